@@ -0,0 +1,15 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignal makes mydns drain ahead of a shutdown.
+var drainSignal os.Signal = syscall.SIGUSR1
@@ -4,92 +4,270 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/execjosh/mydns/internal/blocklist"
-	"github.com/execjosh/mydns/internal/dnsqueryhandler"
+	"github.com/execjosh/mydns"
 	"github.com/execjosh/mydns/internal/iplist"
-	"github.com/execjosh/mydns/internal/roundrobin"
-	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// resolvConfPath is where -nameservers-from-resolv reads nameservers from.
+const resolvConfPath = "/etc/resolv.conf"
+
 func main() {
 	log.SetFlags(log.LstdFlags)
 	log.SetPrefix("mydns: ")
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+
 	flagTCP := flag.Int("tcp", 0, "TCP port")
 	flagUDP := flag.Int("udp", 0, "UDP port")
+	flagDoT := flag.Int("dot", 0, "port to serve DNS over TLS on. requires -tls-cert and -tls-key")
+	flagTLSCert := flag.String("tls-cert", "", "/path/to/cert.pem for DNS over TLS. reloaded on SIGHUP")
+	flagTLSKey := flag.String("tls-key", "", "/path/to/key.pem for DNS over TLS. reloaded on SIGHUP")
+	flagTLSCertReload := flag.Duration("tls-cert-reload", 0, "interval to reload the DNS over TLS certificate at. 0 means only on SIGHUP")
+	flagMaxTCPConns := flag.Int("max-tcp-conns", 0, "maximum number of simultaneously open TCP and DoT client connections. excess connections are closed right away. 0 means unlimited")
+	flagMaxConnQueries := flag.Int("max-conn-queries", 0, "maximum number of queries answered on one TCP or DoT connection before it is closed. 0 means the default of 128")
+	flagTCPIdleTimeout := flag.Duration("tcp-idle-timeout", 0, "how long TCP and DoT connections may be idle, advertised via EDNS0 TCP Keepalive. 0 keeps the default of 8s without advertising it")
+	flagPadding := flag.Int("padding", 0, "block size to pad responses to DoT clients and clients sending EDNS0 Padding to, e.g. 468. 0 disables padding")
 	flagNameservers := iplist.New()
-	flag.Var(flagNameservers, "nameservers", "comma-separated list of IPs for upstream nameservers to be queried round-robin")
-	flagTLSServerName := flag.String("tls-server-name", "", "server name for TLS. if set, enables TLS for upstream queries")
-	flagBlocklistPath := flag.String("blocklist", "", "/path/to/block.list")
+	flag.Var(flagNameservers, "nameservers", "comma-separated list of upstream nameservers to be queried round-robin: IPs, dns://IP:port, tls://IP#name, or https:// URLs")
+	flagNameserversFromResolv := flag.Bool("nameservers-from-resolv", false, "also use the nameservers of "+resolvConfPath+" as upstream nameservers")
+	flagAdaptiveUpstreams := flag.Bool("adaptive-upstreams", false, "pick nameservers weighted toward those with the lowest recent latency instead of round-robin")
+	flagFallbackNameserver := flag.String("fallback-nameserver", "", "nameserver of last resort, only queried once a query to -nameservers has failed")
+	flagTLSServerName := flag.String("tls-server-name", "", "server name for TLS. if set, enables TLS for nameservers given as IPs, and is the default for tls:// nameservers")
+	flagBlocklistPath := flag.String("blocklist", "", "/path/to/block.list, or - to read it from stdin")
+	flagBlocklistBloom := flag.Float64("blocklist-bloom", 0, "false positive rate, e.g. 0.001, of a Bloom filter to hold the blocklist in instead of a map, saving memory on huge blocklists. 0 disables it")
+	flagExportBlocklist := flag.String("export-blocklist", "", "/path/to/file to write the loaded blocklist to in normalized form, one entry per line, on every (re)load")
+	flagBlocklistDNS := flag.String("blocklist-dns", "", "control name whose TXT records hold additional blocklist entries, queried via the upstream nameservers")
+	flagBlocklistDNSRefresh := flag.Duration("blocklist-dns-refresh", time.Hour, "interval to refresh the blocklist at when using -blocklist-dns. 0 means only on SIGHUP")
+	flagFailClosed := flag.Bool("fail-closed", false, "load the blocklist in the background, refusing queries until it is loaded")
+	flagFailOpen := flag.Bool("fail-open", false, "load the blocklist in the background, forwarding queries unfiltered until it is loaded")
+	flagWatchBlocklist := flag.Bool("watch-blocklist", false, "whether to reload the blocklist whenever its file changes on disk")
+	flagReloadDebounce := flag.Duration("reload-debounce", 0, "window within which blocklist reloads triggered by SIGHUP or -watch-blocklist coalesce into one. 0 reloads immediately")
 	flagJSON := flag.Bool("json", false, "whether to output logs as JSON")
+	flagLogLevel := flag.String("log-level", "info", "minimum level of logs: debug, info, warn, or error. debug also dumps upstream queries and responses")
+	flagNoAnswerLog := flag.Bool("no-answer-log", false, "skip the info log line for every record of an upstream answer. blocks and errors are still logged")
+	flagEDNSPassthrough := flag.String("edns-passthrough", "", "comma-separated EDNS0 option codes, e.g. 3 for NSID, to pass from clients to upstream and back. all others are stripped")
+	flagEDNSCookie := flag.Bool("edns-cookie", false, "whether to send DNS Cookies (RFC 7873) to upstream nameservers")
+	flagNormalizeQNAME := flag.Bool("normalize-qname", false, "whether to lowercase the names of queries sent upstream, so queries differing only in case are coalesced")
+	flagMinimalANY := flag.Bool("minimal-any", false, "whether to answer ANY queries with an RFC 8482 HINFO record instead of refusing them")
+	flagMaxUpstreamConcurrency := flag.Int64("max-upstream-concurrency", 0, "maximum number of simultaneous upstream queries. 0 means unlimited")
+	flagUpstreamQueueTimeout := flag.Duration("upstream-queue-timeout", 0, "how long to wait for an upstream query slot before answering SERVFAIL. 0 fails immediately")
+	flagSyslog := flag.String("syslog", "", "where to send block events via syslog: local or network://host:port (e.g. udp://192.0.2.1:514)")
+	flagSyslogFacility := flag.String("syslog-facility", "daemon", "syslog facility for block events")
+	flagTestUpstream := flag.String("test-upstream", "", "send a control query to each nameserver, including the fallback, on startup. `mode` is warn (log failures) or fatal (exit on failure)")
+	flagInspectCNAMEs := flag.Bool("inspect-cnames", true, "whether to block answers with a CNAME record pointing to a blocked name")
+	flagRecursionAvailable := flag.Bool("recursion-available", true, "whether to set the RA bit in responses")
+	flagCompress := flag.Bool("compress", true, "whether to use name compression in responses. disabling it helps legacy clients that mishandle compressed names")
+	flagEDE := flag.Bool("ede", false, "whether to attach Extended DNS Errors (RFC 8914) to blocked and failed responses")
+	flagQueryDeadline := flag.Duration("query-deadline", 0, "maximum total time spent answering a single query before answering SERVFAIL. 0 means no deadline")
+	flagAdmin := flag.String("admin", "", "address for the admin HTTP API, e.g. 127.0.0.1:8053. disabled if empty")
+	flagAdminToken := flag.String("admin-token", "", "bearer token required by the /reload, /check, /quota, /drain, and /maintenance admin endpoints. they are disabled if empty")
+	flagStageOrder := flag.String("stage-order", "", "comma-separated order of the stages queries pass through before being forwarded. defaults to quota,class,whoami,any,type,static,block,suppress")
+	flagHosts := flag.String("hosts", "", "/path/to/hosts file of static records")
+	flagFallbackHosts := flag.String("fallback-hosts", "", "/path/to/hosts file of static records only answered once upstream has failed a query for them")
+	flagCAA := flag.String("caa", "", "/path/to/file of static CAA records")
+	flagTXT := flag.String("txt", "", "/path/to/file of static TXT records, e.g. SPF or DKIM records of internal mail domains")
+	flagDNS64Prefix := flag.String("dns64-prefix", "", "IPv6 prefix to synthesize AAAA records from A records in for NAT64, e.g. 64:ff9b::/96. disabled by default")
+	flagPolicy := flag.String("policy", "", "/path/to/policy file of ordered allow/block rules, evaluated before the blocklist")
+	flagSinkhole := flag.Bool("sinkhole", false, "block every name that is not allowed by the policy file or a blocklist exception")
+	flagBlockIPs := flag.String("block-ips", "", "/path/to/file of CIDRs. queries whose upstream answer contains an IP in one of them are blocked")
+	flagMaxAnswers := flag.Int("max-answers", 0, "maximum number of records in answers to upstream queries. 0 means unlimited")
+	flagMaxQNameLabels := flag.Int("max-qname-labels", 0, "refuse queries for names with more labels than this. 0 means unlimited. names over 253 bytes are always refused")
+	flagClientQuota := flag.String("client-quota", "", "maximum queries per client IP per window, e.g. 10000/24h. queries over it are refused. unlimited if empty")
+	flagBlockMode := flag.String("block-mode", "address", "how to answer blocked queries: address (0.0.0.0/:: or -block-ip4/-block-ip6), hinfo (an HINFO record of -block-hinfo-cpu and -block-hinfo-os), or cname (a CNAME record to -block-cname-target)")
+	flagBlockCNAMETarget := flag.String("block-cname-target", "", "target of the CNAME record in -block-mode cname, e.g. blocked.mynetwork.local")
+	flagBlockHINFOCPU := flag.String("block-hinfo-cpu", "BLOCKED", "CPU string of the HINFO record in -block-mode hinfo")
+	flagBlockHINFOOS := flag.String("block-hinfo-os", "policy", "OS string of the HINFO record in -block-mode hinfo")
+	flagLocalTLD := flag.String("local-tld", "", "comma-separated suffix=IP entries, e.g. test=192.0.2.10, to answer every name under the suffix with, authoritatively. disabled if empty")
+	flagNXDOMAINRedirect := flag.String("nxdomain-redirect", "", "comma-separated IPv4 and/or IPv6 address to answer A/AAAA queries with when upstream answers NXDOMAIN, e.g. for an error page. hijacks NXDOMAIN: breaks typo detection, mail delivery checks, and anything else relying on it. disabled if empty")
+	flagBlockIP4 := flag.String("block-ip4", "", "IPv4 address to answer blocked A queries with, e.g. a sinkhole. defaults to 0.0.0.0")
+	flagBlockIP6 := flag.String("block-ip6", "", "IPv6 address to answer blocked AAAA queries with, e.g. a sinkhole. defaults to ::")
+	flagUnsupportedClassRcode := flag.String("unsupported-class-rcode", "refused", "rcode for questions of classes other than INET, e.g. refused, notimp, or noerror")
+	flagUnsupportedTypeRcode := flag.String("unsupported-type-rcode", "refused", "rcode for questions of unsupported types, e.g. refused, notimp, or noerror")
+	flagUnsupportedOpcodeRcode := flag.String("unsupported-opcode-rcode", "refused", "rcode for messages with opcodes other than QUERY, e.g. refused or notimp")
+	flagMaintenanceRcode := flag.String("maintenance-rcode", "servfail", "rcode to answer all queries with in maintenance mode, toggled with SIGUSR2 or POST /maintenance")
+	flagWhoami := flag.String("whoami-name", "", "name to answer with the client's own IP as A/AAAA and TXT records, e.g. whoami.mydns. disabled if empty")
+	flagWorkers := flag.Int("workers", 0, "number of goroutines handling queries. 0 means one per query")
+	flagUpstreamPool := flag.Int("upstream-pool", 0, "number of connections per DNS over TLS nameserver to keep open for reuse, and idle connections per DNS over HTTPS host. 0 dials one per DNS over TLS query")
+	flagUpstreamPoolIdle := flag.Duration("upstream-pool-idle", 10*time.Second, "how long pooled DNS over TLS and DNS over HTTPS connections may be idle before they are closed")
+	flagAllowUpstreamOverride := flag.Bool("allow-upstream-override", false, "let clients pick the upstream nameserver of a query for debugging, e.g. example.com.via.192-0-2-1")
+	flagRetryWindow := flag.Duration("retry-window", 0, "how long to keep retrying failed upstream queries against the next nameserver. 0 disables retries")
+	flagRetryBackoff := flag.Duration("retry-backoff", 5*time.Millisecond, "how long to wait between upstream retries. jittered by up to 25%")
+	flagRetryRcodes := flag.String("retry-rcodes", "servfail", "comma-separated rcodes that make upstream queries be retried against the next nameserver. disabled if empty")
+	flagMaxRcodeRetries := flag.Int("max-rcode-retries", 2, "how many times to retry an upstream query because of its rcode")
+	flagUDPRcvbuf := flag.Int("udp-rcvbuf", 0, "receive buffer size of the UDP listener in bytes (SO_RCVBUF). 0 keeps the system default")
+	flagUDPSndbuf := flag.Int("udp-sndbuf", 0, "send buffer size of the UDP listener in bytes (SO_SNDBUF). 0 keeps the system default")
+	flagDSCP := flag.Int("dscp", 0, "DSCP value (0-63) to mark listener and upstream traffic with. only supported on Linux, macOS, and FreeBSD")
+	flagSuppressTypes := flag.String("suppress-types", "", "/path/to/file of domain:TYPE entries, e.g. example.com:AAAA, answered with NODATA instead of being forwarded")
+	flagUpstreamSource := flag.String("upstream-source", "", "local IP to send upstream queries from")
 	flag.Parse()
 
-	logger := initLogger(*flagJSON)
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(*flagLogLevel)); err != nil {
+		log.Fatalf("invalid log level: %q", *flagLogLevel)
+	}
+
+	logger := initLogger(*flagJSON, level)
 	defer logger.Sync()
 
-	if *flagTCP <= 0 && *flagUDP <= 0 {
-		logger.Fatal("at least one port for TCP or UDP must be specified")
+	if *flagNameserversFromResolv {
+		n, err := flagNameservers.LoadResolvConf(resolvConfPath)
+		if err != nil {
+			logger.Fatal("invalid configuration", zap.Error(err))
+		}
+		logger.Info("read nameservers", zap.String("path", resolvConfPath), zap.Int("count", n))
 	}
 
-	uniqListOfNameservers := flagNameservers.Uniq()
-	if len(uniqListOfNameservers) < 1 {
-		logger.Fatal("at least one nameserver required!")
+	var stageOrder []string
+	if len(*flagStageOrder) > 0 {
+		stageOrder = strings.Split(*flagStageOrder, ",")
 	}
-	upstreamPort := ":53"
-	if len(*flagTLSServerName) > 0 {
-		upstreamPort = ":853"
-	}
-	for idx, val := range uniqListOfNameservers {
-		uniqListOfNameservers[idx] = val + upstreamPort
+
+	var localTLDs []string
+	if len(*flagLocalTLD) > 0 {
+		localTLDs = strings.Split(*flagLocalTLD, ",")
 	}
-	nameservers := roundrobin.New(uniqListOfNameservers)
-	logger.Info("upstream servers", zap.Strings("nameservers", uniqListOfNameservers))
 
-	blocklist, blockCnt, err := loadBlocklist(*flagBlocklistPath)
-	if err != nil {
-		logger.Error("failed to load blocklist", zap.Error(err))
+	var nxdomainRedirect []string
+	if len(*flagNXDOMAINRedirect) > 0 {
+		nxdomainRedirect = strings.Split(*flagNXDOMAINRedirect, ",")
 	}
-	logger.Info(fmt.Sprintf("Blocking %d domains from %q", blockCnt, *flagBlocklistPath))
 
-	dnsCli := &dns.Client{
-		DialTimeout:    2 * time.Second,
-		ReadTimeout:    2 * time.Second,
-		WriteTimeout:   2 * time.Second,
-		SingleInflight: true,
+	var ednsPassthrough []string
+	if len(*flagEDNSPassthrough) > 0 {
+		ednsPassthrough = strings.Split(*flagEDNSPassthrough, ",")
 	}
-	if len(*flagTLSServerName) > 0 {
-		dnsCli.Net = "tcp-tls"
-		dnsCli.TLSConfig = &tls.Config{
-			ServerName: *flagTLSServerName,
-			MinVersion: tls.VersionTLS13,
-		}
+
+	var retryRcodes []string
+	if len(*flagRetryRcodes) > 0 {
+		retryRcodes = strings.Split(*flagRetryRcodes, ",")
 	}
 
-	srv := dnsqueryhandler.New(
-		logger,
-		dnsCli,
-		nameservers,
-		blocklist,
-	)
-	dns.HandleFunc(".", srv.HandleAandAAAA)
+	srv, err := mydns.NewServer(mydns.Options{
+		Logger:        logger,
+		TCPPort:       *flagTCP,
+		UDPPort:       *flagUDP,
+		Nameservers:   flagNameservers.Uniq(),
+		TLSServerName: *flagTLSServerName,
+
+		AdaptiveUpstreams: *flagAdaptiveUpstreams,
+
+		FallbackNameserver: *flagFallbackNameserver,
+
+		DoTPort:               *flagDoT,
+		TLSCertPath:           *flagTLSCert,
+		TLSKeyPath:            *flagTLSKey,
+		TLSCertReloadInterval: *flagTLSCertReload,
+		TCPIdleTimeout:        *flagTCPIdleTimeout,
+		MaxTCPConns:           *flagMaxTCPConns,
+		MaxConnQueries:        *flagMaxConnQueries,
+		PaddingBlockSize:      *flagPadding,
+
+		UpstreamSource: *flagUpstreamSource,
+		RetryWindow:    *flagRetryWindow,
+		RetryBackoff:   *flagRetryBackoff,
+		DSCP:           *flagDSCP,
+
+		UDPReceiveBuffer: *flagUDPRcvbuf,
+		UDPSendBuffer:    *flagUDPSndbuf,
+
+		RetryRcodes:     retryRcodes,
+		MaxRcodeRetries: *flagMaxRcodeRetries,
+
+		UpstreamPoolSize:        *flagUpstreamPool,
+		UpstreamPoolIdleTimeout: *flagUpstreamPoolIdle,
+
+		AllowUpstreamOverride: *flagAllowUpstreamOverride,
+
+		BlocklistPath:   *flagBlocklistPath,
+		EDNSCookie:      *flagEDNSCookie,
+		EDNSPassthrough: ednsPassthrough,
+		MinimalANY:      *flagMinimalANY,
+		NormalizeQNAME:  *flagNormalizeQNAME,
+
+		BlocklistBloomRate:  *flagBlocklistBloom,
+		BlocklistExportPath: *flagExportBlocklist,
+		BlocklistDNSName:    *flagBlocklistDNS,
+		BlocklistDNSRefresh: *flagBlocklistDNSRefresh,
+		FailClosed:          *flagFailClosed,
+		FailOpen:            *flagFailOpen,
+		WatchBlocklist:      *flagWatchBlocklist,
+		ReloadDebounce:      *flagReloadDebounce,
+
+		MaxUpstreamConcurrency: *flagMaxUpstreamConcurrency,
+		UpstreamQueueTimeout:   *flagUpstreamQueueTimeout,
+		Workers:                *flagWorkers,
+
+		SyslogAddr:     *flagSyslog,
+		SyslogFacility: *flagSyslogFacility,
+
+		TestUpstream: *flagTestUpstream,
+
+		DisableCompression:        !*flagCompress,
+		DisableRecursionAvailable: !*flagRecursionAvailable,
+		DisableCNAMEInspection:    !*flagInspectCNAMEs,
+		DisableAnswerLog:          *flagNoAnswerLog,
+		ExtendedErrors:            *flagEDE,
+		QueryDeadline:             *flagQueryDeadline,
+
+		UnsupportedClassRcode:  *flagUnsupportedClassRcode,
+		UnsupportedTypeRcode:   *flagUnsupportedTypeRcode,
+		UnsupportedOpcodeRcode: *flagUnsupportedOpcodeRcode,
+		MaintenanceRcode:       *flagMaintenanceRcode,
+
+		WhoamiName: *flagWhoami,
+
+		MaxAnswers:     *flagMaxAnswers,
+		MaxQNameLabels: *flagMaxQNameLabels,
+		ClientQuota:    *flagClientQuota,
 
-	if *flagUDP > 0 {
-		go listenAndServe(logger, *flagUDP, "udp")
+		BlockMode:     *flagBlockMode,
+		BlockHINFOCPU: *flagBlockHINFOCPU,
+		BlockHINFOOS:  *flagBlockHINFOOS,
+
+		BlockCNAMETarget: *flagBlockCNAMETarget,
+
+		BlockIP4: *flagBlockIP4,
+		BlockIP6: *flagBlockIP6,
+
+		NXDOMAINRedirect: nxdomainRedirect,
+		LocalTLDs:        localTLDs,
+
+		StageOrder: stageOrder,
+
+		HostsPath:         *flagHosts,
+		FallbackHostsPath: *flagFallbackHosts,
+		CAAPath:           *flagCAA,
+		TXTPath:           *flagTXT,
+		DNS64Prefix:       *flagDNS64Prefix,
+		PolicyPath:        *flagPolicy,
+		Sinkhole:          *flagSinkhole,
+		BlockedIPsPath:    *flagBlockIPs,
+
+		SuppressTypesPath: *flagSuppressTypes,
+
+		AdminAddr:  *flagAdmin,
+		AdminToken: *flagAdminToken,
+	})
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
 	}
-	if *flagTCP > 0 {
-		go listenAndServe(logger, *flagTCP, "tcp")
+
+	if err := srv.Start(); err != nil {
+		logger.Fatal("failed to start", zap.Error(err))
 	}
 
 	var m runtime.MemStats
@@ -99,12 +277,40 @@ func main() {
 		zap.Uint64("Sys", m.Sys),
 	)
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if drainSignal != nil {
+		signal.Notify(sig, drainSignal)
+	}
+	if maintenanceSignal != nil {
+		signal.Notify(sig, maintenanceSignal)
+	}
+	for s := range sig {
+		if drainSignal != nil && s == drainSignal {
+			srv.Drain()
+			continue
+		}
+		if maintenanceSignal != nil && s == maintenanceSignal {
+			srv.SetMaintenance(!srv.InMaintenance())
+			continue
+		}
+		if s != syscall.SIGHUP {
+			break
+		}
+		srv.ScheduleBlocklistReload()
+		if err := srv.ReloadTLSCertificate(); err != nil {
+			logger.Error("failed to reload TLS certificate", zap.Error(err))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("failed to shut down", zap.Error(err))
+	}
 }
 
-func initLogger(useJSON bool) *zap.Logger {
+func initLogger(useJSON bool, level zapcore.Level) *zap.Logger {
 	pec := zap.NewProductionEncoderConfig()
 	pec.EncodeTime = zapcore.ISO8601TimeEncoder
 	pec.EncodeLevel = zapcore.CapitalLevelEncoder
@@ -114,27 +320,5 @@ func initLogger(useJSON bool) *zap.Logger {
 		newEnc = zapcore.NewJSONEncoder
 	}
 
-	return zap.New(zapcore.NewCore(newEnc(pec), zapcore.AddSync(os.Stdout), zap.InfoLevel))
-}
-
-func listenAndServe(logger *zap.Logger, port int, network string) {
-	srv := &dns.Server{Addr: fmt.Sprintf(":%d", port), Net: network}
-	logger.Info(fmt.Sprintf("listening at %s (%s)", srv.Addr, srv.Net))
-	if err := srv.ListenAndServe(); err != nil {
-		logger.Fatal("listenAndServe failed", zap.Error(err))
-	}
-}
-
-func loadBlocklist(filepath string) (*blocklist.Blocklist, uint, error) {
-	if len(filepath) < 1 {
-		return blocklist.Empty(), 0, nil
-	}
-
-	f, err := os.Open(filepath)
-	if err != nil {
-		return blocklist.Empty(), 0, fmt.Errorf("opening blocklist: %w", err)
-	}
-	defer f.Close()
-
-	return blocklist.Load(f)
+	return zap.New(zapcore.NewCore(newEnc(pec), zapcore.AddSync(os.Stdout), level))
 }
@@ -0,0 +1,13 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// maintenanceSignal is nil, as there is no signal to spare; use the admin
+// API's `POST /maintenance` instead.
+var maintenanceSignal os.Signal
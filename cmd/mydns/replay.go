@@ -0,0 +1,108 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/execjosh/mydns/internal/blocklist"
+	"github.com/execjosh/mydns/internal/dnsqueryhandler"
+	"github.com/execjosh/mydns/internal/policy"
+	"github.com/execjosh/mydns/internal/replay"
+	"github.com/execjosh/mydns/internal/roundrobin"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// replayMain implements `mydns replay`, which replays the queries of JSON logs
+// against a new blocklist and policy, and reports the names whose outcome
+// changed. It returns the exit code.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mydns replay [flags] querylog.json")
+		fs.PrintDefaults()
+	}
+	flagBlocklist := fs.String("blocklist", "", "/path/to/blocklist to replay against")
+	flagPolicy := fs.String("policy", "", "/path/to/policy file to replay against")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	queries, err := readQueries(fs.Arg(0))
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	bl := blocklist.Empty()
+	if len(*flagBlocklist) > 0 {
+		if err := loadFile(*flagBlocklist, func(r io.Reader) (err error) {
+			bl, _, err = blocklist.Load(r)
+			return err
+		}); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+
+	rec := &replay.Recorder{}
+	opts := []dnsqueryhandler.Option{dnsqueryhandler.WithBlockReporter(rec)}
+	if len(*flagPolicy) > 0 {
+		var p *policy.Policy
+		if err := loadFile(*flagPolicy, func(r io.Reader) (err error) {
+			p, _, err = policy.Load(r)
+			return err
+		}); err != nil {
+			log.Print(err)
+			return 1
+		}
+		opts = append(opts, dnsqueryhandler.WithPolicy(p))
+	}
+	h := dnsqueryhandler.New(zap.NewNop(), replay.Exchanger{}, roundrobin.New([]string{"replay"}), bl, opts...)
+
+	changes := replay.Run(dns.HandlerFunc(h.HandleAandAAAA), rec, queries)
+	var blocked, allowed int
+	for _, c := range changes {
+		if c.Blocked {
+			blocked++
+		} else {
+			allowed++
+		}
+	}
+	fmt.Printf("replayed %d queries: %d names newly blocked, %d newly allowed\n", len(queries), blocked, allowed)
+	for _, c := range changes {
+		sign := "-"
+		if c.Blocked {
+			sign = "+"
+		}
+		fmt.Printf("%s %s %s (%d queries)\n", sign, c.FQDN, dns.TypeToString[c.Qtype], c.Count)
+	}
+	return 0
+}
+
+func readQueries(path string) ([]replay.Query, error) {
+	var queries []replay.Query
+	err := loadFile(path, func(r io.Reader) (err error) {
+		queries, err = replay.Read(r)
+		return err
+	})
+	return queries, err
+}
+
+func loadFile(path string, load func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return load(f)
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package mydns
+
+import "sync/atomic"
+
+// drainState is set once the server has started draining. It cannot be unset.
+type drainState struct {
+	draining int32
+}
+
+// Draining returns whether the server is draining.
+func (d *drainState) Draining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// start starts draining, returning false if it already had.
+func (d *drainState) start() bool {
+	return atomic.CompareAndSwapInt32(&d.draining, 0, 1)
+}
+
+// Drain makes the server refuse new queries and report itself unhealthy via
+// the admin API's `/healthz`, so that load balancers stop routing to it, while
+// queries that are already being handled are answered. It is meant to be
+// followed by Shutdown once traffic has moved elsewhere, and cannot be undone.
+func (s *Server) Drain() {
+	if s.drain.start() {
+		s.logger.Info("draining: refusing new queries")
+	}
+}
+
+// Draining returns whether Drain has been called.
+func (s *Server) Draining() bool {
+	return s.drain.Draining()
+}
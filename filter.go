@@ -0,0 +1,38 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package mydns
+
+import (
+	"github.com/execjosh/mydns/internal/responsefilter"
+	"github.com/miekg/dns"
+)
+
+// ResponseFilter inspects and optionally rewrites responses before they are
+// written to clients. Filter may modify resp in place, or return another
+// response to send instead; returning nil leaves resp unchanged. It is called
+// concurrently.
+type ResponseFilter interface {
+	Filter(q dns.Question, resp *dns.Msg) *dns.Msg
+}
+
+// ResponseFilterFunc adapts a function to a ResponseFilter.
+type ResponseFilterFunc func(q dns.Question, resp *dns.Msg) *dns.Msg
+
+// Filter calls f(q, resp).
+func (f ResponseFilterFunc) Filter(q dns.Question, resp *dns.Msg) *dns.Msg {
+	return f(q, resp)
+}
+
+// StripTypes returns a ResponseFilter that removes records of qtypes from the
+// answer and authority sections.
+func StripTypes(qtypes ...uint16) ResponseFilter {
+	return responsefilter.NewStripTypes(qtypes...)
+}
+
+// RewriteIPs returns a ResponseFilter that replaces IPs in A and AAAA answers,
+// e.g. for split-horizon NAT. rewrites maps IPs to their replacements, which
+// must be of the same family.
+func RewriteIPs(rewrites map[string]string) (ResponseFilter, error) {
+	return responsefilter.NewRewriteIPs(rewrites)
+}
@@ -5,4 +5,5 @@ go 1.15
 require (
 	github.com/miekg/dns v1.1.35
 	go.uber.org/zap v1.16.0
+	golang.org/x/sync v0.0.0-20190423024810-112230192c58
 )
@@ -0,0 +1,143 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package adaptive
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// alpha is the weight of a new round-trip time in the moving average.
+	alpha = 0.3
+	// explore is the share of picks spread evenly across all nameservers.
+	explore = 0.05
+)
+
+type exchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+// Chooser picks nameservers at random, weighted toward the fastest ones. It
+// keeps an exponentially weighted moving average (EWMA) of the round-trip times
+// observed for each nameserver, and picks one with a chance inversely
+// proportional to the square of its average. A small share of picks is spread
+// evenly regardless, so that slow nameservers are still probed and their
+// recovery is noticed.
+//
+// Nameservers without any observations yet are weighted like the fastest one,
+// so that they are tried early.
+type Chooser struct {
+	list    []string
+	avg     map[string]float64 // zero until the first observation
+	penalty time.Duration
+	mu      sync.Mutex
+}
+
+// New returns a new Chooser for ss, which is copied. Failed exchanges count as
+// taking penalty, which should be about the exchange timeout.
+func New(ss []string, penalty time.Duration) *Chooser {
+	c := &Chooser{
+		list:    make([]string, len(ss)),
+		avg:     make(map[string]float64, len(ss)),
+		penalty: penalty,
+	}
+	copy(c.list, ss)
+	for _, s := range ss {
+		c.avg[s] = 0
+	}
+	return c
+}
+
+// Next returns the next nameserver to query.
+func (c *Chooser) Next() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.list) == 1 || rand.Float64() < explore {
+		return c.list[rand.Intn(len(c.list))]
+	}
+
+	fastest := 0.0
+	for _, avg := range c.avg {
+		if avg > 0 && (fastest == 0 || avg < fastest) {
+			fastest = avg
+		}
+	}
+	if fastest == 0 {
+		return c.list[rand.Intn(len(c.list))]
+	}
+
+	weights := make([]float64, len(c.list))
+	total := 0.0
+	for i, s := range c.list {
+		avg := c.avg[s]
+		if avg == 0 {
+			avg = fastest
+		}
+		weights[i] = 1 / (avg * avg)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return c.list[i]
+		}
+		r -= w
+	}
+	return c.list[len(c.list)-1]
+}
+
+// Observe adds rtt to the moving average of nameserver. Nameservers that are
+// not chosen from are ignored.
+func (c *Chooser) Observe(nameserver string, rtt time.Duration) {
+	// an average of zero means unobserved, and weights divide by it
+	sample := float64(rtt)
+	if sample < float64(time.Microsecond) {
+		sample = float64(time.Microsecond)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	avg, ok := c.avg[nameserver]
+	if !ok {
+		return
+	}
+	if avg == 0 {
+		c.avg[nameserver] = sample
+		return
+	}
+	c.avg[nameserver] = avg + alpha*(sample-avg)
+}
+
+// Exchanger feeds the round-trip times of the exchanges of the wrapped
+// exchanger into a Chooser.
+type Exchanger struct {
+	exchanger exchanger
+	chooser   *Chooser
+}
+
+// Wrap returns a new Exchanger wrapping e, which observes its round-trip times
+// with c.
+func (c *Chooser) Wrap(e exchanger) *Exchanger {
+	return &Exchanger{
+		exchanger: e,
+		chooser:   c,
+	}
+}
+
+// Exchange implements the exchanger interface of the wrapped exchanger.
+func (e *Exchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	res, rtt, err := e.exchanger.Exchange(m, address)
+	if err != nil {
+		e.chooser.Observe(address, e.chooser.penalty)
+	} else {
+		e.chooser.Observe(address, rtt)
+	}
+	return res, rtt, err
+}
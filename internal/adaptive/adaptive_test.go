@@ -0,0 +1,118 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package adaptive_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/adaptive"
+	"github.com/miekg/dns"
+)
+
+const picks = 10000
+
+// latencyExchanger is a fake latency source: every exchange with an address
+// takes the round-trip time given for it, or fails if there is none.
+type latencyExchanger map[string]time.Duration
+
+func (e latencyExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	rtt, ok := e[address]
+	if !ok {
+		return nil, 0, errors.New("timeout")
+	}
+	return m, rtt, nil
+}
+
+func countPicks(c *adaptive.Chooser) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < picks; i++ {
+		counts[c.Next()]++
+	}
+	return counts
+}
+
+func TestNextUnobserved(t *testing.T) {
+	c := adaptive.New([]string{"a", "b"}, time.Second)
+
+	counts := countPicks(c)
+	for _, s := range []string{"a", "b"} {
+		if counts[s] < picks*4/10 {
+			t.Errorf("expected %s to get about half of the picks; got %d of %d", s, counts[s], picks)
+		}
+	}
+}
+
+func TestNextPrefersFaster(t *testing.T) {
+	c := adaptive.New([]string{"a", "b", "c"}, time.Second)
+	for i := 0; i < 5; i++ {
+		c.Observe("a", 10*time.Millisecond)
+		c.Observe("b", 100*time.Millisecond)
+	}
+
+	counts := countPicks(c)
+	if counts["b"] < 1 {
+		t.Error("expected slow b to still be probed")
+	}
+	if counts["b"] > picks/10 {
+		t.Errorf("expected slow b to get few picks; got %d of %d", counts["b"], picks)
+	}
+	// c has not been observed, so it is weighted like the fastest
+	for _, s := range []string{"a", "c"} {
+		if counts[s] < picks*4/10 {
+			t.Errorf("expected %s to get about half of the picks; got %d of %d", s, counts[s], picks)
+		}
+	}
+}
+
+func TestNextRecovery(t *testing.T) {
+	c := adaptive.New([]string{"a", "b"}, time.Second)
+	c.Observe("a", 10*time.Millisecond)
+	c.Observe("b", time.Second)
+	for i := 0; i < 20; i++ {
+		c.Observe("b", 10*time.Millisecond)
+	}
+
+	if counts := countPicks(c); counts["b"] < picks*4/10 {
+		t.Errorf("expected recovered b to get about half of the picks; got %d of %d", counts["b"], picks)
+	}
+}
+
+func TestExchanger(t *testing.T) {
+	c := adaptive.New([]string{"fast", "slow", "down"}, time.Second)
+	e := c.Wrap(latencyExchanger{
+		"fast": 5 * time.Millisecond,
+		"slow": 50 * time.Millisecond,
+	})
+
+	for _, s := range []string{"fast", "slow", "down"} {
+		m := &dns.Msg{}
+		res, _, err := e.Exchange(m, s)
+		if s == "down" {
+			if err == nil {
+				t.Error("expected error to be passed through")
+			}
+			continue
+		}
+		if err != nil || res != m {
+			t.Errorf("expected %s response to be passed through; got %v, %v", s, res, err)
+		}
+	}
+	// unknown nameservers, e.g. a fallback, are ignored
+	if _, _, err := e.Exchange(&dns.Msg{}, "other"); err == nil {
+		t.Error("expected error to be passed through")
+	}
+
+	counts := countPicks(c)
+	if counts["fast"] < picks*8/10 {
+		t.Errorf("expected fast to get most picks; got %d of %d", counts["fast"], picks)
+	}
+	if counts["slow"] < 1 || counts["down"] < 1 {
+		t.Errorf("expected slow and down to still be probed; got %v", counts)
+	}
+	if counts["down"] >= counts["slow"] {
+		t.Errorf("expected down to get fewer picks than slow; got %v", counts)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// metricsPrefix is the prefix of the expvar vars served at `/metrics`.
+const metricsPrefix = "mydns_"
+
+type server interface {
+	ReloadBlocklist() (before uint, after uint, err error)
+	MatchBlocklist(fqdn string) (entry string, blocked bool)
+	ClientQuota(ip net.IP) (limit uint64, remaining uint64, reset time.Time, ok bool)
+	Drain()
+	Draining() bool
+	SetMaintenance(on bool)
+	InMaintenance() bool
+}
+
+// Admin serves the admin HTTP API:
+//   - `GET /healthz` reports whether the server is up, failing with 503 once
+//     it is draining or while it is in maintenance mode
+//   - `GET /metrics` exposes the expvar metrics prefixed with `mydns_` as JSON
+//   - `POST /reload` reloads the blocklist (requires the admin token)
+//   - `GET /check?domain=<fqdn>` reports whether a domain is blocked and by
+//     which entry (requires the admin token)
+//   - `GET /quota?ip=<ip>` reports the remaining query quota of a client
+//     (requires the admin token)
+//   - `POST /drain` makes the server refuse new queries ahead of a shutdown
+//     (requires the admin token)
+//   - `POST /maintenance?enabled=<bool>` enters or leaves maintenance mode
+//     (requires the admin token)
+type Admin struct {
+	logger *zap.Logger
+	token  string
+	srv    server
+	mux    *http.ServeMux
+}
+
+var _ http.Handler = (*Admin)(nil)
+
+// New returns a new instance of Admin. Endpoints that require authentication
+// expect `Authorization: Bearer <token>`; if token is empty, they are
+// disabled.
+func New(logger *zap.Logger, token string, srv server) *Admin {
+	a := &Admin{
+		logger: logger,
+		token:  token,
+		srv:    srv,
+		mux:    http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("/healthz", a.handleHealthz)
+	a.mux.HandleFunc("/metrics", a.handleMetrics)
+	a.mux.HandleFunc("/reload", a.authenticated(http.MethodPost, a.handleReload))
+	a.mux.HandleFunc("/check", a.authenticated(http.MethodGet, a.handleCheck))
+	a.mux.HandleFunc("/quota", a.authenticated(http.MethodGet, a.handleQuota))
+	a.mux.HandleFunc("/drain", a.authenticated(http.MethodPost, a.handleDrain))
+	a.mux.HandleFunc("/maintenance", a.authenticated(http.MethodPost, a.handleMaintenance))
+
+	return a
+}
+
+// ServeHTTP implements `http.Handler`
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Admin) authenticated(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if len(a.token) < 1 {
+			writeError(w, http.StatusForbidden, "no admin token configured")
+			return
+		}
+
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func (a *Admin) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if a.srv.Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if a.srv.InMaintenance() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "maintenance"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleMetrics serves the expvar vars of mydns like `expvar.Handler`. Unlike
+// it, the built-in `cmdline` and `memstats` are left out, as `cmdline` holds the
+// admin token and the endpoint does not require it.
+func (a *Admin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !strings.HasPrefix(kv.Key, metricsPrefix) {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",")
+		}
+		first = false
+		fmt.Fprintf(w, "\n%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
+
+func (a *Admin) handleDrain(w http.ResponseWriter, r *http.Request) {
+	a.srv.Drain()
+	a.logger.Info("draining via admin API")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "draining"})
+}
+
+func (a *Admin) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid enabled")
+		return
+	}
+
+	a.srv.SetMaintenance(on)
+	a.logger.Info("toggled maintenance mode via admin API", zap.Bool("enabled", on))
+	writeJSON(w, http.StatusOK, struct {
+		Maintenance bool `json:"maintenance"`
+	}{a.srv.InMaintenance()})
+}
+
+func (a *Admin) handleReload(w http.ResponseWriter, r *http.Request) {
+	before, after, err := a.srv.ReloadBlocklist()
+	if err != nil {
+		a.logger.Error("failed to reload blocklist via admin API", zap.Error(err))
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.logger.Info("reloaded blocklist via admin API",
+		zap.Uint("before", before),
+		zap.Uint("after", after),
+	)
+	writeJSON(w, http.StatusOK, struct {
+		Before uint `json:"before"`
+		After  uint `json:"after"`
+	}{before, after})
+}
+
+func (a *Admin) handleCheck(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	if _, ok := dns.IsDomainName(domain); !ok || len(domain) < 1 {
+		writeError(w, http.StatusBadRequest, "invalid domain")
+		return
+	}
+	fqdn := dns.CanonicalName(domain)
+
+	entry, blocked := a.srv.MatchBlocklist(fqdn)
+	writeJSON(w, http.StatusOK, struct {
+		Domain  string `json:"domain"`
+		Blocked bool   `json:"blocked"`
+		Entry   string `json:"entry,omitempty"`
+	}{fqdn, blocked, entry})
+}
+
+func (a *Admin) handleQuota(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "invalid ip")
+		return
+	}
+
+	limit, remaining, reset, ok := a.srv.ClientQuota(ip)
+	if !ok {
+		writeError(w, http.StatusNotFound, "client quotas are disabled")
+		return
+	}
+
+	var resetAt *time.Time
+	if !reset.IsZero() {
+		resetAt = &reset
+	}
+	writeJSON(w, http.StatusOK, struct {
+		IP        string     `json:"ip"`
+		Limit     uint64     `json:"limit"`
+		Remaining uint64     `json:"remaining"`
+		Reset     *time.Time `json:"reset,omitempty"`
+	}{ip.String(), limit, remaining, resetAt})
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
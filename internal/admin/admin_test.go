@@ -0,0 +1,265 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package admin_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/admin"
+	_ "github.com/execjosh/mydns/internal/metrics"
+	"go.uber.org/zap"
+)
+
+type fakeServer struct {
+	reloads     int
+	draining    bool
+	maintenance bool
+}
+
+func (s *fakeServer) ReloadBlocklist() (uint, uint, error) {
+	s.reloads++
+	return 3, 5, nil
+}
+
+func (s *fakeServer) MatchBlocklist(fqdn string) (string, bool) {
+	switch fqdn {
+	case "ads.example.com.":
+		return "*.example.com.", true
+	case "www.example.com.":
+		return "@@www.example.com.", false
+	}
+	return "", false
+}
+
+func (s *fakeServer) ClientQuota(ip net.IP) (uint64, uint64, time.Time, bool) {
+	if ip.Equal(net.ParseIP("192.0.2.10")) {
+		return 100, 42, time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), true
+	}
+	return 100, 100, time.Time{}, true
+}
+
+func (s *fakeServer) Drain() {
+	s.draining = true
+}
+
+func (s *fakeServer) Draining() bool {
+	return s.draining
+}
+
+func (s *fakeServer) SetMaintenance(on bool) {
+	s.maintenance = on
+}
+
+func (s *fakeServer) InMaintenance() bool {
+	return s.maintenance
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		auth       string
+		wantStatus int
+		wantReload bool
+	}{
+		{"valid token", "s3cret", http.MethodPost, "Bearer s3cret", http.StatusOK, true},
+		{"wrong token", "s3cret", http.MethodPost, "Bearer nope", http.StatusUnauthorized, false},
+		{"missing token", "s3cret", http.MethodPost, "", http.StatusUnauthorized, false},
+		{"no token configured", "", http.MethodPost, "Bearer ", http.StatusForbidden, false},
+		{"wrong method", "s3cret", http.MethodGet, "Bearer s3cret", http.StatusMethodNotAllowed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &fakeServer{}
+			a := admin.New(zap.NewNop(), tt.token, srv)
+
+			req := httptest.NewRequest(tt.method, "/reload", nil)
+			if len(tt.auth) > 0 {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			a.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d; got %d", tt.wantStatus, rec.Code)
+			}
+			if got := srv.reloads > 0; got != tt.wantReload {
+				t.Errorf("expected reload to be %v", tt.wantReload)
+			}
+			if tt.wantReload {
+				if got, want := strings.TrimSpace(rec.Body.String()), `{"before":3,"after":5}`; got != want {
+					t.Errorf("expected body %s; got %s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	args := os.Args
+	os.Args = append([]string{"mydns", "-admin-token", "s3cret"}, args[1:]...)
+	defer func() { os.Args = args }()
+
+	a := admin.New(zap.NewNop(), "s3cret", &fakeServer{})
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("expected JSON; got %v", err)
+	}
+	if _, ok := vars["mydns_upstream_inflight"]; !ok {
+		t.Error("expected mydns metrics")
+	}
+	for name := range vars {
+		if !strings.HasPrefix(name, "mydns_") {
+			t.Errorf("expected only mydns metrics; got %q", name)
+		}
+	}
+	if strings.Contains(rec.Body.String(), "s3cret") {
+		t.Error("expected the admin token not to be exposed")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		query      string
+		auth       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"domain=ADS.example.com", "Bearer s3cret", http.StatusOK, `{"domain":"ads.example.com.","blocked":true,"entry":"*.example.com."}`},
+		{"domain=www.example.com.", "Bearer s3cret", http.StatusOK, `{"domain":"www.example.com.","blocked":false,"entry":"@@www.example.com."}`},
+		{"domain=example.net", "Bearer s3cret", http.StatusOK, `{"domain":"example.net.","blocked":false}`},
+		{"", "Bearer s3cret", http.StatusBadRequest, `{"error":"invalid domain"}`},
+		{"domain=ads.example.com", "", http.StatusUnauthorized, `{"error":"invalid admin token"}`},
+	}
+
+	a := admin.New(zap.NewNop(), "s3cret", &fakeServer{})
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/check?"+tt.query, nil)
+		if len(tt.auth) > 0 {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%q: expected status %d; got %d", tt.query, tt.wantStatus, rec.Code)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+			t.Errorf("%q: expected body %s; got %s", tt.query, tt.wantBody, got)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"ip=192.0.2.10", http.StatusOK, `{"ip":"192.0.2.10","limit":100,"remaining":42,"reset":"2021-01-02T00:00:00Z"}`},
+		{"ip=192.0.2.11", http.StatusOK, `{"ip":"192.0.2.11","limit":100,"remaining":100}`},
+		{"ip=guest", http.StatusBadRequest, `{"error":"invalid ip"}`},
+	}
+
+	a := admin.New(zap.NewNop(), "s3cret", &fakeServer{})
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/quota?"+tt.query, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%q: expected status %d; got %d", tt.query, tt.wantStatus, rec.Code)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+			t.Errorf("%q: expected body %s; got %s", tt.query, tt.wantBody, got)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	srv := &fakeServer{}
+	a := admin.New(zap.NewNop(), "s3cret", srv)
+
+	healthz := func() int {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+
+	if code := healthz(); code != http.StatusOK {
+		t.Errorf("expected healthz status %d before draining; got %d", http.StatusOK, code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/drain", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected drain status %d; got %d", http.StatusOK, rec.Code)
+	}
+	if !srv.draining {
+		t.Error("expected server to be draining")
+	}
+
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected healthz status %d while draining; got %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	srv := &fakeServer{}
+	a := admin.New(zap.NewNop(), "s3cret", srv)
+
+	healthz := func() int {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+	maintenance := func(enabled string) int {
+		req := httptest.NewRequest(http.MethodPost, "/maintenance?enabled="+enabled, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := maintenance("true"); code != http.StatusOK {
+		t.Errorf("expected maintenance status %d; got %d", http.StatusOK, code)
+	}
+	if !srv.maintenance {
+		t.Error("expected server to be in maintenance mode")
+	}
+	if code := healthz(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected healthz status %d in maintenance mode; got %d", http.StatusServiceUnavailable, code)
+	}
+
+	if code := maintenance("maybe"); code != http.StatusBadRequest {
+		t.Errorf("expected maintenance status %d for an invalid value; got %d", http.StatusBadRequest, code)
+	}
+	if code := maintenance("false"); code != http.StatusOK {
+		t.Errorf("expected maintenance status %d; got %d", http.StatusOK, code)
+	}
+	if srv.maintenance {
+		t.Error("expected server to have left maintenance mode")
+	}
+	if code := healthz(); code != http.StatusOK {
+		t.Errorf("expected healthz status %d after maintenance; got %d", http.StatusOK, code)
+	}
+}
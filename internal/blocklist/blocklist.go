@@ -9,7 +9,10 @@ import (
 	"io"
 	"log"
 	"strings"
+	"time"
 
+	"github.com/execjosh/mydns/internal/bloom"
+	"github.com/execjosh/mydns/internal/clock"
 	"github.com/execjosh/mydns/internal/globtrie"
 	"github.com/execjosh/mydns/internal/stringset"
 	"github.com/miekg/dns"
@@ -20,43 +23,141 @@ type set interface {
 	Contains(string) bool
 }
 
-// Blocklist represents an immutable set of FQDNs to block.
+// negationPrefixes are the line prefixes that mark an entry as an exception
+// that must not be blocked, even if a broader entry matches it. `@@` comes from
+// adblock syntax.
+var negationPrefixes = []string{"@@", "-"}
+
+// Blocklist represents an immutable set of FQDNs to block. Only temporary
+// entries change, as they expire.
 type Blocklist struct {
 	exact set
-	glob  set
+	glob  *globtrie.GlobTrie
+
+	allowExact set
+	allowGlob  *globtrie.GlobTrie
+
+	temporary *temporary
+	clock     clock.Clock
 }
 
 // Empty returns an empty Blocklist.
 func Empty() *Blocklist {
 	return &Blocklist{
-		exact: stringset.New(),
-		glob:  globtrie.New(),
+		exact:      stringset.New(),
+		glob:       globtrie.New(),
+		allowExact: stringset.New(),
+		allowGlob:  globtrie.New(),
+		temporary:  newTemporary(),
+		clock:      clock.Real,
 	}
 }
 
-// Load loads a blocklist from an io.Reader.
-func Load(r io.Reader) (*Blocklist, uint, error) {
-	bl := Empty()
+// loadConfig is the blocklist being loaded, and how.
+type loadConfig struct {
+	bl *Blocklist
+
+	progress      func(lines uint)
+	progressEvery uint
+	bufSize       int
+}
+
+// LoadOption configures how a blocklist is loaded.
+type LoadOption func(*loadConfig)
+
+// WithClock makes the blocklist use c instead of the real clock to compute and
+// check the deadlines of temporary entries, e.g. for testing.
+func WithClock(c clock.Clock) LoadOption {
+	return func(cfg *loadConfig) {
+		cfg.bl.clock = c
+	}
+}
+
+// WithProgress calls fn with the number of lines read so far after every
+// `every` lines, e.g. to log the progress of loading a huge blocklist.
+func WithProgress(every uint, fn func(lines uint)) LoadOption {
+	return func(cfg *loadConfig) {
+		cfg.progress = fn
+		cfg.progressEvery = every
+	}
+}
+
+// WithBufferSize reads lines into a buffer of n bytes, allocated once, instead
+// of one that starts at 4 KiB and grows up to 64 KiB as needed. A line longer
+// than n makes loading fail.
+func WithBufferSize(n int) LoadOption {
+	return func(cfg *loadConfig) {
+		cfg.bufSize = n
+	}
+}
 
-	var cnt uint
+// WithBloomFilter holds the exact blocked entries in a Bloom filter with the
+// given false positive rate instead of a map, using a fraction of the memory.
+// In exchange, about that share of names that are not blocked are blocked
+// anyway, and Match reports them as matching themselves. Globs, exceptions,
+// and temporary entries are still held exactly.
+func WithBloomFilter(rate float64) LoadOption {
+	return func(cfg *loadConfig) {
+		cfg.bl.exact = bloom.New(rate)
+	}
+}
+
+// Load loads a blocklist from an io.Reader. Lines starting with a negation
+// prefix (`@@` or `-`) are exceptions and are never blocked. dnsmasq
+// `address=/domain/0.0.0.0` lines block the domain and its subdomains; other
+// dnsmasq directives are skipped. A blocked entry may be followed by an
+// expiry, either in seconds from now or as an RFC 3339 timestamp, to block it
+// only temporarily. The returned count only includes blocked entries.
+//
+// The blocklist is built while r is read, line by line, so only one line is
+// held in memory at a time, besides the blocklist itself.
+func Load(r io.Reader, opts ...LoadOption) (*Blocklist, uint, error) {
+	cfg := &loadConfig{bl: Empty()}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	bl := cfg.bl
+	now := bl.clock.Now()
+
+	var cnt, lines uint
 	s := bufio.NewScanner(r)
+	if cfg.bufSize > 0 {
+		s.Buffer(make([]byte, cfg.bufSize), cfg.bufSize)
+	}
 	for s.Scan() {
-		l := s.Text()
-		if _, ok := dns.IsDomainName(l); !ok {
+		lines++
+		if cfg.progress != nil && cfg.progressEvery > 0 && lines%cfg.progressEvery == 0 {
+			cfg.progress(lines)
+		}
+		if len(s.Bytes()) < 1 {
 			continue
 		}
-		l = dns.CanonicalName(l)
 
-		var set set
-		if strings.Contains(l, "*") {
-			set = bl.glob
-		} else {
-			set = bl.exact
+		line := s.Text()
+		if directive, value, ok := parseDnsmasq(line); ok {
+			domains, err := dnsmasqBlocked(directive, value)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			for _, d := range domains {
+				// dnsmasq also matches subdomains, but a glob only covers
+				// one more label
+				if bl.insert(d, false) && bl.insert("*."+d, false) {
+					cnt++
+				}
+			}
+			continue
 		}
 
-		if err := set.Insert(l); err != nil {
-			log.Println(err)
-		} else {
+		l, allow := trimNegationPrefix(line)
+		if fields := strings.Fields(l); len(fields) == 2 {
+			if bl.insertTemporary(fields[0], fields[1], allow, now) {
+				cnt++
+			}
+			continue
+		}
+		if bl.insert(l, allow) && !allow {
 			cnt++
 		}
 	}
@@ -67,7 +168,111 @@ func Load(r io.Reader) (*Blocklist, uint, error) {
 	return bl, cnt, nil
 }
 
+// insert adds l to the matching set, returning whether it was valid.
+func (bl *Blocklist) insert(l string, allow bool) bool {
+	if _, ok := dns.IsDomainName(l); !ok {
+		return false
+	}
+	l = dns.CanonicalName(l)
+
+	isGlob := strings.Contains(l, "*")
+
+	var set set
+	switch {
+	case allow && isGlob:
+		set = bl.allowGlob
+	case allow:
+		set = bl.allowExact
+	case isGlob:
+		set = bl.glob
+	default:
+		set = bl.exact
+	}
+
+	if err := set.Insert(l); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// insertTemporary adds an entry that expires, returning whether it was valid
+// and has not expired yet.
+func (bl *Blocklist) insertTemporary(l string, expiry string, allow bool, now time.Time) bool {
+	if allow {
+		log.Printf("skipping temporary exception: %q", l)
+		return false
+	}
+	if _, ok := dns.IsDomainName(l); !ok {
+		return false
+	}
+	deadline, err := parseExpiry(expiry, now)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if !now.Before(deadline) {
+		return false
+	}
+
+	bl.temporary.insert(dns.CanonicalName(l), deadline)
+	return true
+}
+
+// Prune removes temporary entries that have expired, returning how many were
+// removed. Expired entries are never matched, so this only frees memory.
+func (bl *Blocklist) Prune() int {
+	return bl.temporary.prune(bl.clock.Now())
+}
+
 // Contains returns whether the specified fqdn is included in the blocklist.
+// Exceptions take precedence over blocked entries.
 func (bl *Blocklist) Contains(fqdn string) bool {
-	return bl.exact.Contains(fqdn) || bl.glob.Contains(fqdn)
+	_, blocked := bl.Match(fqdn)
+	return blocked
+}
+
+// Allows returns whether fqdn matches an exception, i.e. is explicitly allowed.
+// Matching is case-insensitive.
+func (bl *Blocklist) Allows(fqdn string) bool {
+	fqdn = dns.CanonicalName(fqdn)
+
+	if bl.allowExact.Contains(fqdn) {
+		return true
+	}
+	_, ok := bl.allowGlob.Match(fqdn)
+	return ok
+}
+
+// Match returns whether fqdn is blocked, together with the entry that decided
+// it. The entry is prefixed with `@@` if it is an exception, and empty if
+// nothing matched. Matching is case-insensitive.
+func (bl *Blocklist) Match(fqdn string) (entry string, blocked bool) {
+	fqdn = dns.CanonicalName(fqdn)
+
+	if bl.allowExact.Contains(fqdn) {
+		return negationPrefixes[0] + fqdn, false
+	}
+	if pattern, ok := bl.allowGlob.Match(fqdn); ok {
+		return negationPrefixes[0] + pattern, false
+	}
+	if bl.exact.Contains(fqdn) {
+		return fqdn, true
+	}
+	if pattern, ok := bl.glob.Match(fqdn); ok {
+		return pattern, true
+	}
+	if entry, ok := bl.temporary.match(fqdn, bl.clock.Now()); ok {
+		return entry, true
+	}
+	return "", false
+}
+
+func trimNegationPrefix(l string) (string, bool) {
+	for _, p := range negationPrefixes {
+		if strings.HasPrefix(l, p) {
+			return strings.TrimPrefix(l, p), true
+		}
+	}
+	return l, false
 }
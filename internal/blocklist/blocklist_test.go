@@ -0,0 +1,330 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package blocklist_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/blocklist"
+	"github.com/execjosh/mydns/internal/clock"
+)
+
+func TestLoadNegation(t *testing.T) {
+	bl, cnt, err := blocklist.Load(strings.NewReader(strings.Join([]string{
+		"*.example.com",
+		"@@www.example.com",
+		"-cdn.example.com",
+		"ads.example.org",
+		"*.ads.example.org",
+		"@@*.ads.example.org",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cnt != 3 {
+		t.Errorf("expected 3 blocked entries; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn string
+		want bool
+	}{
+		{"sub1.example.com.", true},
+		{"www.example.com.", false},
+		{"cdn.example.com.", false},
+		{"ads.example.org.", true},
+		{"tracker.ads.example.org.", false},
+		{"example.net.", false},
+	}
+	for _, tt := range tests {
+		if got := bl.Contains(tt.fqdn); got != tt.want {
+			t.Errorf("Contains(%q) = %v; want %v", tt.fqdn, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDnsmasq(t *testing.T) {
+	bl, cnt, err := blocklist.Load(strings.NewReader(strings.Join([]string{
+		"address=/ads.example.com/0.0.0.0",
+		"address=/tracker.example.net/metrics.example.net/::",
+		"address=/nx.example.org/",
+		"address=/router.lan/192.168.1.1",
+		"server=/corp.example/10.0.0.1",
+		"cache-size=1000",
+		"plain.example.com",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cnt != 5 {
+		t.Errorf("expected 5 blocked entries; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn string
+		want bool
+	}{
+		{"ads.example.com.", true},
+		{"banner.ads.example.com.", true},
+		{"example.com.", false},
+		{"tracker.example.net.", true},
+		{"metrics.example.net.", true},
+		{"nx.example.org.", true},
+		{"router.lan.", false},
+		{"corp.example.", false},
+		{"plain.example.com.", true},
+	}
+	for _, tt := range tests {
+		if got := bl.Contains(tt.fqdn); got != tt.want {
+			t.Errorf("Contains(%q) = %v; want %v", tt.fqdn, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	bl, _, err := blocklist.Load(strings.NewReader(strings.Join([]string{
+		"*.example.com",
+		"@@www.example.com",
+		"@@*.cdn.example.com",
+		"ads.example.org",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		fqdn        string
+		wantEntry   string
+		wantBlocked bool
+	}{
+		{"sub1.example.com.", "*.example.com.", true},
+		{"www.example.com.", "@@www.example.com.", false},
+		{"img.cdn.example.com.", "@@*.cdn.example.com.", false},
+		{"ads.example.org.", "ads.example.org.", true},
+		{"ADS.Example.org.", "ads.example.org.", true},
+		{"WWW.example.com.", "@@www.example.com.", false},
+		{"example.net.", "", false},
+	}
+	for _, tt := range tests {
+		entry, blocked := bl.Match(tt.fqdn)
+		if entry != tt.wantEntry || blocked != tt.wantBlocked {
+			t.Errorf("Match(%q) = %q, %v; want %q, %v", tt.fqdn, entry, blocked, tt.wantEntry, tt.wantBlocked)
+		}
+		if want := strings.HasPrefix(tt.wantEntry, "@@"); bl.Allows(tt.fqdn) != want {
+			t.Errorf("Allows(%q) = %v; want %v", tt.fqdn, !want, want)
+		}
+	}
+}
+
+func TestLoadTemporary(t *testing.T) {
+	c := clock.NewFake(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	bl, cnt, err := blocklist.Load(strings.NewReader(strings.Join([]string{
+		"ads.example.com 3600",
+		"*.games.example.com 7200",
+		"video.example.com 2021-03-01T13:30:00Z",
+		"expired.example.com 2021-03-01T11:00:00Z",
+		"@@www.example.com 3600",
+		"broken.example.com soon",
+		"permanent.example.com",
+	}, "\n")), blocklist.WithClock(c))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 4 {
+		t.Errorf("expected 4 blocked entries; got %d", cnt)
+	}
+
+	tests := []struct {
+		after time.Duration
+		fqdn  string
+		want  bool
+	}{
+		{0, "ads.example.com.", true},
+		{0, "chess.games.example.com.", true},
+		{0, "video.example.com.", true},
+		{0, "expired.example.com.", false},
+		{0, "www.example.com.", false},
+		{0, "broken.example.com.", false},
+		{time.Hour, "ads.example.com.", false},
+		{time.Hour, "chess.games.example.com.", true},
+		{time.Hour, "video.example.com.", true},
+		{2 * time.Hour, "chess.games.example.com.", false},
+		{2 * time.Hour, "video.example.com.", false},
+		{2 * time.Hour, "permanent.example.com.", true},
+	}
+	start := c.Now()
+	for _, tt := range tests {
+		c.Set(start.Add(tt.after))
+		if got := bl.Contains(tt.fqdn); got != tt.want {
+			t.Errorf("after %v: Contains(%q) = %v; want %v", tt.after, tt.fqdn, got, tt.want)
+		}
+	}
+
+	c.Set(start.Add(time.Hour))
+	if n := bl.Prune(); n != 1 {
+		t.Errorf("expected 1 entry to be pruned after an hour; got %d", n)
+	}
+	c.Set(start.Add(2 * time.Hour))
+	if n := bl.Prune(); n != 2 {
+		t.Errorf("expected 2 entries to be pruned after two hours; got %d", n)
+	}
+}
+
+func TestLoadBloomFilter(t *testing.T) {
+	bl, cnt, err := blocklist.Load(strings.NewReader(strings.Join([]string{
+		"ads.example.com",
+		"*.tracker.example.net",
+		"*.example.org",
+		"@@www.example.org",
+	}, "\n")), blocklist.WithBloomFilter(0.0001))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 blocked entries; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn string
+		want bool
+	}{
+		{"ads.example.com.", true},
+		{"ADS.example.com.", true},
+		{"pixel.tracker.example.net.", true},
+		{"cdn.example.org.", true},
+		{"www.example.org.", false},
+		{"example.com.", false},
+	}
+	for _, tt := range tests {
+		if got := bl.Contains(tt.fqdn); got != tt.want {
+			t.Errorf("Contains(%q) = %v; want %v", tt.fqdn, got, tt.want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	c := clock.NewFake(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	bl, _, err := blocklist.Load(strings.NewReader(strings.Join([]string{
+		"ads.example.com",
+		"ADS.example.com.",
+		"*.tracker.example.net",
+		"address=/example.org/0.0.0.0",
+		"@@www.example.org",
+		"-*.cdn.example.org",
+		"video.example.com 3600",
+		"expired.example.com 2021-03-01T11:00:00Z",
+	}, "\n")), blocklist.WithClock(c))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var exported strings.Builder
+	if err := bl.Export(&exported); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := strings.Join([]string{
+		"*.example.org.",
+		"*.tracker.example.net.",
+		"ads.example.com.",
+		"example.org.",
+		"video.example.com. 2021-03-01T13:00:00Z",
+		"@@*.cdn.example.org.",
+		"@@www.example.org.",
+	}, "\n") + "\n"
+	if exported.String() != want {
+		t.Errorf("expected export:\n%s\ngot:\n%s", want, exported.String())
+	}
+
+	reloaded, cnt, err := blocklist.Load(strings.NewReader(exported.String()), blocklist.WithClock(c))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 5 {
+		t.Errorf("expected 5 blocked entries after reloading; got %d", cnt)
+	}
+	var reexported strings.Builder
+	if err := reloaded.Export(&reexported); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reexported.String() != exported.String() {
+		t.Errorf("expected the export to round-trip; got:\n%s", reexported.String())
+	}
+}
+
+func TestExportBloomFilter(t *testing.T) {
+	bl, _, err := blocklist.Load(strings.NewReader("ads.example.com"), blocklist.WithBloomFilter(0.01))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bl.Export(ioutil.Discard); !errors.Is(err, blocklist.ErrNotExportable) {
+		t.Errorf("expected ErrNotExportable; got %v", err)
+	}
+}
+
+func TestLoadProgress(t *testing.T) {
+	var reported []uint
+	_, cnt, err := blocklist.Load(strings.NewReader(strings.Join([]string{
+		"sub1.example.com",
+		"sub2.example.com",
+		"",
+		"sub3.example.com",
+		"sub4.example.com",
+	}, "\n")), blocklist.WithProgress(2, func(lines uint) {
+		reported = append(reported, lines)
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 4 {
+		t.Errorf("expected 4 entries; got %d", cnt)
+	}
+	if len(reported) != 2 || reported[0] != 2 || reported[1] != 4 {
+		t.Errorf("expected progress after 2 and 4 lines; got %v", reported)
+	}
+}
+
+func TestLoadBufferSize(t *testing.T) {
+	list := "sub1.example.com\n" + strings.Repeat("a", 40) + ".example.com\n"
+
+	if _, cnt, err := blocklist.Load(strings.NewReader(list), blocklist.WithBufferSize(64)); err != nil || cnt != 2 {
+		t.Errorf("expected 2 entries and no error; got %d and %v", cnt, err)
+	}
+	if _, _, err := blocklist.Load(strings.NewReader(list), blocklist.WithBufferSize(32)); err == nil {
+		t.Error("expected a line longer than the buffer to fail loading")
+	}
+}
+
+// BenchmarkLoad reports the memory allocated while loading a large blocklist,
+// as B/op, with a map and with a Bloom filter holding the exact entries.
+func BenchmarkLoad(b *testing.B) {
+	var list strings.Builder
+	for i := 0; i < 1000000; i++ {
+		fmt.Fprintf(&list, "blocked%d.example.com\n", i)
+	}
+	for _, bb := range []struct {
+		name string
+		opts []blocklist.LoadOption
+	}{
+		{"map", nil},
+		{"bloom/0.1%", []blocklist.LoadOption{blocklist.WithBloomFilter(0.001)}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := blocklist.Load(strings.NewReader(list.String()), bb.opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
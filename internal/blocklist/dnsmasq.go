@@ -0,0 +1,50 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package blocklist
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseDnsmasq recognizes a dnsmasq directive line, e.g.
+// `address=/ads.example.com/0.0.0.0`, returning its name and value.
+func parseDnsmasq(l string) (directive string, value string, ok bool) {
+	idx := strings.IndexByte(l, '=')
+	if idx < 1 {
+		return "", "", false
+	}
+	for _, c := range l[:idx] {
+		if (c < 'a' || c > 'z') && c != '-' {
+			return "", "", false
+		}
+	}
+	return l[:idx], l[idx+1:], true
+}
+
+// dnsmasqBlocked returns the domains blocked by a dnsmasq directive. Only
+// `address=/domain/.../ip` lines block, and only if the IP is unspecified
+// (`0.0.0.0`, `::`, `#`, or empty); anything else is not a blocklist entry.
+func dnsmasqBlocked(directive string, value string) ([]string, error) {
+	if directive != "address" {
+		return nil, fmt.Errorf("skipping unsupported dnsmasq directive: %q", directive)
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || len(parts[0]) > 0 {
+		return nil, fmt.Errorf("invalid dnsmasq address: %q", value)
+	}
+	domains, ip := parts[1:len(parts)-1], parts[len(parts)-1]
+
+	switch ip {
+	case "", "#":
+	default:
+		if parsed := net.ParseIP(ip); parsed == nil || !parsed.IsUnspecified() {
+			return nil, fmt.Errorf("skipping dnsmasq address that is not a block: %q", value)
+		}
+	}
+
+	return domains, nil
+}
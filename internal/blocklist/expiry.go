@@ -0,0 +1,145 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package blocklist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// temporary holds blocked entries that expire at a deadline. Unlike the
+// permanent sets, it is mutable, so that expired entries can be pruned; it is
+// expected to be small.
+type temporary struct {
+	mu    sync.Mutex
+	exact map[string]time.Time
+	globs []temporaryGlob
+}
+
+type temporaryGlob struct {
+	pattern  string
+	labels   []string
+	deadline time.Time
+}
+
+func newTemporary() *temporary {
+	return &temporary{
+		exact: map[string]time.Time{},
+	}
+}
+
+// parseExpiry parses the expiry of an entry, either as a number of seconds
+// from now or as an RFC 3339 timestamp, into a deadline.
+func parseExpiry(s string, now time.Time) (time.Time, error) {
+	if secs, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return now.Add(time.Duration(secs) * time.Second), nil
+	}
+	deadline, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q: expected seconds or an RFC 3339 timestamp", s)
+	}
+	return deadline, nil
+}
+
+func (t *temporary) insert(entry string, deadline time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !strings.Contains(entry, "*") {
+		t.exact[entry] = deadline
+		return
+	}
+	t.globs = append(t.globs, temporaryGlob{
+		pattern:  entry,
+		labels:   dns.SplitDomainName(entry),
+		deadline: deadline,
+	})
+}
+
+// match returns the entry matching the canonical fqdn, unless it has expired.
+func (t *temporary) match(fqdn string, now time.Time) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.exact) < 1 && len(t.globs) < 1 {
+		return "", false
+	}
+
+	if deadline, ok := t.exact[fqdn]; ok && now.Before(deadline) {
+		return fqdn, true
+	}
+
+	labels := dns.SplitDomainName(fqdn)
+	for _, g := range t.globs {
+		if now.Before(g.deadline) && matchLabels(g.labels, labels) {
+			return g.pattern, true
+		}
+	}
+	return "", false
+}
+
+// prune removes expired entries, returning how many were removed.
+func (t *temporary) prune(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var n int
+	for entry, deadline := range t.exact {
+		if !now.Before(deadline) {
+			delete(t.exact, entry)
+			n++
+		}
+	}
+
+	globs := t.globs[:0]
+	for _, g := range t.globs {
+		if now.Before(g.deadline) {
+			globs = append(globs, g)
+		} else {
+			n++
+		}
+	}
+	t.globs = globs
+
+	return n
+}
+
+// entries returns the entries that have not expired yet, each followed by its
+// deadline as an RFC 3339 timestamp, in no particular order.
+func (t *temporary) entries(now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var entries []string
+	for entry, deadline := range t.exact {
+		if now.Before(deadline) {
+			entries = append(entries, entry+" "+deadline.Format(time.RFC3339))
+		}
+	}
+	for _, g := range t.globs {
+		if now.Before(g.deadline) {
+			entries = append(entries, g.pattern+" "+g.deadline.Format(time.RFC3339))
+		}
+	}
+	return entries
+}
+
+// matchLabels matches labels against a pattern where `*` matches exactly one
+// label, like the glob trie.
+func matchLabels(pattern []string, labels []string) bool {
+	if len(pattern) != len(labels) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != labels[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package blocklist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/execjosh/mydns/internal/stringset"
+)
+
+// ErrNotExportable is returned by Export if the exact blocked entries are held
+// in a Bloom filter, which cannot list its entries.
+var ErrNotExportable = errors.New("blocklist held in a Bloom filter cannot be exported")
+
+// Export writes the blocklist to w in normalized form, one canonical entry per
+// line, which Load reads back into an equivalent blocklist. Blocked entries,
+// globs included, come first, followed by temporary entries with their
+// deadlines, and exceptions prefixed with `@@`. Each group is sorted and free
+// of duplicates. dnsmasq directives are written as the pair of entries they
+// were loaded as, e.g. `example.com.` and `*.example.com.`, and temporary
+// entries that have expired are left out.
+func (bl *Blocklist) Export(w io.Writer) error {
+	exact, ok := bl.exact.(stringset.StringSet)
+	if !ok {
+		return ErrNotExportable
+	}
+	allowExact, ok := bl.allowExact.(stringset.StringSet)
+	if !ok {
+		return ErrNotExportable
+	}
+
+	blocked := append(keys(exact), bl.glob.Patterns()...)
+	temporary := bl.temporary.entries(bl.clock.Now())
+	allowed := append(keys(allowExact), bl.allowGlob.Patterns()...)
+
+	bw := bufio.NewWriter(w)
+	for _, group := range []struct {
+		prefix  string
+		entries []string
+	}{
+		{"", blocked},
+		{"", temporary},
+		{negationPrefixes[0], allowed},
+	} {
+		sort.Strings(group.entries)
+		for _, e := range group.entries {
+			if _, err := fmt.Fprintln(bw, group.prefix+e); err != nil {
+				return fmt.Errorf("exporting blocklist: %w", err)
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("exporting blocklist: %w", err)
+	}
+	return nil
+}
+
+func keys(set stringset.StringSet) []string {
+	ss := make([]string, 0, len(set))
+	for s := range set {
+		ss = append(ss, s)
+	}
+	return ss
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package blocksyslog
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// queueSize is how many block events may wait to be written to syslog before
+// further ones are dropped.
+const queueSize = 256
+
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// Reporter sends block events to syslog. Events are written by a background
+// goroutine so that a slow or unreachable syslog server does not delay
+// queries.
+type Reporter struct {
+	w      *syslog.Writer
+	events chan string
+	quit   chan struct{}
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error // last write failure, returned by the next ReportBlock
+
+	closeOnce sync.Once
+}
+
+// New connects to syslog. addr is either `local` for the local syslog daemon,
+// or `network://host:port` (e.g. `udp://192.0.2.1:514`) for a remote one.
+// facility is a syslog facility name such as `daemon` or `local0`.
+func New(addr string, facility string) (*Reporter, error) {
+	prio, ok := facilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility: %q", facility)
+	}
+	prio |= syslog.LOG_NOTICE
+
+	var network, raddr string
+	if addr != "local" {
+		parts := strings.SplitN(addr, "://", 2)
+		if len(parts) != 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
+			return nil, fmt.Errorf("invalid syslog address: %q", addr)
+		}
+		network, raddr = parts[0], parts[1]
+	}
+
+	w, err := syslog.Dial(network, raddr, prio, "mydns")
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+
+	r := &Reporter{
+		w:      w,
+		events: make(chan string, queueSize),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+
+	return r, nil
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	for {
+		select {
+		case line := <-r.events:
+			r.write(line)
+		case <-r.quit:
+			for {
+				select {
+				case line := <-r.events:
+					r.write(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *Reporter) write(line string) {
+	if err := r.w.Notice(line); err != nil {
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+	}
+}
+
+// ReportBlock queues a block event to be sent as a line of space-separated
+// key=value pairs. It does not wait for the event to be written: if the queue
+// is full the event is dropped, and a failure to write an earlier event is
+// returned by the next call.
+func (r *Reporter) ReportBlock(requestID string, fqdn string, qtype string, remoteAddr net.IP) error {
+	line := fmt.Sprintf("event=block request.ID=%s query.fqdn=%q query.type=%s remoteAddr=%s",
+		requestID, fqdn, qtype, remoteAddr)
+
+	select {
+	case <-r.quit:
+		return errors.New("syslog reporter is closed")
+	default:
+	}
+	select {
+	case r.events <- line:
+	default:
+		return errors.New("syslog queue is full, dropping block event")
+	}
+
+	r.mu.Lock()
+	err := r.err
+	r.err = nil
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("writing to syslog: %w", err)
+	}
+	return nil
+}
+
+// Close writes the queued events and closes the connection to syslog.
+func (r *Reporter) Close() error {
+	r.closeOnce.Do(func() { close(r.quit) })
+	<-r.done
+	return r.w.Close()
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package blocksyslog_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/blocksyslog"
+)
+
+func listen(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func readLine(t *testing.T, pc net.PacketConn) string {
+	t.Helper()
+
+	if err := pc.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected a syslog message: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNew(t *testing.T) {
+	pc := listen(t)
+	udp := "udp://" + pc.LocalAddr().String()
+
+	tests := []struct {
+		name     string
+		addr     string
+		facility string
+		wantErr  string
+	}{
+		{"network", udp, "daemon", ""},
+		{"facility is case-insensitive", udp, "LOCAL0", ""},
+		{"unknown facility", udp, "nope", `unknown syslog facility: "nope"`},
+		{"empty facility", udp, "", `unknown syslog facility: ""`},
+		{"missing scheme", pc.LocalAddr().String(), "daemon", "invalid syslog address"},
+		{"empty network", "://" + pc.LocalAddr().String(), "daemon", "invalid syslog address"},
+		{"empty host", "udp://", "daemon", "invalid syslog address"},
+		{"unknown network", "carrier-pigeon://192.0.2.1:514", "daemon", "connecting to syslog"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := blocksyslog.New(tt.addr, tt.facility)
+			if len(tt.wantErr) < 1 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				r.Close()
+				return
+			}
+			if err == nil {
+				r.Close()
+				t.Fatalf("expected error containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q; got %q", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReportBlock(t *testing.T) {
+	pc := listen(t)
+
+	r, err := blocksyslog.New("udp://"+pc.LocalAddr().String(), "local7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.ReportBlock("abc123", "ads.example.", "AAAA", net.ParseIP("192.0.2.7")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readLine(t, pc)
+	// local7 (23<<3) | notice (5)
+	if want := "<189>"; !strings.HasPrefix(got, want) {
+		t.Errorf("expected priority %q; got %q", want, got)
+	}
+	want := fmt.Sprintf(" mydns[%d]: event=block request.ID=abc123 query.fqdn=%q query.type=AAAA remoteAddr=192.0.2.7\n",
+		os.Getpid(), "ads.example.")
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("expected line ending in %q; got %q", want, got)
+	}
+}
+
+func TestCloseFlushesQueue(t *testing.T) {
+	pc := listen(t)
+
+	r, err := blocksyslog.New("udp://"+pc.LocalAddr().String(), "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		if err := r.ReportBlock(fmt.Sprint(i), "ads.example.", "A", net.ParseIP("192.0.2.7")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if got, want := readLine(t, pc), fmt.Sprintf("request.ID=%d ", i); !strings.Contains(got, want) {
+			t.Errorf("expected %q; got %q", want, got)
+		}
+	}
+
+	if err := r.ReportBlock("late", "ads.example.", "A", net.ParseIP("192.0.2.7")); err == nil {
+		t.Error("expected error after Close")
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build windows || plan9
+// +build windows plan9
+
+package blocksyslog
+
+import (
+	"errors"
+	"net"
+)
+
+// Reporter sends block events to syslog. It is not supported on this platform.
+type Reporter struct{}
+
+// New always fails, because syslog is not supported on this platform.
+func New(addr string, facility string) (*Reporter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+// ReportBlock does nothing.
+func (r *Reporter) ReportBlock(requestID string, fqdn string, qtype string, remoteAddr net.IP) error {
+	return nil
+}
+
+// Close does nothing.
+func (r *Reporter) Close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package bloom implements a scalable Bloom filter of strings, trading a small
+// rate of false positives for a fraction of the memory of a map.
+package bloom
+
+import (
+	"hash/maphash"
+	"math"
+)
+
+// initialCapacity is the number of strings the first stage of a Filter is
+// sized for. Each further stage holds twice as many as the one before.
+const initialCapacity = 1 << 16
+
+// Filter is a scalable Bloom filter (Almeida et al., 2007). It starts small and
+// adds larger stages as strings are inserted, each with half the false
+// positive rate of the one before, so the overall rate stays below the target
+// however many strings are inserted. It is not safe for concurrent inserts,
+// but Contains may be called concurrently once inserting is done.
+type Filter struct {
+	stages []*stage
+	rate   float64 // false positive rate of the next stage
+	seeds  [2]maphash.Seed
+}
+
+// New returns an empty Filter whose false positive rate does not exceed rate,
+// which must be between 0 and 1.
+func New(rate float64) *Filter {
+	return &Filter{
+		rate:  rate / 2,
+		seeds: [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()},
+	}
+}
+
+// Insert inserts s into the filter.
+func (f *Filter) Insert(s string) error {
+	h1, h2 := f.hash(s)
+	if f.contains(h1, h2) {
+		return nil
+	}
+
+	if len(f.stages) < 1 || f.last().full() {
+		capacity := uint64(initialCapacity)
+		if len(f.stages) > 0 {
+			capacity = f.last().capacity * 2
+		}
+		f.stages = append(f.stages, newStage(capacity, f.rate))
+		f.rate /= 2
+	}
+	f.last().insert(h1, h2)
+	return nil
+}
+
+// Contains returns whether s may have been inserted into the filter. It is
+// never false for inserted strings, but may be true for others.
+func (f *Filter) Contains(s string) bool {
+	h1, h2 := f.hash(s)
+	return f.contains(h1, h2)
+}
+
+// Bytes returns the memory used by the bits of the filter.
+func (f *Filter) Bytes() int {
+	n := 0
+	for _, st := range f.stages {
+		n += len(st.bits) * 8
+	}
+	return n
+}
+
+func (f *Filter) contains(h1, h2 uint64) bool {
+	for _, st := range f.stages {
+		if st.contains(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) last() *stage {
+	return f.stages[len(f.stages)-1]
+}
+
+// stage is a classic Bloom filter sized for a fixed number of strings.
+type stage struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint64 // number of hash functions
+	capacity uint64
+	count    uint64
+}
+
+// newStage returns a stage holding capacity strings at the given false
+// positive rate, with the optimal number of bits and hash functions.
+func newStage(capacity uint64, rate float64) *stage {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &stage{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+func (st *stage) full() bool {
+	return st.count >= st.capacity
+}
+
+// The k bit positions are derived from two hashes (Kirsch and Mitzenmacher,
+// 2006), which is as good as k independent ones.
+func (st *stage) insert(h1, h2 uint64) {
+	for i := uint64(0); i < st.k; i++ {
+		bit := (h1 + i*h2) % st.m
+		st.bits[bit/64] |= 1 << (bit % 64)
+	}
+	st.count++
+}
+
+func (st *stage) contains(h1, h2 uint64) bool {
+	for i := uint64(0); i < st.k; i++ {
+		bit := (h1 + i*h2) % st.m
+		if st.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hash returns two independent 64-bit hashes of s. The second one is odd, so
+// that it never maps all k positions onto the same bit.
+func (f *Filter) hash(s string) (uint64, uint64) {
+	var h maphash.Hash
+	h.SetSeed(f.seeds[0])
+	h.WriteString(s)
+	h1 := h.Sum64()
+
+	h.SetSeed(f.seeds[1])
+	h.WriteString(s)
+	return h1, h.Sum64() | 1
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package bloom_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/bloom"
+	"github.com/execjosh/mydns/internal/stringset"
+)
+
+func names(prefix string, n int) []string {
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = fmt.Sprintf("%s%d.example.com.", prefix, i)
+	}
+	return ss
+}
+
+func TestFilter(t *testing.T) {
+	const rate = 0.01
+
+	f := bloom.New(rate)
+	// enough to need several stages
+	inserted := names("blocked", 300000)
+	for _, s := range inserted {
+		f.Insert(s)
+	}
+
+	for _, s := range inserted {
+		if !f.Contains(s) {
+			t.Fatalf("expected %q to be contained", s)
+		}
+	}
+
+	others := names("allowed", 100000)
+	fp := 0
+	for _, s := range others {
+		if f.Contains(s) {
+			fp++
+		}
+	}
+	if got := float64(fp) / float64(len(others)); got > rate {
+		t.Errorf("expected a false positive rate of at most %v; got %v", rate, got)
+	}
+}
+
+func TestEmptyFilter(t *testing.T) {
+	f := bloom.New(0.01)
+	if f.Contains("example.com.") {
+		t.Error("expected an empty filter to contain nothing")
+	}
+	if f.Bytes() != 0 {
+		t.Errorf("expected an empty filter to use no memory; got %d bytes", f.Bytes())
+	}
+}
+
+type set interface {
+	Insert(string) error
+	Contains(string) bool
+}
+
+// BenchmarkMemory compares the memory used to hold a large blocklist, as
+// B/op, of a map and of filters at various false positive rates.
+func BenchmarkMemory(b *testing.B) {
+	ss := names("blocked", 1000000)
+	for _, bb := range []struct {
+		name string
+		new  func() set
+	}{
+		{"map", func() set { return stringset.New() }},
+		{"bloom/1%", func() set { return bloom.New(0.01) }},
+		{"bloom/0.1%", func() set { return bloom.New(0.001) }},
+		{"bloom/0.01%", func() set { return bloom.New(0.0001) }},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := bb.new()
+				for _, name := range ss {
+					s.Insert(name)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkContains(b *testing.B) {
+	ss := names("blocked", 1000000)
+	for _, bb := range []struct {
+		name string
+		set  set
+	}{
+		{"map", stringset.New()},
+		{"bloom/0.1%", bloom.New(0.001)},
+	} {
+		for _, name := range ss {
+			bb.set.Insert(name)
+		}
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bb.set.Contains(ss[i%len(ss)])
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package caa
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Records represents an immutable set of static CAA records (RFC 8659), which
+// restrict the CAs allowed to issue certificates for a name.
+type Records struct {
+	records map[string][]*dns.CAA
+}
+
+// Load loads CAA records from an io.Reader. Each line holds a name followed by
+// the flags, tag, and value of a record, as in a zone file, e.g.
+// `dev.local 0 issue "ca.dev.local"`. Lines starting with `#` are comments. It
+// returns the number of records loaded.
+func Load(r io.Reader) (*Records, uint, error) {
+	rs := &Records{records: map[string][]*dns.CAA{}}
+
+	var cnt uint
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if len(l) < 1 || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		rr, err := parse(l)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		name := dns.CanonicalName(rr.Hdr.Name)
+		rs.records[name] = append(rs.records[name], rr)
+		cnt++
+	}
+	if err := s.Err(); err != nil {
+		return rs, cnt, fmt.Errorf("loading CAA records: %w", err)
+	}
+
+	return rs, cnt, nil
+}
+
+func parse(l string) (*dns.CAA, error) {
+	fields := strings.Fields(l)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("expected `<name> <flags> <tag> <value>`; got %q", l)
+	}
+	if _, ok := dns.IsDomainName(fields[0]); !ok || strings.Contains(fields[0], "*") {
+		return nil, fmt.Errorf("invalid CAA record name: %q", fields[0])
+	}
+
+	name := dns.Fqdn(fields[0])
+	rr, err := dns.NewRR(name + " 0 IN CAA " + strings.TrimSpace(l[len(fields[0]):]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CAA record %q: %w", l, err)
+	}
+	return rr.(*dns.CAA), nil
+}
+
+// Lookup returns the CAA records of fqdn, in the order they were loaded.
+// Matching is case-insensitive.
+func (rs *Records) Lookup(fqdn string) ([]*dns.CAA, bool) {
+	records, ok := rs.records[dns.CanonicalName(fqdn)]
+	return records, ok
+}
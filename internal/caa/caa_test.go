@@ -0,0 +1,54 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package caa_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/caa"
+)
+
+func TestLookup(t *testing.T) {
+	rs, cnt, err := caa.Load(strings.NewReader(strings.Join([]string{
+		"# internal CA",
+		`dev.local      0   issue "ca.dev.local"`,
+		`dev.local      0   iodef "mailto:pki@dev.local"`,
+		`api.dev.local  128 issue "ca.dev.local; account=42"`,
+		`*.dev.local    0   issue "ca.dev.local"`,
+		`broken.local   0   issue`,
+		`broken.local   x   issue "ca.dev.local"`,
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 records; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn string
+		want []string
+	}{
+		{"dev.local.", []string{"0 issue ca.dev.local", "0 iodef mailto:pki@dev.local"}},
+		{"API.dev.local.", []string{"128 issue ca.dev.local; account=42"}},
+		{"web.dev.local.", nil},
+		{"broken.local.", nil},
+	}
+	for _, tt := range tests {
+		records, ok := rs.Lookup(tt.fqdn)
+		if ok != (len(tt.want) > 0) {
+			t.Errorf("Lookup(%q): expected ok to be %v", tt.fqdn, !ok)
+			continue
+		}
+		var got []string
+		for _, rr := range records {
+			got = append(got, fmt.Sprintf("%d %s %s", rr.Flag, rr.Tag, rr.Value))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Lookup(%q) = %v; want %v", tt.fqdn, got, tt.want)
+		}
+	}
+}
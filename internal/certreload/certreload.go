@@ -0,0 +1,83 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package certreload
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader serves a TLS certificate from disk that can be reloaded without
+// restarting, e.g. after a renewal. Use GetCertificate as
+// tls.Config.GetCertificate.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	cert atomic.Value // *tls.Certificate
+	mu   sync.Mutex   // serializes reloads
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New loads the certificate and key from the given PEM files.
+func New(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the certificate and key. If loading fails, the current
+// certificate is kept.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate returns the current certificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// Poll reloads the certificate every interval until Close is called. Failed
+// reloads are passed to onErr.
+func (r *Reloader) Poll(interval time.Duration, onErr func(error)) {
+	t := time.NewTicker(interval)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-t.C:
+				if err := r.Reload(); err != nil {
+					onErr(err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops polling, if started.
+func (r *Reloader) Close() error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package certreload_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/certreload"
+)
+
+// writeCert writes a self-signed certificate for commonName to dir.
+func writeCert(t *testing.T, dir string, commonName string) (certFile string, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, r *certreload.Reloader) string {
+	t.Helper()
+
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("getting certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "old.example")
+
+	r, err := certreload.New(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+	if got := commonName(t, r); got != "old.example" {
+		t.Fatalf("expected old.example; got %s", got)
+	}
+
+	writeCert(t, dir, "new.example")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := commonName(t, r); got != "new.example" {
+		t.Errorf("expected new.example after reload; got %s", got)
+	}
+
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("expected an error reloading a broken key")
+	}
+	if got := commonName(t, r); got != "new.example" {
+		t.Errorf("expected the old certificate to be kept; got %s", got)
+	}
+}
+
+func TestNewMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := certreload.New(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Error("expected an error")
+	}
+}
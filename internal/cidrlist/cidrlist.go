@@ -0,0 +1,78 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cidrlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+)
+
+// CIDRList represents an immutable list of IP ranges.
+type CIDRList struct {
+	nets []*net.IPNet
+}
+
+// Load loads IP ranges in CIDR notation, e.g. `192.0.2.0/24`, from an
+// io.Reader, one per line. A bare IP is treated as a single address. `#`
+// starts a comment. It returns the number of ranges loaded.
+func Load(r io.Reader) (*CIDRList, uint, error) {
+	l := &CIDRList{}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) < 1 {
+			continue
+		}
+
+		n, err := parse(line)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		l.nets = append(l.nets, n)
+	}
+	if err := s.Err(); err != nil {
+		return l, uint(len(l.nets)), fmt.Errorf("loading CIDR list: %w", err)
+	}
+
+	return l, uint(len(l.nets)), nil
+}
+
+func parse(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %q", s)
+	}
+	return n, nil
+}
+
+// Contains returns whether ip falls within any of the ranges.
+func (l *CIDRList) Contains(ip net.IP) bool {
+	for _, n := range l.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
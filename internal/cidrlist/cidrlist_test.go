@@ -0,0 +1,47 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cidrlist_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/cidrlist"
+)
+
+func TestLoad(t *testing.T) {
+	l, cnt, err := cidrlist.Load(strings.NewReader(`
+# known-bad hosting
+198.51.100.0/24
+203.0.113.7   # single address
+2001:db8:bad::/48
+not-an-ip
+10.0.0.0/33
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 ranges; got %d", cnt)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"198.51.100.1", true},
+		{"198.51.101.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"2001:db8:bad:1::1", true},
+		{"2001:db8:good::1", false},
+		{"::ffff:198.51.100.1", true},
+	}
+	for _, tt := range tests {
+		if got := l.Contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Contains(%s): expected %v; got %v", tt.ip, tt.want, got)
+		}
+	}
+}
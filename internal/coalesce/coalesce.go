@@ -0,0 +1,76 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package coalesce
+
+import (
+	"time"
+
+	"github.com/execjosh/mydns/internal/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+type exchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+// Exchanger collapses concurrent identical exchanges with the wrapped
+// exchanger into one: while a query is in flight, the same query to the same
+// address waits for its response instead of being sent again. Queries are
+// identical if they only differ in their ID.
+type Exchanger struct {
+	exchanger exchanger
+	group     singleflight.Group
+}
+
+type result struct {
+	msg *dns.Msg
+	rtt time.Duration
+}
+
+// New returns a new Exchanger wrapping e.
+func New(e exchanger) *Exchanger {
+	return &Exchanger{exchanger: e}
+}
+
+// Exchange implements the exchanger interface of the wrapped exchanger. A
+// shared response is copied and carries the ID of m, as if it had been sent
+// in reply to m.
+func (e *Exchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	key, err := key(m, address)
+	if err != nil {
+		return e.exchanger.Exchange(m, address)
+	}
+
+	var sent bool
+	v, err, shared := e.group.Do(key, func() (interface{}, error) {
+		sent = true
+		metrics.CoalescingInFlight.Add(1)
+		defer metrics.CoalescingInFlight.Add(-1)
+
+		r, rtt, err := e.exchanger.Exchange(m, address)
+		return result{r, rtt}, err
+	})
+	if !sent {
+		metrics.CoalescedQueries.Add(1)
+	}
+	res := v.(result)
+	if !shared || res.msg == nil {
+		return res.msg, res.rtt, err
+	}
+
+	r := res.msg.Copy()
+	r.Id = m.Id
+	return r, res.rtt, err
+}
+
+// key identifies m sent to address by its wire format, with the ID zeroed.
+func key(m *dns.Msg, address string) (string, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return "", err
+	}
+	buf[0], buf[1] = 0, 0
+	return address + " " + string(buf), nil
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package coalesce_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/coalesce"
+	"github.com/execjosh/mydns/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// gatedExchanger answers queries once release is closed, counting how many
+// it received.
+type gatedExchanger struct {
+	release chan struct{}
+	sent    int32
+}
+
+func (e *gatedExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	atomic.AddInt32(&e.sent, 1)
+	<-e.release
+	res := &dns.Msg{}
+	res.SetReply(m)
+	return res, time.Millisecond, nil
+}
+
+func TestExchange(t *testing.T) {
+	inner := &gatedExchanger{release: make(chan struct{})}
+	e := coalesce.New(inner)
+	coalescedBefore := metrics.CoalescedQueries.Value()
+
+	const n = 5
+	queries := make([]*dns.Msg, n)
+	responses := make([]*dns.Msg, n)
+	var wg sync.WaitGroup
+	for i := range queries {
+		queries[i] = &dns.Msg{}
+		queries[i].SetQuestion("example.com.", dns.TypeA)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, _, err := e.Exchange(queries[i], "192.0.2.1:53")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			responses[i] = res
+		}(i)
+	}
+
+	// a different address is a different query
+	other := &dns.Msg{}
+	other.SetQuestion("example.com.", dns.TypeA)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.Exchange(other, "192.0.2.2:53")
+	}()
+
+	waitFor(t, func() bool { return metrics.CoalescingInFlight.Value() == 2 })
+	// give the remaining queries time to join the one in flight
+	time.Sleep(20 * time.Millisecond)
+	close(inner.release)
+	wg.Wait()
+
+	if sent := atomic.LoadInt32(&inner.sent); sent != 2 {
+		t.Errorf("expected 2 queries to be sent; got %d", sent)
+	}
+	if coalesced := metrics.CoalescedQueries.Value() - coalescedBefore; coalesced != n-1 {
+		t.Errorf("expected %d coalesced queries; got %d", n-1, coalesced)
+	}
+	if v := metrics.CoalescingInFlight.Value(); v != 0 {
+		t.Errorf("expected no queries in flight; got %d", v)
+	}
+	for i, res := range responses {
+		if res == nil || res.Id != queries[i].Id {
+			t.Errorf("expected response %d to carry the ID of its query (%d); got %v", i, queries[i].Id, res)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
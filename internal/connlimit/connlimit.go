@@ -0,0 +1,85 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package connlimit
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/execjosh/mydns/internal/metrics"
+)
+
+// Limiter bounds the number of simultaneously open connections accepted by
+// the listeners it wraps. Unlike a listener that stops accepting once the
+// limit is reached, excess connections are accepted and closed right away, so
+// that they neither pile up in the kernel's backlog nor wait for a slot.
+type Limiter struct {
+	max    int64
+	active int64
+}
+
+// New returns a new Limiter allowing at most max open connections.
+func New(max int) *Limiter {
+	return &Limiter{max: int64(max)}
+}
+
+// Listener wraps l, so that its connections count against the limit. The
+// same Limiter may wrap several listeners, which then share the limit.
+func (lim *Limiter) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, lim: lim}
+}
+
+// Active returns the number of currently open connections.
+func (lim *Limiter) Active() int {
+	return int(atomic.LoadInt64(&lim.active))
+}
+
+func (lim *Limiter) acquire() bool {
+	if atomic.AddInt64(&lim.active, 1) > lim.max {
+		atomic.AddInt64(&lim.active, -1)
+		return false
+	}
+	return true
+}
+
+func (lim *Limiter) release() {
+	atomic.AddInt64(&lim.active, -1)
+}
+
+type listener struct {
+	net.Listener
+	lim *Limiter
+}
+
+// Accept waits for the next connection within the limit, closing those that
+// exceed it.
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.lim.acquire() {
+			metrics.TCPConnsRejected.Add(1)
+			c.Close()
+			continue
+		}
+		metrics.TCPConnsAccepted.Add(1)
+		return &conn{Conn: c, release: l.lim.release}, nil
+	}
+}
+
+type conn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and frees its slot. Only the first call frees
+// it.
+func (c *conn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package connlimit_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/connlimit"
+)
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	lim := connlimit.New(1)
+	l := lim.Listener(inner)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first := dial(t, inner.Addr())
+	defer first.Close()
+	c := <-accepted
+	if n := lim.Active(); n != 1 {
+		t.Errorf("expected 1 active connection; got %d", n)
+	}
+
+	// the second connection exceeds the limit, so it is closed right away
+	second := dial(t, inner.Addr())
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection over the limit to be closed; got %v", err)
+	}
+
+	// closing the first connection, twice, frees exactly one slot
+	c.Close()
+	c.Close()
+	if n := lim.Active(); n != 0 {
+		t.Errorf("expected no active connections; got %d", n)
+	}
+	third := dial(t, inner.Addr())
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Error("expected a connection within the limit to be accepted")
+	}
+}
+
+func dial(t *testing.T, addr net.Addr) net.Conn {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	return c
+}
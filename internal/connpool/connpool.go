@@ -0,0 +1,171 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package connpool keeps TCP and TLS connections to upstream nameservers open
+// for reuse, saving a handshake per query.
+package connpool
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/execjosh/mydns/internal/clock"
+	"github.com/execjosh/mydns/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// Pool is an exchanger that sends queries over pooled connections, one query
+// per connection at a time. Connections are dialed by the client as needed
+// and, once their query has been answered, kept for the next one, up to a
+// maximum number per nameserver. Connections that have been idle for too long
+// are closed, as the nameserver is likely to have closed them already.
+type Pool struct {
+	client      *dns.Client
+	maxIdle     int
+	idleTimeout time.Duration
+	clock       clock.Clock
+
+	mu   sync.Mutex
+	idle map[string][]*idleConn // by nameserver, most recently used last
+}
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// Option configures a Pool.
+type Option func(*Pool)
+
+// WithClock makes the pool use c instead of the real clock to track idle
+// connections, e.g. for testing.
+func WithClock(c clock.Clock) Option {
+	return func(p *Pool) {
+		p.clock = c
+	}
+}
+
+// New returns a Pool dialing with client, whose Net must be `tcp` or
+// `tcp-tls`, keeping at most maxIdle connections per nameserver for up to
+// idleTimeout.
+func New(client *dns.Client, maxIdle int, idleTimeout time.Duration, opts ...Option) *Pool {
+	p := &Pool{
+		client:      client,
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		clock:       clock.Real,
+		idle:        map[string][]*idleConn{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Exchange sends m to nameserver over an idle connection, if there is one,
+// or a new one. If a reused connection fails, e.g. because the nameserver
+// has closed it in the meantime, m is sent once more over a new connection.
+func (p *Pool) Exchange(m *dns.Msg, nameserver string) (*dns.Msg, time.Duration, error) {
+	if conn := p.get(nameserver); conn != nil {
+		metrics.UpstreamConnsReused.Add(1)
+		r, rtt, err := p.exchange(m, nameserver, conn)
+		var nerr net.Error
+		if err == nil || (errors.As(err, &nerr) && nerr.Timeout()) {
+			return r, rtt, err
+		}
+	}
+
+	conn, err := p.client.Dial(nameserver)
+	if err != nil {
+		return nil, 0, err
+	}
+	metrics.UpstreamConnsCreated.Add(1)
+	return p.exchange(m, nameserver, conn)
+}
+
+// exchange sends m over conn, which is put back into the pool if the exchange
+// succeeds, and closed otherwise, as it may still receive a late response.
+func (p *Pool) exchange(m *dns.Msg, nameserver string, conn *dns.Conn) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := p.client.ExchangeWithConn(m, conn)
+	if err != nil {
+		conn.Close()
+		return r, rtt, err
+	}
+	p.put(nameserver, conn)
+	return r, rtt, nil
+}
+
+// get returns the most recently used idle connection to nameserver that has
+// not timed out, or nil.
+func (p *Pool) get(nameserver string) *dns.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	conns := p.idle[nameserver]
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if now.Sub(c.since) < p.idleTimeout {
+			p.idle[nameserver] = conns
+			return c.conn
+		}
+		c.conn.Close()
+	}
+	delete(p.idle, nameserver)
+	return nil
+}
+
+func (p *Pool) put(nameserver string, conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[nameserver]) >= p.maxIdle {
+		conn.Close()
+		return
+	}
+	p.idle[nameserver] = append(p.idle[nameserver], &idleConn{conn, p.clock.Now()})
+}
+
+// Prune closes the connections that have been idle for longer than the idle
+// timeout, returning how many were closed.
+func (p *Pool) Prune() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	n := 0
+	for nameserver, conns := range p.idle {
+		// the oldest come first
+		i := 0
+		for i < len(conns) && now.Sub(conns[i].since) >= p.idleTimeout {
+			conns[i].conn.Close()
+			i++
+		}
+		n += i
+		if i == len(conns) {
+			delete(p.idle, nameserver)
+		} else {
+			p.idle[nameserver] = conns[i:]
+		}
+	}
+	return n
+}
+
+// Close closes all idle connections. Connections in use are closed once their
+// exchange has finished.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conns := range p.idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+	p.idle = map[string][]*idleConn{}
+	p.maxIdle = 0
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package connpool_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/clock"
+	"github.com/execjosh/mydns/internal/connpool"
+	"github.com/miekg/dns"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+// startServer starts a TCP nameserver answering every query with NOERROR. It
+// closes connections that have been idle for idleTimeout.
+func startServer(tb testing.TB, idleTimeout time.Duration) (string, *countingListener) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+	cl := &countingListener{Listener: l}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener: cl,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetReply(r)
+			w.WriteMsg(res)
+		}),
+		IdleTimeout:       func() time.Duration { return idleTimeout },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	tb.Cleanup(func() { srv.Shutdown() })
+
+	return l.Addr().String(), cl
+}
+
+func query() *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+func TestReuse(t *testing.T) {
+	addr, l := startServer(t, time.Minute)
+	c := clock.NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := connpool.New(&dns.Client{Net: "tcp"}, 1, 10*time.Second, connpool.WithClock(c))
+	defer p.Close()
+
+	for i := 0; i < 3; i++ {
+		m := query()
+		res, _, err := p.Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("query %d: unexpected error: %v", i+1, err)
+		}
+		if res.Id != m.Id {
+			t.Errorf("query %d: expected ID %d; got %d", i+1, m.Id, res.Id)
+		}
+	}
+	if got := atomic.LoadInt32(&l.accepted); got != 1 {
+		t.Errorf("expected 1 connection; got %d", got)
+	}
+
+	c.Advance(10 * time.Second)
+	if _, _, err := p.Exchange(query(), addr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&l.accepted); got != 2 {
+		t.Errorf("expected a new connection after the idle timeout; got %d connections", got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	addr, _ := startServer(t, time.Minute)
+	c := clock.NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := connpool.New(&dns.Client{Net: "tcp"}, 2, 10*time.Second, connpool.WithClock(c))
+	defer p.Close()
+
+	if _, _, err := p.Exchange(query(), addr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := p.Prune(); n != 0 {
+		t.Errorf("expected nothing to be pruned; got %d", n)
+	}
+	c.Advance(10 * time.Second)
+	if n := p.Prune(); n != 1 {
+		t.Errorf("expected 1 idle connection to be pruned; got %d", n)
+	}
+}
+
+func TestRedialClosedConn(t *testing.T) {
+	addr, l := startServer(t, 50*time.Millisecond)
+	p := connpool.New(&dns.Client{Net: "tcp", ReadTimeout: time.Second}, 1, time.Minute)
+	defer p.Close()
+
+	if _, _, err := p.Exchange(query(), addr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the nameserver closes the pooled connection once it is idle
+	time.Sleep(200 * time.Millisecond)
+	if _, _, err := p.Exchange(query(), addr); err != nil {
+		t.Fatalf("expected a new connection to be dialed; got error: %v", err)
+	}
+	if got := atomic.LoadInt32(&l.accepted); got != 2 {
+		t.Errorf("expected 2 connections; got %d", got)
+	}
+}
+
+// BenchmarkExchange compares sending queries over pooled connections with
+// dialing a new connection per query, as dns.Client does.
+func BenchmarkExchange(b *testing.B) {
+	addr, _ := startServer(b, time.Minute)
+
+	b.Run("dial", func(b *testing.B) {
+		c := &dns.Client{Net: "tcp"}
+		for i := 0; i < b.N; i++ {
+			if _, _, err := c.Exchange(query(), addr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		p := connpool.New(&dns.Client{Net: "tcp"}, 1, time.Minute)
+		defer p.Close()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := p.Exchange(query(), addr); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
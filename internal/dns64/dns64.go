@@ -0,0 +1,63 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dns64
+
+import (
+	"fmt"
+	"net"
+)
+
+// WellKnownPrefix is the Well-Known Prefix of RFC 6052.
+const WellKnownPrefix = "64:ff9b::/96"
+
+// Prefix is an IPv6 prefix that IPv4 addresses are embedded into, as
+// described in RFC 6052, to synthesize AAAA records for NAT64.
+type Prefix struct {
+	ip   net.IP
+	size int // in bytes
+}
+
+// Parse parses a prefix in CIDR notation. Its length must be one of 32, 40,
+// 48, 56, 64, or 96.
+func Parse(s string) (*Prefix, error) {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix: %w", err)
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix %q: not IPv6", s)
+	}
+
+	ones, _ := n.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid DNS64 prefix %q: length must be 32, 40, 48, 56, 64, or 96", s)
+	}
+
+	return &Prefix{ip: n.IP.To16(), size: ones / 8}, nil
+}
+
+// String returns p in CIDR notation.
+func (p *Prefix) String() string {
+	return fmt.Sprintf("%s/%d", p.ip, p.size*8)
+}
+
+// Synthesize embeds v4 into p. Bits 64 to 71 of the result are reserved, so
+// for prefixes shorter than 96 bits, v4 is split around them.
+func (p *Prefix) Synthesize(v4 net.IP) net.IP {
+	v4 = v4.To4()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.ip)
+
+	i := p.size
+	for _, b := range v4 {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
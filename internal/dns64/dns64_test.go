@@ -0,0 +1,45 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dns64_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/dns64"
+)
+
+func TestSynthesize(t *testing.T) {
+	// RFC 6052, section 2.4
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{dns64.WellKnownPrefix, "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		p, err := dns64.Parse(tt.prefix)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.prefix, err)
+			continue
+		}
+		if got := p.Synthesize(net.ParseIP("192.0.2.33")); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: expected %s; got %s", tt.prefix, tt.want, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"64:ff9b::", "64:ff9b::/80", "192.0.2.0/24"} {
+		if _, err := dns64.Parse(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
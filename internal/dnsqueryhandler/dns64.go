@@ -0,0 +1,103 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type dns64Prefix interface {
+	Synthesize(v4 net.IP) net.IP
+}
+
+// ipv4Mapped is ::ffff:0:0/96. RFC 6147 treats AAAA records within it as if
+// they did not exist.
+var ipv4Mapped = &net.IPNet{
+	IP:   net.ParseIP("::ffff:0:0"),
+	Mask: net.CIDRMask(96, 128),
+}
+
+// needsDNS64 returns whether ures, the upstream response to an AAAA query,
+// calls for synthesis (RFC 6147, section 5.1): it is not NXDOMAIN, and has no
+// usable AAAA records.
+func needsDNS64(ures *dns.Msg) bool {
+	if ures.Rcode == dns.RcodeNameError {
+		return false
+	}
+	for _, rr := range ures.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !ipv4Mapped.Contains(aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesizeAAAA queries the A records of uquery's name and synthesizes AAAA
+// records from them. ures is the upstream response to the AAAA query, whose
+// SOA, if any, caps the TTL of the synthesized records. It returns nil if there
+// are no A records, or if the A query fails; the AAAA response is used as is,
+// then. blocked reports an A record with a blocked IP.
+func (s *DNSQueryHandler) synthesizeAAAA(ctx context.Context, logger *zap.Logger, uquery *dns.Msg, ures *dns.Msg) (res *dns.Msg, blocked bool) {
+	aquery := uquery.Copy()
+	aquery.Id = dns.Id()
+	aquery.Question[0].Qtype = dns.TypeA
+
+	ares, nameserver, err := s.exchangeWithRetry(ctx, logger, aquery)
+	if err != nil || ares.Id != aquery.Id || !sameQuestion(aquery, ares) || ares.Rcode != dns.RcodeSuccess {
+		logger.Info("DNS64 A query failed",
+			zap.String("nameserver", nameserver),
+			zap.Error(err),
+		)
+		return nil, false
+	}
+	if s.cookies != nil {
+		if err := s.cookies.Validate(ares, nameserver); err != nil {
+			logger.Info("invalid upstream cookie",
+				zap.Error(err),
+			)
+			return nil, false
+		}
+	}
+
+	maxTTL := ^uint32(0)
+	for _, rr := range ures.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < maxTTL {
+			maxTTL = soa.Minttl
+		}
+	}
+
+	res = ures.Copy()
+	res.Rcode = dns.RcodeSuccess
+	res.Answer = nil
+	res.Ns = nil
+	var synthesized int
+	for _, rr := range ares.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME, *dns.DNAME:
+			res.Answer = append(res.Answer, rr)
+		case *dns.A:
+			if s.hasBlockedIP(rr) {
+				return nil, true
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			if hdr.Ttl > maxTTL {
+				hdr.Ttl = maxTTL
+			}
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: s.dns64.Synthesize(rr.A)})
+			synthesized++
+		}
+	}
+	if synthesized < 1 {
+		return nil, false
+	}
+	logger.Info("synthesized AAAA records",
+		zap.Int("response.answers", synthesized),
+	)
+	return res, false
+}
@@ -4,14 +4,18 @@
 package dnsqueryhandler
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/execjosh/mydns/internal/metrics"
+	"github.com/execjosh/mydns/internal/policy"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
@@ -28,12 +32,537 @@ type exchanger interface {
 	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
 }
 
+type rules interface {
+	Decide(fqdn string, client net.IP) (action policy.Action, matched bool)
+}
+
+type readiness interface {
+	Ready() bool
+}
+
+type drainer interface {
+	Draining() bool
+}
+
+type maintainer interface {
+	InMaintenance() bool
+}
+
+type allowlist interface {
+	Allows(fqdn string) bool
+}
+
+type ipSet interface {
+	Contains(ip net.IP) bool
+}
+
+type typeFilter interface {
+	Suppressed(fqdn string, qtype uint16) bool
+}
+
+type quotaTracker interface {
+	Allow(ip net.IP) bool
+}
+
+type staticRecords interface {
+	Lookup(fqdn string, qtype uint16) ([]net.IP, bool)
+	LookupPTR(fqdn string) ([]string, bool)
+}
+
+type caaRecords interface {
+	Lookup(fqdn string) ([]*dns.CAA, bool)
+}
+
+type txtRecords interface {
+	Lookup(fqdn string) ([]*dns.TXT, bool)
+}
+
+type responseFilter interface {
+	Filter(q dns.Question, res *dns.Msg) *dns.Msg
+}
+
+type blockReporter interface {
+	ReportBlock(requestID string, fqdn string, qtype string, remoteAddr net.IP) error
+}
+
+type cookieJar interface {
+	Attach(m *dns.Msg, nameserver string) error
+	Validate(res *dns.Msg, nameserver string) error
+}
+
 // DNSQueryHandler represents a DNS query handler.
 type DNSQueryHandler struct {
-	logger      *zap.Logger
-	exchanger   exchanger
-	nameservers chooser
-	blocklist   set
+	logger           *zap.Logger
+	exchanger        exchanger
+	nameservers      chooser
+	blocklist        set
+	cookies          cookieJar
+	passthrough      map[uint16]bool
+	minimalANY       bool
+	normalizeQNAME   bool
+	reporter         blockReporter
+	compress         bool
+	recursion        bool
+	inspectCNAMEs    bool
+	logAnswers       bool
+	ede              bool
+	hosts            staticRecords
+	localTLDs        map[string][]net.IP
+	lastResort       staticRecords
+	caa              caaRecords
+	txt              txtRecords
+	policy           rules
+	sinkhole         allowlist
+	ready            readiness
+	drain            drainer
+	maintenance      maintainer
+	maintenanceRcode int
+	failOpen         bool
+	blockedIPs       ipSet
+	suppressed       typeFilter
+	quota            quotaTracker
+
+	queryDeadline time.Duration
+	retryWindow   time.Duration
+	retryBackoff  time.Duration
+
+	retryRcodes     map[int]bool
+	maxRcodeRetries int
+
+	unsupportedClassRcode  int
+	unsupportedTypeRcode   int
+	unsupportedOpcodeRcode int
+
+	whoami string
+
+	blockIP4  net.IP
+	blockIP6  net.IP
+	blockInfo *hinfo
+	blockHost string
+
+	tcpKeepalive time.Duration
+	padding      int
+
+	order    []string
+	pipeline pipeline
+
+	maxLabels  int
+	maxAnswers int
+	fallback   string
+
+	filters []responseFilter
+	dns64   dns64Prefix
+
+	overrides map[string]string
+
+	redirectIP4 net.IP
+	redirectIP6 net.IP
+}
+
+// Option configures optional behavior of a DNSQueryHandler.
+type Option func(*DNSQueryHandler)
+
+// WithCookies enables DNS Cookies (RFC 7873) for upstream queries.
+func WithCookies(jar cookieJar) Option {
+	return func(s *DNSQueryHandler) {
+		s.cookies = jar
+	}
+}
+
+// WithEDNSPassthrough copies the EDNS0 options with the given codes, e.g. 3 for
+// NSID, from client queries to upstream queries, and from upstream responses
+// back to clients. Other options are never passed on in either direction.
+func WithEDNSPassthrough(codes ...uint16) Option {
+	return func(s *DNSQueryHandler) {
+		if s.passthrough == nil {
+			s.passthrough = map[uint16]bool{}
+		}
+		for _, code := range codes {
+			s.passthrough[code] = true
+		}
+	}
+}
+
+// WithMinimalANY answers ANY queries with a synthesized HINFO record, as
+// described in RFC 8482, instead of refusing them.
+func WithMinimalANY() Option {
+	return func(s *DNSQueryHandler) {
+		s.minimalANY = true
+	}
+}
+
+// WithQNAMENormalization lowercases the names of queries sent upstream, so
+// that identical queries of clients using different case are coalesced. The
+// answers are returned in the client's case.
+func WithQNAMENormalization() Option {
+	return func(s *DNSQueryHandler) {
+		s.normalizeQNAME = true
+	}
+}
+
+// WithBlockReporter additionally reports every blocked query to r, e.g. to
+// forward it to syslog.
+func WithBlockReporter(r blockReporter) Option {
+	return func(s *DNSQueryHandler) {
+		s.reporter = r
+	}
+}
+
+// WithCompression sets whether responses use DNS name compression. It is
+// enabled by default. Disabling it helps legacy clients that mishandle
+// compressed names, at the cost of larger responses.
+func WithCompression(enabled bool) Option {
+	return func(s *DNSQueryHandler) {
+		s.compress = enabled
+	}
+}
+
+// WithRecursionAvailable sets whether responses have the RA bit set. It is set
+// by default, since mydns provides recursion via its upstreams, regardless of
+// what they answer with, and on synthesized responses alike.
+func WithRecursionAvailable(enabled bool) Option {
+	return func(s *DNSQueryHandler) {
+		s.recursion = enabled
+	}
+}
+
+// WithAnswerLog sets whether every record of an upstream answer is logged at
+// info level. It is enabled by default; on busy resolvers, these lines dominate
+// the log volume. Blocks and errors are logged regardless.
+func WithAnswerLog(enabled bool) Option {
+	return func(s *DNSQueryHandler) {
+		s.logAnswers = enabled
+	}
+}
+
+// WithCNAMEInspection sets whether upstream answers are blocked if any of their
+// CNAME records points to a blocked name, which catches CNAME cloaking. It is
+// enabled by default.
+func WithCNAMEInspection(enabled bool) Option {
+	return func(s *DNSQueryHandler) {
+		s.inspectCNAMEs = enabled
+	}
+}
+
+// WithExtendedErrors attaches Extended DNS Errors (RFC 8914) to blocked and
+// failed responses, if the client supports EDNS.
+func WithExtendedErrors() Option {
+	return func(s *DNSQueryHandler) {
+		s.ede = true
+	}
+}
+
+// WithQueryDeadline bounds the total time spent answering a single query. Once
+// d has elapsed, the query is answered with SERVFAIL.
+func WithQueryDeadline(d time.Duration) Option {
+	return func(s *DNSQueryHandler) {
+		s.queryDeadline = d
+	}
+}
+
+// WithStaticRecords answers queries for names found in h with their static
+// IPs, without consulting the blocklist or upstream.
+func WithStaticRecords(h staticRecords) Option {
+	return func(s *DNSQueryHandler) {
+		s.hosts = h
+	}
+}
+
+// WithLocalTLD answers every name under suffix, e.g. `test.`, with ips,
+// authoritatively and without forwarding, unless it has static records. Names
+// under several suffixes are answered with the IPs of the longest one.
+func WithLocalTLD(suffix string, ips ...net.IP) Option {
+	return func(s *DNSQueryHandler) {
+		if s.localTLDs == nil {
+			s.localTLDs = map[string][]net.IP{}
+		}
+		suffix = dns.CanonicalName(suffix)
+		s.localTLDs[suffix] = append(s.localTLDs[suffix], ips...)
+	}
+}
+
+// WithFallbackRecords answers A and AAAA queries for names found in h with
+// their static records, but only once upstream has failed them, i.e. the
+// exchange failed or was answered with SERVFAIL. Until then, such names are
+// forwarded like any other.
+func WithFallbackRecords(h staticRecords) Option {
+	return func(s *DNSQueryHandler) {
+		s.lastResort = h
+	}
+}
+
+// WithCAARecords answers CAA queries for names found in r with their static
+// records, without consulting the blocklist or upstream.
+func WithCAARecords(r caaRecords) Option {
+	return func(s *DNSQueryHandler) {
+		s.caa = r
+	}
+}
+
+// WithTXTRecords answers TXT queries for names with static TXT records, e.g.
+// SPF or DKIM records of internal mail domains, authoritatively. TXT queries
+// for other names are forwarded.
+func WithTXTRecords(r txtRecords) Option {
+	return func(s *DNSQueryHandler) {
+		s.txt = r
+	}
+}
+
+// WithResponseFilters passes every response through filters, in order, before
+// it is written. Each filter may modify the response, or replace it by
+// returning another one; returning nil leaves it unchanged.
+func WithResponseFilters(filters ...responseFilter) Option {
+	return func(s *DNSQueryHandler) {
+		s.filters = append(s.filters, filters...)
+	}
+}
+
+// WithDNS64 synthesizes AAAA records from A records for names without any, as
+// a DNS64 resolver (RFC 6147) does for NAT64. IPv4 addresses are embedded into
+// p.
+func WithDNS64(p dns64Prefix) Option {
+	return func(s *DNSQueryHandler) {
+		s.dns64 = p
+	}
+}
+
+// WithPolicy evaluates the ordered rules of p before the blocklist. If a rule
+// matches the name and the client's IP, its action decides whether the query
+// is blocked; otherwise, the blocklist does.
+func WithPolicy(p rules) Option {
+	return func(s *DNSQueryHandler) {
+		s.policy = p
+	}
+}
+
+// WithBlocklistReadiness covers the time until the blocklist has been loaded,
+// i.e. r is ready. Until then, queries reaching the block stage are refused,
+// or, if failOpen is set, forwarded without being checked.
+func WithBlocklistReadiness(r readiness, failOpen bool) Option {
+	return func(s *DNSQueryHandler) {
+		s.ready = r
+		s.failOpen = failOpen
+	}
+}
+
+// WithDrain refuses all queries once d is draining, e.g. before a shutdown,
+// so that clients and load balancers move on to other servers. Queries that
+// are already being handled are answered as usual.
+func WithDrain(d drainer) Option {
+	return func(s *DNSQueryHandler) {
+		s.drain = d
+	}
+}
+
+// WithMaintenance answers all queries with rcode, e.g. SERVFAIL, while m is in
+// maintenance mode, so that clients use their secondary resolver. Draining
+// takes precedence.
+func WithMaintenance(m maintainer, rcode int) Option {
+	return func(s *DNSQueryHandler) {
+		s.maintenance = m
+		s.maintenanceRcode = rcode
+	}
+}
+
+// WithSinkhole blocks every name, except those allowed by a policy rule or by
+// l, instead of consulting the blocklist. Blocked names are answered as
+// usual, e.g. with the block IPs, so that a captive portal can intercept them.
+func WithSinkhole(l allowlist) Option {
+	return func(s *DNSQueryHandler) {
+		s.sinkhole = l
+	}
+}
+
+// WithBlockedIPs blocks queries whose upstream answer contains an A or AAAA
+// record with an IP in l. This catches domains that are not known by name,
+// e.g. fast-flux domains, but resolve to known-bad IPs.
+func WithBlockedIPs(l ipSet) Option {
+	return func(s *DNSQueryHandler) {
+		s.blockedIPs = l
+	}
+}
+
+// WithRetry retries upstream queries that fail with a network error against the
+// next nameserver, for as long as window has not elapsed since the first
+// attempt. Between attempts, it waits backoff, jittered by up to ±25% to keep
+// clients from retrying in lockstep.
+func WithRetry(window, backoff time.Duration) Option {
+	return func(s *DNSQueryHandler) {
+		s.retryWindow = window
+		s.retryBackoff = backoff
+	}
+}
+
+// WithRcodeRetries retries upstream queries answered with one of rcodes, e.g.
+// SERVFAIL from an overloaded resolver, against the next nameserver, at most
+// max times. Unlike network errors, these retries do not wait. If all of them
+// are answered with such an rcode, the last response is used.
+func WithRcodeRetries(rcodes []int, max int) Option {
+	return func(s *DNSQueryHandler) {
+		s.retryRcodes = map[int]bool{}
+		for _, rcode := range rcodes {
+			s.retryRcodes[rcode] = true
+		}
+		s.maxRcodeRetries = max
+	}
+}
+
+// WithUnsupportedRcodes sets the rcodes used to answer questions of classes
+// other than INET and of unsupported types. Both default to REFUSED, which
+// some clients take as a cue to retry elsewhere; NOTIMP is often more
+// accurate.
+func WithUnsupportedRcodes(class, qtype int) Option {
+	return func(s *DNSQueryHandler) {
+		s.unsupportedClassRcode = class
+		s.unsupportedTypeRcode = qtype
+	}
+}
+
+// WithUnsupportedOpcodeRcode sets the rcode used to answer messages with an
+// opcode other than QUERY, e.g. UPDATE or NOTIFY. It defaults to REFUSED.
+func WithUnsupportedOpcodeRcode(rcode int) Option {
+	return func(s *DNSQueryHandler) {
+		s.unsupportedOpcodeRcode = rcode
+	}
+}
+
+// WithWhoami answers queries for name with the client's own IP, as seen by
+// the server: as an A or AAAA record, depending on its family, and as a TXT
+// record. This helps debugging NAT.
+func WithWhoami(name string) Option {
+	return func(s *DNSQueryHandler) {
+		s.whoami = dns.CanonicalName(name)
+	}
+}
+
+// WithSuppressedTypes answers queries whose type f suppresses for their domain
+// with NODATA, instead of forwarding them, e.g. AAAA for hosts with broken
+// IPv6. Other types are forwarded as usual.
+func WithSuppressedTypes(f typeFilter) Option {
+	return func(s *DNSQueryHandler) {
+		s.suppressed = f
+	}
+}
+
+// WithBlockAnswers sets the IPs blocked queries are answered with, e.g. those of
+// a sinkhole, instead of `0.0.0.0` for A and `::` for AAAA. A nil IP keeps the
+// default for its family, so an IPv4-only sinkhole still answers AAAA with
+// `::`.
+func WithBlockAnswers(ip4, ip6 net.IP) Option {
+	return func(s *DNSQueryHandler) {
+		if ip4 != nil {
+			s.blockIP4 = ip4.To4()
+		}
+		if ip6 != nil {
+			s.blockIP6 = ip6
+		}
+	}
+}
+
+// WithHINFOBlocks answers blocked queries with an HINFO record holding cpu and
+// os, e.g. `BLOCKED` and `policy`, which explains the block in client logs,
+// instead of an address record.
+func WithHINFOBlocks(cpu, os string) Option {
+	return func(s *DNSQueryHandler) {
+		s.blockInfo = &hinfo{cpu: cpu, os: os}
+	}
+}
+
+// WithFallback queries nameserver, the nameserver of last resort, once
+// queries to the rotating nameservers have failed, including any retries,
+// before answering SERVFAIL.
+func WithFallback(nameserver string) Option {
+	return func(s *DNSQueryHandler) {
+		s.fallback = nameserver
+	}
+}
+
+// WithUpstreamOverride lets clients pick the upstream nameserver of a query,
+// bypassing the rotation, for debugging: either with the EDNS0 option
+// EDNS0UpstreamOverride, or by appending `via.<IP with dashes>` to the name,
+// e.g. `example.com.via.192-0-2-1.`, which is stripped before forwarding.
+// nameservers maps the IPs that may be picked, in the form of net.IP.String,
+// to the address the exchanger knows them by; queries naming others are
+// refused, so that clients cannot relay queries to arbitrary servers.
+func WithUpstreamOverride(nameservers map[string]string) Option {
+	return func(s *DNSQueryHandler) {
+		s.overrides = nameservers
+	}
+}
+
+// WithNXDOMAINRedirect answers A and AAAA queries that upstream answered with
+// NXDOMAIN with ip4 and ip6, respectively, e.g. those of an error page, with a
+// TTL of zero. Either may be nil to keep NXDOMAIN for its family. This breaks
+// anything relying on NXDOMAIN, so it is only meant for captive portals and
+// the like.
+func WithNXDOMAINRedirect(ip4, ip6 net.IP) Option {
+	return func(s *DNSQueryHandler) {
+		s.redirectIP4 = ip4
+		s.redirectIP6 = ip6
+	}
+}
+
+// WithMaxAnswers caps the answers to upstream queries at the first n records,
+// to keep responses small. This is deliberate, so it does not set TC.
+func WithMaxAnswers(n int) Option {
+	return func(s *DNSQueryHandler) {
+		s.maxAnswers = n
+	}
+}
+
+// WithMaxLabels refuses queries for names with more than n labels, before they
+// reach any lookup. Names longer than 253 bytes are always refused.
+func WithMaxLabels(n int) Option {
+	return func(s *DNSQueryHandler) {
+		s.maxLabels = n
+	}
+}
+
+// WithCNAMEBlocks answers blocked queries with a CNAME record pointing to
+// target, e.g. a host serving a page that explains the block, instead of an
+// address record. If target is blocked itself, which would make clients loop,
+// blocked queries are answered with an address record after all.
+func WithCNAMEBlocks(target string) Option {
+	return func(s *DNSQueryHandler) {
+		s.blockHost = dns.Fqdn(target)
+	}
+}
+
+// WithTCPKeepalive advertises timeout as the idle timeout of TCP connections,
+// via the EDNS0 TCP Keepalive option (RFC 7828). As the RFC requires, it is only
+// added to responses to TCP queries carrying the option themselves. timeout
+// must not exceed MaxTCPKeepalive.
+func WithTCPKeepalive(timeout time.Duration) Option {
+	return func(s *DNSQueryHandler) {
+		s.tcpKeepalive = timeout
+	}
+}
+
+// WithPadding pads responses to a multiple of blockSize bytes via the EDNS0
+// Padding option (RFC 7830), to resist traffic analysis of encrypted
+// transports. Only responses to queries received over TLS or carrying the
+// option themselves are padded. RFC 8467 recommends a block size of 468.
+func WithPadding(blockSize int) Option {
+	return func(s *DNSQueryHandler) {
+		s.padding = blockSize
+	}
+}
+
+// WithClientQuota refuses queries of clients that have exceeded their quota,
+// as counted by q.
+func WithClientQuota(q quotaTracker) Option {
+	return func(s *DNSQueryHandler) {
+		s.quota = q
+	}
+}
+
+// WithStageOrder sets the order of the stages queries pass through before they
+// are forwarded, e.g. to let static records override blocks by running
+// StageStatic before StageBlock. order must pass ValidateStageOrder.
+func WithStageOrder(order []string) Option {
+	return func(s *DNSQueryHandler) {
+		s.order = order
+	}
 }
 
 // New returns a new instance of DNSQueryHandler.
@@ -42,34 +571,85 @@ func New(
 	exchanger exchanger,
 	nameservers chooser,
 	blocklist set,
+	opts ...Option,
 ) *DNSQueryHandler {
-	return &DNSQueryHandler{
-		logger:      logger,
-		exchanger:   exchanger,
-		nameservers: nameservers,
-		blocklist:   blocklist,
+	s := &DNSQueryHandler{
+		logger:        logger,
+		exchanger:     exchanger,
+		nameservers:   nameservers,
+		blocklist:     blocklist,
+		compress:      true,
+		recursion:     true,
+		inspectCNAMEs: true,
+		logAnswers:    true,
+
+		unsupportedClassRcode:  dns.RcodeRefused,
+		unsupportedTypeRcode:   dns.RcodeRefused,
+		unsupportedOpcodeRcode: dns.RcodeRefused,
+
+		blockIP4: net.IPv4zero,
+		blockIP6: net.IPv6zero,
+
+		order: DefaultStageOrder(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.pipeline = newPipeline(s, s.order)
+	return s
 }
 
-// HandleAandAAAA handles DNS queries for class INET and types A and AAAA. If the
-// requested domain name is blocked, it responds with `0.0.0.0` for A (or `::`
-// for AAAA). Otherwise, it forwards the request to an upstream server.
+// HandleAandAAAA handles DNS queries for class INET and the types accepted by
+// isValidQtype, foremost A and AAAA. If the requested domain name is blocked,
+// it responds with `0.0.0.0` for A (or `::` for AAAA), unless other IPs are
+// set by WithBlockAnswers. Otherwise, it forwards the request to an upstream
+// server.
 func (s *DNSQueryHandler) HandleAandAAAA(w dns.ResponseWriter, r *dns.Msg) {
 	logger := s.logger
 
+	ctx := context.Background()
+	if s.queryDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.queryDeadline)
+		defer cancel()
+	}
+
 	reqID, err := generateRequestID()
 	if err != nil {
 		s.logger.Error("failed to generate request ID",
 			zap.Error(err),
 		)
-		writeErr(w, r, dns.RcodeServerFailure)
+		s.writeErr(w, r, dns.RcodeServerFailure, edeOther)
+		return
+	}
+	logger = logger.With(
+		zap.String("request.ID", reqID),
+		zap.Uint16("query.ID", r.Id),
+	)
+
+	if s.drain != nil && s.drain.Draining() {
+		logger.Info("refusing to answer while draining")
+		s.writeErr(w, r, dns.RcodeRefused, edeDraining)
+		return
+	}
+	if s.maintenance != nil && s.maintenance.InMaintenance() {
+		logger.Info("failing to answer in maintenance mode")
+		s.writeErr(w, r, s.maintenanceRcode, edeMaintenance)
+		return
+	}
+
+	if r.Opcode != dns.OpcodeQuery {
+		logger.Info("refusing to answer non-QUERY opcode",
+			zap.String("opcode", opcodeToString(r.Opcode)),
+		)
+		metrics.UnsupportedOpcodes.Add(1)
+		s.writeErr(w, r, s.unsupportedOpcodeRcode, edeNotSupported)
 		return
 	}
-	logger = logger.With(zap.String("request.ID", reqID))
 
 	if len(r.Question) < 1 {
 		logger.Info("refusing to answer because there are no questions")
-		writeErr(w, r, dns.RcodeRefused)
+		s.writeErr(w, r, dns.RcodeRefused, edeOther)
 		return
 	}
 
@@ -77,7 +657,10 @@ func (s *DNSQueryHandler) HandleAandAAAA(w dns.ResponseWriter, r *dns.Msg) {
 	q := r.Question[0]
 
 	fqdn := dns.Fqdn(q.Name)
-	logger = logger.With(zap.String("query.fqdn", fqdn))
+	logger = logger.With(
+		zap.String("query.fqdn", fqdn),
+		zap.String("query.type", qtypeToString(q.Qtype)),
+	)
 
 	remoteAddr, err := addrToIP(w.RemoteAddr())
 	if err != nil {
@@ -88,83 +671,675 @@ func (s *DNSQueryHandler) HandleAandAAAA(w dns.ResponseWriter, r *dns.Msg) {
 	}
 	logger = logger.With(zap.Stringer("remoteAddr", remoteAddr))
 
-	if q.Qclass != dns.ClassINET {
-		logger.Info("refusing to answer non-INET class question",
-			zap.String("Qclass", qclassToString(q.Qclass)),
-		)
-		writeErr(w, r, dns.RcodeRefused)
-		return
+	var nameserver string
+	if s.overrides != nil {
+		if name, ip, ok := parseOverride(r, fqdn); ok {
+			ns, known := s.overrides[ip.String()]
+			if !known {
+				logger.Info("refusing to override upstream with an unknown nameserver",
+					zap.Stringer("upstreamOverride", ip),
+				)
+				s.writeErr(w, r, dns.RcodeRefused, edeOther)
+				return
+			}
+			fqdn, nameserver = name, ns
+			logger = logger.With(zap.String("upstreamOverride", ns))
+		}
 	}
 
-	if !isValidQtype(q.Qtype) {
-		logger.Info("refusing to answer non-A/AAAA type question",
-			zap.String("Qtype", qtypeToString(q.Qtype)),
+	if s.isOversized(fqdn) {
+		logger.Info("refusing to answer because the name is too long",
+			zap.Int("query.labels", dns.CountLabel(fqdn)),
 		)
-		writeErr(w, r, dns.RcodeRefused)
+		metrics.OversizedQueries.Add(1)
+		s.writeErr(w, r, dns.RcodeRefused, edeOther)
 		return
 	}
 
-	if s.blocklist.Contains(fqdn) {
-		ans := generateBlockedAnswer(fqdn, q.Qtype, q.Qclass)
-		logger.Info("block",
-			zap.String("response.answer", ans.String()),
-		)
-		writeAnswer(w, r, ans)
-		return
+	res := s.pipeline.run(ctx, &query{
+		msg:        r,
+		question:   q,
+		fqdn:       fqdn,
+		reqID:      reqID,
+		remoteAddr: remoteAddr,
+		nameserver: nameserver,
+		logger:     logger,
+	})
+	s.writeMsg(w, r, res.msg, res.ede)
+}
+
+func (s *DNSQueryHandler) stageQuota(ctx context.Context, q *query) (bool, *response) {
+	if s.quota == nil || s.quota.Allow(q.remoteAddr) {
+		return false, nil
 	}
+	q.logger.Info("refusing to answer because the client quota is exceeded")
+	return true, errResponse(q.msg, dns.RcodeRefused, edeQuotaExceeded)
+}
 
-	nameserver := s.nameservers.Next()
-	logger = logger.With(zap.String("nameserver", nameserver))
+func (s *DNSQueryHandler) stageClass(ctx context.Context, q *query) (bool, *response) {
+	if q.question.Qclass == dns.ClassINET {
+		return false, nil
+	}
+	q.logger.Info("refusing to answer non-INET class question",
+		zap.String("Qclass", qclassToString(q.question.Qclass)),
+	)
+	return true, errResponse(q.msg, s.unsupportedClassRcode, edeNotSupported)
+}
+
+func (s *DNSQueryHandler) stageWhoami(ctx context.Context, q *query) (bool, *response) {
+	if len(s.whoami) < 1 || dns.CanonicalName(q.fqdn) != s.whoami {
+		return false, nil
+	}
+	answers := generateWhoamiAnswers(q.fqdn, q.question.Qtype, q.question.Qclass, q.remoteAddr)
+	q.logger.Info("whoami",
+		zap.Int("response.answers", len(answers)),
+	)
+	return true, answerResponse(q.msg, nil, answers...)
+}
+
+func (s *DNSQueryHandler) stageANY(ctx context.Context, q *query) (bool, *response) {
+	if q.question.Qtype != dns.TypeANY || !s.minimalANY {
+		return false, nil
+	}
+	ans := generateMinimalANYAnswer(q.fqdn, q.question.Qclass)
+	q.logger.Info("minimal ANY",
+		zap.String("response.answer", ans.String()),
+	)
+	return true, answerResponse(q.msg, nil, ans)
+}
+
+func (s *DNSQueryHandler) stageType(ctx context.Context, q *query) (bool, *response) {
+	if isValidQtype(q.question.Qtype) || s.hasStaticPTR(q) {
+		return false, nil
+	}
+	q.logger.Info("refusing to answer unsupported type question",
+		zap.String("Qtype", qtypeToString(q.question.Qtype)),
+	)
+	return true, errResponse(q.msg, s.unsupportedTypeRcode, edeNotSupported)
+}
+
+// hasStaticPTR returns whether q is a PTR query for the IP of a static record.
+// Other PTR queries are not supported.
+func (s *DNSQueryHandler) hasStaticPTR(q *query) bool {
+	if s.hosts == nil || q.question.Qtype != dns.TypePTR {
+		return false
+	}
+	_, ok := s.hosts.LookupPTR(q.fqdn)
+	return ok
+}
+
+func (s *DNSQueryHandler) stageStatic(ctx context.Context, q *query) (bool, *response) {
+	if s.caa != nil && q.question.Qtype == dns.TypeCAA {
+		if records, ok := s.caa.Lookup(q.fqdn); ok {
+			answers := generateStaticCAAAnswers(q.fqdn, q.question.Qclass, records)
+			q.logger.Info("static",
+				zap.Int("response.answers", len(answers)),
+			)
+			return true, answerResponse(q.msg, nil, answers...)
+		}
+	}
+	if s.txt != nil && q.question.Qtype == dns.TypeTXT {
+		if records, ok := s.txt.Lookup(q.fqdn); ok {
+			answers := generateStaticTXTAnswers(q.fqdn, q.question.Qclass, records)
+			q.logger.Info("static",
+				zap.Int("response.answers", len(answers)),
+			)
+			res := answerResponse(q.msg, nil, answers...)
+			res.msg.Authoritative = true
+			return true, res
+		}
+	}
+	if s.hosts == nil {
+		return s.stageLocalTLD(q)
+	}
+	var answers []dns.RR
+	if q.question.Qtype == dns.TypePTR {
+		names, ok := s.hosts.LookupPTR(q.fqdn)
+		if !ok {
+			return s.stageLocalTLD(q)
+		}
+		answers = generateStaticPTRAnswers(q.fqdn, q.question.Qclass, names)
+	} else {
+		ips, ok := s.hosts.Lookup(q.fqdn, q.question.Qtype)
+		if !ok {
+			return s.stageLocalTLD(q)
+		}
+		answers = generateStaticAnswers(q.fqdn, q.question.Qtype, q.question.Qclass, ips)
+	}
+	q.logger.Info("static",
+		zap.Int("response.answers", len(answers)),
+	)
+	return true, answerResponse(q.msg, nil, answers...)
+}
+
+// stageLocalTLD answers names under a local TLD authoritatively. Types other
+// than A and AAAA, and families without IPs, are answered with NODATA.
+func (s *DNSQueryHandler) stageLocalTLD(q *query) (bool, *response) {
+	suffix, ips, ok := s.lookupLocalTLD(q.fqdn)
+	if !ok {
+		return false, nil
+	}
+	answers := generateStaticAnswers(q.fqdn, q.question.Qtype, q.question.Qclass, ips)
+	q.logger.Info("local TLD",
+		zap.String("suffix", suffix),
+		zap.Int("response.answers", len(answers)),
+	)
+	res := answerResponse(q.msg, nil, answers...)
+	res.msg.Authoritative = true
+	return true, res
+}
 
+// lookupLocalTLD returns the longest local TLD fqdn is under, and its IPs.
+func (s *DNSQueryHandler) lookupLocalTLD(fqdn string) (string, []net.IP, bool) {
+	if len(s.localTLDs) < 1 {
+		return "", nil, false
+	}
+	fqdn = dns.CanonicalName(fqdn)
+	for _, i := range dns.Split(fqdn) {
+		if ips, ok := s.localTLDs[fqdn[i:]]; ok {
+			return fqdn[i:], ips, true
+		}
+	}
+	return "", nil, false
+}
+
+func (s *DNSQueryHandler) stageBlock(ctx context.Context, q *query) (bool, *response) {
+	if s.ready != nil && !s.ready.Ready() {
+		if s.failOpen {
+			q.logger.Debug("blocklist not ready; forwarding unfiltered")
+			return false, nil
+		}
+		q.logger.Info("blocklist not ready; refusing")
+		return true, errResponse(q.msg, dns.RcodeRefused, edeNotReady)
+	}
+	if !s.isBlocked(q.fqdn, q.remoteAddr) {
+		return false, nil
+	}
+	return true, s.blocked(q)
+}
+
+func (s *DNSQueryHandler) stageSuppress(ctx context.Context, q *query) (bool, *response) {
+	if s.suppressed == nil || !s.suppressed.Suppressed(q.fqdn, q.question.Qtype) {
+		return false, nil
+	}
+	q.logger.Info("suppressed type",
+		zap.String("Qtype", qtypeToString(q.question.Qtype)),
+	)
+	return true, answerResponse(q.msg, nil)
+}
+
+// stageForward forwards the query to the upstream nameservers. It always
+// handles the query, so it comes last.
+func (s *DNSQueryHandler) stageForward(ctx context.Context, q *query) (bool, *response) {
+	logger := q.logger
+	qname := q.fqdn
+	if s.normalizeQNAME {
+		qname = strings.ToLower(qname)
+	}
 	uquery := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Id:               dns.Id(),
-			RecursionDesired: r.RecursionDesired,
+			RecursionDesired: q.msg.RecursionDesired,
+			CheckingDisabled: q.msg.CheckingDisabled,
 			Opcode:           dns.OpcodeQuery,
 		},
 		Question: []dns.Question{
 			{
-				Name:   fqdn,
-				Qtype:  q.Qtype,
-				Qclass: q.Qclass,
+				Name:   qname,
+				Qtype:  q.question.Qtype,
+				Qclass: q.question.Qclass,
 			},
 		},
 	}
-	ures, _, err := s.exchanger.Exchange(uquery, nameserver)
+	logger = logger.With(zap.Uint16("upstreamQuery.ID", uquery.Id))
+	if dnssecOK(q.msg) {
+		// validators behind mydns need the upstream's RRSIGs and denial proofs
+		uquery.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	s.passOptions(q.msg, uquery)
+	var ures *dns.Msg
+	var nameserver string
+	var err error
+	if len(q.nameserver) > 0 {
+		nameserver = q.nameserver
+		ures, err = s.attempt(ctx, logger, uquery, nameserver)
+	} else {
+		ures, nameserver, err = s.exchangeWithRetry(ctx, logger, uquery)
+		if err != nil && len(s.fallback) > 0 && ctx.Err() == nil {
+			logger.Info("falling back to the nameserver of last resort",
+				zap.String("nameserver", nameserver),
+				zap.Error(err),
+			)
+			metrics.UpstreamFallbacks.Add(1)
+			nameserver = s.fallback
+			ures, err = s.attempt(ctx, logger, uquery, nameserver)
+		}
+	}
+	logger = logger.With(zap.String("nameserver", nameserver))
 	if err != nil {
 		logger.Error("upstream DNS query failed",
 			zap.Error(err),
 		)
-		writeErr(w, r, dns.RcodeServerFailure)
-		return
+		if res, ok := s.fallbackRecords(q); ok {
+			return true, res
+		}
+		return true, errResponse(q.msg, dns.RcodeServerFailure, edeNetworkError)
 	}
 
 	if uquery.Id != ures.Id {
 		logger.Info("query response ID mismatch",
-			zap.Uint16("upstreamQuery.ID", uquery.Id),
 			zap.Uint16("upstreamResponse.ID", ures.Id),
 		)
-		writeErr(w, r, dns.RcodeServerFailure)
-		return
+		metrics.SpoofedResponses.Add(1)
+		return true, errResponse(q.msg, dns.RcodeServerFailure, edeIDMismatch)
+	}
+
+	if !sameQuestion(uquery, ures) {
+		logger.Info("query response question mismatch",
+			zap.Any("upstreamQuery.Question", uquery.Question),
+			zap.Any("upstreamResponse.Question", ures.Question),
+		)
+		metrics.SpoofedResponses.Add(1)
+		return true, errResponse(q.msg, dns.RcodeServerFailure, edeQuestionMismatch)
+	}
+	if sent, got := uquery.Question[0].Name, ures.Question[0].Name; sent != got {
+		// accepted, but a sign of a buggy upstream or a middlebox rewriting names
+		logger.Info("query response question name case mismatch",
+			zap.String("upstreamQuery.Name", sent),
+			zap.String("upstreamResponse.Name", got),
+		)
+		metrics.CaseMismatches.Add(1)
+	}
+
+	if s.cookies != nil {
+		if err := s.cookies.Validate(ures, nameserver); err != nil {
+			logger.Info("invalid upstream cookie",
+				zap.Error(err),
+			)
+			return true, errResponse(q.msg, dns.RcodeServerFailure, edeInvalidCookie)
+		}
+	}
+
+	if s.dns64 != nil && q.question.Qtype == dns.TypeAAAA && needsDNS64(ures) {
+		synthesized, blocked := s.synthesizeAAAA(ctx, logger, uquery, ures)
+		if blocked {
+			logger.Info("answer IP is blocked")
+			return true, s.blocked(q)
+		}
+		if synthesized != nil {
+			ures = synthesized
+		}
+	}
+
+	if ures.Rcode == dns.RcodeServerFailure {
+		if res, ok := s.fallbackRecords(q); ok {
+			return true, res
+		}
+	}
+
+	if ures.Rcode == dns.RcodeNameError && s.redirects(q.question.Qtype) {
+		logger.Info("redirecting NXDOMAIN")
+		return true, answerResponse(q.msg, nil, generateBlockedAnswer(q.fqdn, q.question.Qclass, q.question.Qtype, s.redirectIP4, s.redirectIP6))
 	}
 
 	if len(ures.Answer) < 1 {
-		// TODO check ures.Rcode and behave accordingly
-		logger.Info("no answer in query response")
-		writeErr(w, r, dns.RcodeNameError)
-		return
+		logger.Info("no answer in query response",
+			zap.String("upstreamResponse.rcode", dns.RcodeToString[ures.Rcode]),
+		)
+		res := emptyResponse(q.msg, ures)
+		s.passOptions(ures, res.msg)
+		return true, res
 	}
 
 	// TODO maybe cache upstream responses
 	var answers []dns.RR
 	for _, ans := range ures.Answer {
-		logger.Info("answer",
-			zap.String("response.answer", ans.String()),
+		if s.logAnswers {
+			logger.Info("answer",
+				zap.String("response.answer", ans.String()),
+			)
+		}
+		if s.hasBlockedIP(ans) {
+			logger.Info("answer IP is blocked")
+			return true, s.blocked(q)
+		}
+		if target, ok := s.blockedCNAMETarget(ans, q.remoteAddr); ok {
+			logger.Info("CNAME target is blocked",
+				zap.String("target", target),
+			)
+			return true, s.blocked(q)
+		}
+		if containsRR(answers, ans) {
+			logger.Info("dropping duplicate answer")
+			continue
+		}
+		if qname != q.fqdn && ans.Header().Name == qname {
+			// restore the client's case
+			ans = dns.Copy(ans)
+			ans.Header().Name = q.fqdn
+		}
+		answers = append(answers, ans)
+	}
+	if s.maxAnswers > 0 && len(answers) > s.maxAnswers {
+		logger.Info("capping answers",
+			zap.Int("response.answers", len(answers)),
+			zap.Int("maxAnswers", s.maxAnswers),
 		)
+		answers = answers[:s.maxAnswers]
+	}
+
+	res := answerResponse(q.msg, nil, answers...)
+	s.passOptions(ures, res.msg)
+	return true, res
+}
+
+// passOptions copies the EDNS0 options of from that are passed through to to,
+// adding an OPT record to to if needed.
+func (s *DNSQueryHandler) passOptions(from, to *dns.Msg) {
+	opt := from.IsEdns0()
+	if len(s.passthrough) < 1 || opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		if s.passthrough[o.Option()] {
+			addOption(to, o)
+		}
+	}
+}
+
+// fallbackRecords answers q with its fallback records, if it has any, after
+// upstream has failed it.
+func (s *DNSQueryHandler) fallbackRecords(q *query) (*response, bool) {
+	if s.lastResort == nil {
+		return nil, false
+	}
+	if q.question.Qtype != dns.TypeA && q.question.Qtype != dns.TypeAAAA {
+		return nil, false
+	}
+	ips, ok := s.lastResort.Lookup(q.fqdn, q.question.Qtype)
+	if !ok {
+		return nil, false
+	}
+	answers := generateStaticAnswers(q.fqdn, q.question.Qtype, q.question.Qclass, ips)
+	q.logger.Info("answering with fallback records",
+		zap.Int("response.answers", len(answers)),
+	)
+	metrics.FallbackRecordAnswers.Add(1)
+	return answerResponse(q.msg, nil, answers...), true
+}
+
+// redirects reports whether NXDOMAIN is redirected for qtype.
+func (s *DNSQueryHandler) redirects(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA:
+		return s.redirectIP4 != nil
+	case dns.TypeAAAA:
+		return s.redirectIP6 != nil
+	}
+	return false
+}
+
+// maxNameLen is the maximum length of a name in presentation format, without
+// the trailing dot.
+const maxNameLen = 253
+
+// isOversized reports whether fqdn exceeds the length or label limits.
+func (s *DNSQueryHandler) isOversized(fqdn string) bool {
+	if len(strings.TrimSuffix(fqdn, ".")) > maxNameLen {
+		return true
+	}
+	return s.maxLabels > 0 && dns.CountLabel(fqdn) > s.maxLabels
+}
+
+// isBlocked returns whether fqdn is blocked for client.
+func (s *DNSQueryHandler) isBlocked(fqdn string, client net.IP) bool {
+	if s.policy != nil {
+		if action, ok := s.policy.Decide(fqdn, client); ok {
+			return action == policy.Block
+		}
+	}
+	if s.sinkhole != nil {
+		return !s.sinkhole.Allows(fqdn)
+	}
+	return s.blocklist.Contains(fqdn)
+}
+
+// blockedCNAMETarget returns the target of rr, if it is a CNAME record pointing
+// to a name blocked for client by the policy or the blocklist. Targets are not
+// subject to the sinkhole: the names an allowed name is an alias of, e.g. of a
+// CDN, are allowed along with it.
+func (s *DNSQueryHandler) blockedCNAMETarget(rr dns.RR, client net.IP) (string, bool) {
+	cname, ok := rr.(*dns.CNAME)
+	if !ok || !s.inspectCNAMEs {
+		return "", false
+	}
+	if s.policy != nil {
+		if action, ok := s.policy.Decide(cname.Target, client); ok {
+			return cname.Target, action == policy.Block
+		}
+	}
+	return cname.Target, s.blocklist.Contains(cname.Target)
+}
+
+// hasBlockedIP returns whether rr is an A or AAAA record with a blocked IP.
+func (s *DNSQueryHandler) hasBlockedIP(rr dns.RR) bool {
+	if s.blockedIPs == nil {
+		return false
+	}
+
+	switch rr := rr.(type) {
+	case *dns.A:
+		return s.blockedIPs.Contains(rr.A)
+	case *dns.AAAA:
+		return s.blockedIPs.Contains(rr.AAAA)
+	}
+	return false
+}
+
+// emptyResponse answers r like ures, which has no answer: with its rcode, e.g.
+// NOERROR for NODATA or NXDOMAIN, and the SOA records of its authority
+// section, which tell clients how long to cache the negative answer. If r has
+// the DO bit set, the NSEC, NSEC3, and RRSIG records proving the denial are
+// kept as well.
+func emptyResponse(r *dns.Msg, ures *dns.Msg) *response {
+	res := errResponse(r, ures.Rcode, nil)
+	proofs := dnssecOK(r)
+	for _, rr := range ures.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			if !proofs {
+				continue
+			}
+		default:
+			continue
+		}
+		res.msg.Ns = append(res.msg.Ns, rr)
+	}
+	return res
+}
+
+// dnssecOK reports whether r has the DO bit set, i.e. the client wants DNSSEC
+// records (RFC 3225).
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// containsRR reports whether rrs holds a duplicate of rr, i.e. one with the same
+// name, class, type, and data, but possibly another TTL.
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, x := range rrs {
+		if dns.IsDuplicate(x, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocked answers q with the blocked answer and reports the block, if enabled.
+func (s *DNSQueryHandler) blocked(q *query) *response {
+	var ans dns.RR
+	switch {
+	case q.question.Qtype == dns.TypeCAA, q.question.Qtype == dns.TypeTLSA,
+		q.question.Qtype == dns.TypeDS, q.question.Qtype == dns.TypeDNSKEY,
+		q.question.Qtype == dns.TypeTXT:
+		// NODATA: a blocked name has no CAA, TLSA, DS, DNSKEY, or TXT
+		// records, whatever the block mode
+	case s.blockInfo != nil:
+		ans = generateBlockedHINFOAnswer(q.fqdn, q.question.Qclass, s.blockInfo)
+	case len(s.blockHost) > 0 && !s.isBlocked(s.blockHost, q.remoteAddr):
+		ans = generateBlockedCNAMEAnswer(q.fqdn, q.question.Qclass, s.blockHost)
+	default:
+		if len(s.blockHost) > 0 {
+			q.logger.Warn("CNAME block target is blocked itself",
+				zap.String("target", s.blockHost),
+			)
+		}
+		ans = generateBlockedAnswer(q.fqdn, q.question.Qclass, q.question.Qtype, s.blockIP4, s.blockIP6)
+	}
+	var answers []dns.RR
+	desc := "NODATA"
+	if ans != nil {
 		answers = append(answers, ans)
+		desc = ans.String()
+	}
+	q.logger.Info("block",
+		zap.String("response.answer", desc),
+	)
+	if s.reporter != nil {
+		if err := s.reporter.ReportBlock(q.reqID, q.fqdn, qtypeToString(q.question.Qtype), q.remoteAddr); err != nil {
+			q.logger.Error("failed to report block",
+				zap.Error(err),
+			)
+		}
+	}
+	return answerResponse(q.msg, edeBlocked, answers...)
+}
+
+// exchangeWithRetry sends uquery to the next nameserver, retrying failed
+// attempts against the following ones while the retry window allows, and
+// responses with a retryable rcode up to the configured number of times. It
+// returns the nameserver of the last attempt.
+func (s *DNSQueryHandler) exchangeWithRetry(ctx context.Context, logger *zap.Logger, uquery *dns.Msg) (*dns.Msg, string, error) {
+	start := time.Now()
+	rcodeRetries := 0
+	for attempt := 1; ; attempt++ {
+		nameserver := s.nameservers.Next()
+		ures, err := s.attempt(ctx, logger, uquery, nameserver)
+		if err == nil && s.retryRcodes[ures.Rcode] && rcodeRetries < s.maxRcodeRetries && ctx.Err() == nil {
+			rcodeRetries++
+			logger.Info("retrying upstream DNS query after error rcode",
+				zap.String("nameserver", nameserver),
+				zap.Int("attempt", attempt),
+				zap.String("upstreamResponse.rcode", dns.RcodeToString[ures.Rcode]),
+			)
+			metrics.UpstreamRcodeRetries.Add(1)
+			continue
+		}
+		if err == nil || ctx.Err() != nil {
+			return ures, nameserver, err
+		}
+
+		backoff := jitter(s.retryBackoff)
+		if time.Since(start)+backoff >= s.retryWindow {
+			return nil, nameserver, err
+		}
+		logger.Info("retrying upstream DNS query",
+			zap.String("nameserver", nameserver),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nameserver, fmt.Errorf("query deadline: %w", ctx.Err())
+		case <-t.C:
+		}
+	}
+}
+
+// attempt sends a copy of uquery to nameserver, as exchange may attach options
+// to it. At debug level, the query and response are dumped.
+func (s *DNSQueryHandler) attempt(ctx context.Context, logger *zap.Logger, uquery *dns.Msg, nameserver string) (*dns.Msg, error) {
+	m := uquery.Copy()
+	ures, err := s.exchange(ctx, m, nameserver)
+	if ce := logger.Check(zap.DebugLevel, "upstream exchange"); ce != nil {
+		fields := []zap.Field{zap.String("nameserver", nameserver)}
+		fields = append(fields, dumpMsg("upstreamQuery", m)...)
+		fields = append(fields, dumpMsg("upstreamResponse", ures)...)
+		ce.Write(fields...)
+	}
+	return ures, err
+}
+
+// dumpMsg returns fields holding m both parsed and as hex of its wire format,
+// under key. It is costly, so only call it when the result is logged.
+func dumpMsg(key string, m *dns.Msg) []zap.Field {
+	if m == nil {
+		return nil
+	}
+	fields := []zap.Field{zap.String(key, m.String())}
+	if wire, err := m.Pack(); err == nil {
+		fields = append(fields, zap.String(key+".wire", hex.EncodeToString(wire)))
+	}
+	return fields
+}
+
+// jitter returns d randomly scaled by a factor between 0.75 and 1.25.
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.75 + mathrand.Float64()/2))
+}
+
+// exchange sends uquery to nameserver, attaching a DNS Cookie if enabled. If
+// the nameserver rejects the cookie with BADCOOKIE, the query is retried once
+// with the server cookie it returned.
+func (s *DNSQueryHandler) exchange(ctx context.Context, uquery *dns.Msg, nameserver string) (*dns.Msg, error) {
+	if s.cookies == nil {
+		return s.exchangeContext(ctx, uquery, nameserver)
+	}
+
+	if err := s.cookies.Attach(uquery, nameserver); err != nil {
+		return nil, fmt.Errorf("attaching cookie: %w", err)
+	}
+	ures, err := s.exchangeContext(ctx, uquery, nameserver)
+	if err != nil || ures.Rcode != dns.RcodeBadCookie {
+		return ures, err
+	}
+
+	if err := s.cookies.Validate(ures, nameserver); err != nil {
+		return nil, fmt.Errorf("validating BADCOOKIE response: %w", err)
+	}
+	retry := uquery.Copy()
+	removeOption(retry, dns.EDNS0COOKIE)
+	if err := s.cookies.Attach(retry, nameserver); err != nil {
+		return nil, fmt.Errorf("attaching cookie: %w", err)
+	}
+	return s.exchangeContext(ctx, retry, nameserver)
+}
+
+// exchangeContext sends m to nameserver, giving up once ctx is done. The
+// underlying exchange is then left to finish on its own timeouts.
+func (s *DNSQueryHandler) exchangeContext(ctx context.Context, m *dns.Msg, nameserver string) (*dns.Msg, error) {
+	type result struct {
+		res *dns.Msg
+		err error
 	}
 
-	writeAnswer(w, r, answers...)
+	c := make(chan result, 1)
+	go func() {
+		res, _, err := s.exchanger.Exchange(m, nameserver)
+		c <- result{res, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("query deadline: %w", ctx.Err())
+	case r := <-c:
+		return r.res, r.err
+	}
 }
 
 func generateRequestID() (string, error) {
@@ -178,29 +1353,120 @@ func generateRequestID() (string, error) {
 	return hex.EncodeToString(buf[:]), nil
 }
 
+// sameQuestion reports whether res answers exactly the question of query. The
+// name is compared case-insensitively, as upstreams need not preserve case.
+// Along with the ID check and the random source port `dns.Client` dials from,
+// this makes blind spoofing of upstream responses impractical.
+func sameQuestion(query, res *dns.Msg) bool {
+	if len(query.Question) != 1 || len(res.Question) != 1 {
+		return false
+	}
+	q, a := query.Question[0], res.Question[0]
+	return strings.EqualFold(q.Name, a.Name) && q.Qtype == a.Qtype && q.Qclass == a.Qclass
+}
+
+// isValidQtype reports whether questions of qtype are answered. Questions of
+// other types are answered with the unsupported type rcode.
 func isValidQtype(qtype uint16) bool {
 	switch qtype {
-	case dns.TypeA, dns.TypeAAAA:
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCAA, dns.TypeTLSA, dns.TypeDS, dns.TypeDNSKEY, dns.TypeTXT:
 		return true
 	}
 	return false
 }
 
-func writeAnswer(w dns.ResponseWriter, r *dns.Msg, ans ...dns.RR) error {
-	res := &dns.Msg{
-		Answer: ans,
+func (s *DNSQueryHandler) writeErr(w dns.ResponseWriter, r *dns.Msg, code int, ede *extendedError) error {
+	res := errResponse(r, code, ede)
+	return s.writeMsg(w, r, res.msg, res.ede)
+}
+
+func (s *DNSQueryHandler) writeMsg(w dns.ResponseWriter, r *dns.Msg, res *dns.Msg, ede *extendedError) error {
+	if len(r.Question) > 0 {
+		for _, f := range s.filters {
+			if filtered := f.Filter(r.Question[0], res); filtered != nil {
+				res = filtered
+			}
+		}
+	}
+	res.Compress = s.compress
+	res.RecursionAvailable = s.recursion
+	// mydns does not validate DNSSEC, so it must never claim authenticated data
+	res.AuthenticatedData = false
+	if dnssecOK(r) {
+		// echo the DO bit, as RFC 3225 requires
+		if opt := res.IsEdns0(); opt != nil {
+			opt.SetDo()
+		} else {
+			res.SetEdns0(dns.DefaultMsgSize, true)
+		}
+	}
+	if s.ede && ede != nil && r.IsEdns0() != nil {
+		addOption(res, ede.option())
+	}
+	if s.tcpKeepalive > 0 && wantsTCPKeepalive(w, r) {
+		addOption(res, tcpKeepaliveOption(s.tcpKeepalive))
+	}
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		// responses that do not fit into the client's UDP buffer are truncated
+		// and marked with TC, so it retries over TCP
+		if size := udpSize(r); res.Len() > size {
+			res.Truncate(size)
+		}
 	}
-	res.SetReply(r)
+	if s.padding > 0 && wantsPadding(w, r) {
+		pad(res, s.padding, paddingLimit(w, r))
+	}
+	metrics.ObserveResponseBytes(transport(w), res.Truncated, res.Len())
 	return w.WriteMsg(res)
 }
 
-func writeErr(w dns.ResponseWriter, r *dns.Msg, code int) error {
-	res := &dns.Msg{}
-	res.SetRcode(r, dns.RcodeNameError)
-	return w.WriteMsg(res)
+// transport returns the transport a client is connected over: `udp`, `tcp`,
+// or `tls`.
+func transport(w dns.ResponseWriter) string {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		return "udp"
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return "tls"
+	}
+	return "tcp"
+}
+
+// udpSize returns the UDP payload size r advertises, or the default of 512
+// bytes without EDNS.
+func udpSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// removeOption removes the options with code from the OPT record of m, if any.
+func removeOption(m *dns.Msg, code uint16) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+}
+
+// addOption adds o to the OPT record of m, adding one if there is none.
+func addOption(m *dns.Msg, o dns.EDNS0) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, o)
 }
 
-func generateBlockedAnswer(fqdn string, qclass uint16, qtype uint16) dns.RR {
+func generateBlockedAnswer(fqdn string, qclass uint16, qtype uint16, ip4, ip6 net.IP) dns.RR {
 	hdr := dns.RR_Header{
 		Name:   fqdn,
 		Rrtype: qtype,
@@ -211,20 +1477,146 @@ func generateBlockedAnswer(fqdn string, qclass uint16, qtype uint16) dns.RR {
 	case dns.TypeA:
 		return &dns.A{
 			Hdr: hdr,
-			A:   net.IPv4zero,
+			A:   ip4,
 		}
 	case dns.TypeAAAA:
 		return &dns.AAAA{
 			Hdr:  hdr,
-			AAAA: net.IPv6zero,
+			AAAA: ip6,
 		}
 	}
 
 	// TODO should this be server error?
 	return &dns.A{
 		Hdr: hdr,
-		A:   net.IPv4zero,
+		A:   ip4,
+	}
+}
+
+// generateStaticAnswers returns the records of type qtype for the given static
+// IPs. It is empty (NODATA) if there are no IPs of the requested family.
+func generateStaticAnswers(fqdn string, qtype uint16, qclass uint16, ips []net.IP) []dns.RR {
+	hdr := dns.RR_Header{
+		Name:   fqdn,
+		Rrtype: qtype,
+		Class:  qclass,
+	}
+
+	var answers []dns.RR
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case qtype == dns.TypeA && ip4 != nil:
+			answers = append(answers, &dns.A{Hdr: hdr, A: ip4})
+		case qtype == dns.TypeAAAA && ip4 == nil:
+			answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return answers
+}
+
+func generateStaticPTRAnswers(fqdn string, qclass uint16, names []string) []dns.RR {
+	hdr := dns.RR_Header{
+		Name:   fqdn,
+		Rrtype: dns.TypePTR,
+		Class:  qclass,
+	}
+
+	answers := make([]dns.RR, 0, len(names))
+	for _, name := range names {
+		answers = append(answers, &dns.PTR{Hdr: hdr, Ptr: name})
+	}
+	return answers
+}
+
+// generateStaticCAAAnswers returns copies of records, named fqdn to preserve
+// the case of the question.
+func generateStaticCAAAnswers(fqdn string, qclass uint16, records []*dns.CAA) []dns.RR {
+	answers := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		ans := dns.Copy(rr).(*dns.CAA)
+		ans.Hdr.Name = fqdn
+		ans.Hdr.Class = qclass
+		answers = append(answers, ans)
+	}
+	return answers
+}
+
+// generateStaticTXTAnswers returns copies of records, named fqdn to preserve
+// the case of the question.
+func generateStaticTXTAnswers(fqdn string, qclass uint16, records []*dns.TXT) []dns.RR {
+	answers := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		ans := dns.Copy(rr).(*dns.TXT)
+		ans.Hdr.Name = fqdn
+		ans.Hdr.Class = qclass
+		answers = append(answers, ans)
+	}
+	return answers
+}
+
+// hinfo holds the strings of an HINFO record.
+type hinfo struct {
+	cpu string
+	os  string
+}
+
+func generateBlockedHINFOAnswer(fqdn string, qclass uint16, info *hinfo) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeHINFO,
+			Class:  qclass,
+		},
+		Cpu: info.cpu,
+		Os:  info.os,
+	}
+}
+
+func generateBlockedCNAMEAnswer(fqdn string, qclass uint16, target string) dns.RR {
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeCNAME,
+			Class:  qclass,
+		},
+		Target: target,
+	}
+}
+
+// generateMinimalANYAnswer returns the HINFO record that RFC 8482 recommends as
+// a response to ANY queries.
+func generateMinimalANYAnswer(fqdn string, qclass uint16) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeHINFO,
+			Class:  qclass,
+			Ttl:    3600,
+		},
+		Cpu: "RFC8482",
+	}
+}
+
+// generateWhoamiAnswers returns the records of type qtype holding ip. It is
+// empty (NODATA) for an A query from an IPv6 client, and vice versa.
+func generateWhoamiAnswers(fqdn string, qtype uint16, qclass uint16, ip net.IP) []dns.RR {
+	hdr := dns.RR_Header{
+		Name:   fqdn,
+		Rrtype: qtype,
+		Class:  qclass,
+	}
+
+	ip4 := ip.To4()
+	switch {
+	case qtype == dns.TypeA && ip4 != nil:
+		return []dns.RR{&dns.A{Hdr: hdr, A: ip4}}
+	case qtype == dns.TypeAAAA && ip4 == nil:
+		return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+	case qtype == dns.TypeTXT:
+		return []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{ip.String()}}}
 	}
+	return nil
 }
 
 func addrToIP(addr net.Addr) (net.IP, error) {
@@ -246,6 +1638,14 @@ func qclassToString(qclass uint16) string {
 	return qclassStr
 }
 
+func opcodeToString(opcode int) string {
+	opcodeStr, ok := dns.OpcodeToString[opcode]
+	if !ok {
+		return fmt.Sprintf("unknown<%d>", opcode)
+	}
+	return opcodeStr
+}
+
 func qtypeToString(qtype uint16) string {
 	qtypeStr, ok := dns.TypeToString[qtype]
 	if !ok {
@@ -0,0 +1,2598 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/dnsqueryhandler"
+	"github.com/execjosh/mydns/internal/ednscookie"
+	"github.com/execjosh/mydns/internal/metrics"
+	"github.com/execjosh/mydns/internal/policy"
+	"github.com/execjosh/mydns/internal/txtrecords"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type fixedChooser string
+
+func (c fixedChooser) Next() string { return string(c) }
+
+type emptySet struct{}
+
+func (emptySet) Contains(string) bool { return false }
+
+type fullSet struct{}
+
+func (fullSet) Contains(string) bool { return true }
+
+type failingExchanger struct{}
+
+func (failingExchanger) Exchange(*dns.Msg, string) (*dns.Msg, time.Duration, error) {
+	return nil, 0, errors.New("exchange failed")
+}
+
+func TestMinimalANY(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		failingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithMinimalANY(),
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeANY)
+
+	w := &fakeResponseWriter{}
+	h.HandleAandAAAA(w, req)
+
+	res := w.response(t)
+	assertRcode(t, res, dns.RcodeSuccess)
+	if len(res.Answer) != 1 {
+		t.Fatalf("expected exactly one answer; got %v", res.Answer)
+	}
+	hinfo, ok := res.Answer[0].(*dns.HINFO)
+	if !ok {
+		t.Fatalf("expected HINFO; got %T", res.Answer[0])
+	}
+	if hinfo.Hdr.Name != "example.com." || hinfo.Cpu != "RFC8482" || hinfo.Os != "" {
+		t.Errorf("unexpected HINFO: %v", hinfo)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		h := dnsqueryhandler.New(
+			zap.NewNop(),
+			failingExchanger{},
+			fixedChooser("192.0.2.1:53"),
+			emptySet{},
+			dnsqueryhandler.WithCompression(compress),
+		)
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeMX} {
+			req := &dns.Msg{}
+			req.SetQuestion("example.com.", qtype)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			if w.response(t).Compress != compress {
+				t.Errorf("qtype %s: expected Compress to be %v", dns.TypeToString[qtype], compress)
+			}
+		}
+	}
+}
+
+func TestRecursionAvailable(t *testing.T) {
+	tests := []struct {
+		name    string
+		blocked interface{ Contains(string) bool }
+		enabled bool
+	}{
+		{"forwarded", emptySet{}, true},
+		{"blocked", fullSet{}, true},
+		{"forwarded disabled", emptySet{}, false},
+		{"blocked disabled", fullSet{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				answeringExchanger{"192.0.2.10"},
+				fixedChooser("192.0.2.1:53"),
+				tt.blocked,
+				dnsqueryhandler.WithRecursionAvailable(tt.enabled),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			if res.RecursionAvailable != tt.enabled {
+				t.Errorf("expected RA to be %v", tt.enabled)
+			}
+		})
+	}
+}
+
+func extendedErrorCode(t *testing.T, m *dns.Msg) (uint16, bool) {
+	t.Helper()
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, o := range opt.Option {
+		if o.Option() != 15 {
+			continue
+		}
+		l, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || len(l.Data) < 2 {
+			t.Fatalf("malformed EDE option: %v", o)
+		}
+		return uint16(l.Data[0])<<8 | uint16(l.Data[1]), true
+	}
+	return 0, false
+}
+
+func TestExtendedErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		set      interface{ Contains(string) bool }
+		qtype    uint16
+		edns     bool
+		wantCode uint16
+		wantEDE  bool
+	}{
+		{"blocked", fullSet{}, dns.TypeA, true, 15, true},
+		{"unsupported type", emptySet{}, dns.TypeMX, true, 21, true},
+		{"network error", emptySet{}, dns.TypeA, true, 23, true},
+		{"client without EDNS", fullSet{}, dns.TypeA, false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				failingExchanger{},
+				fixedChooser("192.0.2.1:53"),
+				tt.set,
+				dnsqueryhandler.WithExtendedErrors(),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("example.com.", tt.qtype)
+			if tt.edns {
+				req.SetEdns0(dns.DefaultMsgSize, false)
+			}
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			code, ok := extendedErrorCode(t, res)
+			if ok != tt.wantEDE {
+				t.Fatalf("expected EDE present to be %v", tt.wantEDE)
+			}
+			if code != tt.wantCode {
+				t.Errorf("expected EDE info code %d; got %d", tt.wantCode, code)
+			}
+
+			packed, err := res.Pack()
+			if err != nil {
+				t.Fatalf("packing response: %v", err)
+			}
+			if err := new(dns.Msg).Unpack(packed); err != nil {
+				t.Errorf("unpacking response: %v", err)
+			}
+		})
+	}
+}
+
+type slowExchanger time.Duration
+
+func (e slowExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	time.Sleep(time.Duration(e))
+	res := &dns.Msg{}
+	res.SetReply(m)
+	return res, time.Duration(e), nil
+}
+
+func TestQueryDeadline(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		slowExchanger(time.Second),
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithQueryDeadline(20*time.Millisecond),
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &fakeResponseWriter{}
+	start := time.Now()
+	h.HandleAandAAAA(w, req)
+	elapsed := time.Since(start)
+
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("expected handler to give up after the deadline; took %v", elapsed)
+	}
+	assertRcode(t, w.response(t), dns.RcodeServerFailure)
+}
+
+type staticRecords map[string][]net.IP
+
+func (r staticRecords) Lookup(fqdn string, _ uint16) ([]net.IP, bool) {
+	ips, ok := r[fqdn]
+	return ips, ok
+}
+
+func (r staticRecords) LookupPTR(fqdn string) ([]string, bool) {
+	var names []string
+	for name, ips := range r {
+		for _, ip := range ips {
+			if arpa, _ := dns.ReverseAddr(ip.String()); arpa == fqdn {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, len(names) > 0
+}
+
+func TestStaticRecords(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		failingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		fullSet{},
+		dnsqueryhandler.WithStaticRecords(staticRecords{
+			"app.dev.local.": {net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+			"v4.dev.local.":  {net.ParseIP("192.0.2.10")},
+		}),
+	)
+
+	tests := []struct {
+		fqdn  string
+		qtype uint16
+		want  []string
+	}{
+		{"app.dev.local.", dns.TypeA, []string{"127.0.0.1"}},
+		{"app.dev.local.", dns.TypeAAAA, []string{"::1"}},
+		{"v4.dev.local.", dns.TypeAAAA, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fqdn+" "+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion(tt.fqdn, tt.qtype)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			assertAnswerIPs(t, res, tt.want...)
+		})
+	}
+}
+
+type caaRecords map[string][]*dns.CAA
+
+func (r caaRecords) Lookup(fqdn string) ([]*dns.CAA, bool) {
+	records, ok := r[fqdn]
+	return records, ok
+}
+
+// caaExchanger answers CAA queries with an issue record for its CA.
+type caaExchanger string
+
+func (e caaExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetReply(m)
+	res.Answer = append(res.Answer, &dns.CAA{
+		Hdr:   dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: 60},
+		Tag:   "issue",
+		Value: string(e),
+	})
+	return res, 0, nil
+}
+
+func TestCAA(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		caaExchanger("ca.example.net"),
+		fixedChooser("192.0.2.1:53"),
+		onlySet{"blocked.example.com."},
+		dnsqueryhandler.WithCAARecords(caaRecords{
+			"dev.local.": {{Hdr: dns.RR_Header{Name: "dev.local.", Rrtype: dns.TypeCAA, Class: dns.ClassINET}, Tag: "issue", Value: "ca.dev.local"}},
+		}),
+		dnsqueryhandler.WithStaticRecords(staticRecords{
+			"api.dev.local.": {net.ParseIP("192.0.2.10")},
+		}),
+	)
+
+	tests := []struct {
+		fqdn string
+		want []string
+	}{
+		{"example.com.", []string{"ca.example.net"}},
+		{"dev.local.", []string{"ca.dev.local"}},
+		{"api.dev.local.", nil},
+		{"blocked.example.com.", nil},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, dns.TypeCAA)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		var got []string
+		for _, rr := range res.Answer {
+			caa, ok := rr.(*dns.CAA)
+			if !ok || caa.Hdr.Name != tt.fqdn {
+				t.Errorf("%s: unexpected answer: %v", tt.fqdn, rr)
+				continue
+			}
+			got = append(got, caa.Value)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: expected CAA values %v; got %v", tt.fqdn, tt.want, got)
+		}
+	}
+}
+
+// tlsaExchanger answers TLSA queries with a DANE-EE record for its certificate
+// digest, claiming it is authenticated.
+type tlsaExchanger string
+
+func (e tlsaExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetReply(m)
+	res.AuthenticatedData = true
+	res.Answer = append(res.Answer, &dns.TLSA{
+		Hdr:          dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: 60},
+		Usage:        3,
+		Selector:     1,
+		MatchingType: 1,
+		Certificate:  string(e),
+	})
+	return res, 0, nil
+}
+
+func TestTLSA(t *testing.T) {
+	const cert = "d2abde240d7cd3ee6b4b28c54df034b97983a1d16e8a410e4561cb106618e971"
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		tlsaExchanger(cert),
+		fixedChooser("192.0.2.1:53"),
+		onlySet{"_25._tcp.blocked.example.com."},
+		dnsqueryhandler.WithStaticRecords(staticRecords{
+			"_25._tcp.mail.dev.local.": {net.ParseIP("192.0.2.10")},
+		}),
+	)
+
+	tests := []struct {
+		fqdn string
+		want []string
+	}{
+		{"_25._tcp.mail.example.com.", []string{cert}},
+		{"_25._tcp.mail.dev.local.", nil},
+		{"_25._tcp.blocked.example.com.", nil},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, dns.TypeTLSA)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		if res.AuthenticatedData {
+			t.Errorf("%s: expected AD to be cleared", tt.fqdn)
+		}
+		var got []string
+		for _, rr := range res.Answer {
+			tlsa, ok := rr.(*dns.TLSA)
+			if !ok || tlsa.Hdr.Name != tt.fqdn {
+				t.Errorf("%s: unexpected answer: %v", tt.fqdn, rr)
+				continue
+			}
+			got = append(got, tlsa.Certificate)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: expected TLSA certificates %v; got %v", tt.fqdn, tt.want, got)
+		}
+	}
+}
+
+// dnssecExchanger answers DS and DNSKEY queries with a record and its RRSIG,
+// and the names in nodata with a signed NSEC denial. It records the last query
+// it received.
+type dnssecExchanger struct {
+	nodata map[string]bool
+	last   *dns.Msg
+}
+
+func (e *dnssecExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	e.last = m.Copy()
+
+	q := m.Question[0]
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: 60}
+	}
+	res := &dns.Msg{}
+	res.SetReply(m)
+	if e.nodata[q.Name] {
+		res.Ns = append(res.Ns,
+			&dns.SOA{Hdr: hdr(dns.TypeSOA), Ns: "ns.example.com.", Mbox: "hostmaster.example.com.", Minttl: 60},
+			&dns.NSEC{Hdr: hdr(dns.TypeNSEC), NextDomain: "z." + q.Name, TypeBitMap: []uint16{dns.TypeA}},
+			&dns.RRSIG{Hdr: hdr(dns.TypeRRSIG), TypeCovered: dns.TypeNSEC, SignerName: "example.com."},
+		)
+		return res, 0, nil
+	}
+	switch q.Qtype {
+	case dns.TypeDS:
+		res.Answer = append(res.Answer, &dns.DS{Hdr: hdr(dns.TypeDS), KeyTag: 12345, Algorithm: dns.ECDSAP256SHA256, DigestType: dns.SHA256, Digest: "aa"})
+	case dns.TypeDNSKEY:
+		res.Answer = append(res.Answer, &dns.DNSKEY{Hdr: hdr(dns.TypeDNSKEY), Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256, PublicKey: "aa=="})
+	}
+	res.Answer = append(res.Answer, &dns.RRSIG{Hdr: hdr(dns.TypeRRSIG), TypeCovered: q.Qtype, SignerName: "example.com."})
+	return res, 0, nil
+}
+
+func TestDNSSECTypes(t *testing.T) {
+	tests := []struct {
+		name      string
+		fqdn      string
+		qtype     uint16
+		do        bool
+		wantTypes []uint16
+		wantNs    []uint16
+	}{
+		{"DS", "sub.example.com.", dns.TypeDS, true, []uint16{dns.TypeDS, dns.TypeRRSIG}, nil},
+		{"DNSKEY", "example.com.", dns.TypeDNSKEY, true, []uint16{dns.TypeDNSKEY, dns.TypeRRSIG}, nil},
+		{"DS without DO", "sub.example.com.", dns.TypeDS, false, []uint16{dns.TypeDS, dns.TypeRRSIG}, nil},
+		{"NODATA", "unsigned.example.com.", dns.TypeDS, true, nil, []uint16{dns.TypeSOA, dns.TypeNSEC, dns.TypeRRSIG}},
+		{"NODATA without DO", "unsigned.example.com.", dns.TypeDS, false, nil, []uint16{dns.TypeSOA}},
+		{"blocked", "blocked.example.com.", dns.TypeDNSKEY, true, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &dnssecExchanger{nodata: map[string]bool{"unsigned.example.com.": true}}
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				e,
+				fixedChooser("192.0.2.1:53"),
+				onlySet{"blocked.example.com."},
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion(tt.fqdn, tt.qtype)
+			req.CheckingDisabled = true
+			if tt.do {
+				req.SetEdns0(dns.DefaultMsgSize, true)
+			}
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			if got := rrTypes(res.Answer); !equalTypes(got, tt.wantTypes) {
+				t.Errorf("expected answer types %v; got %v", tt.wantTypes, got)
+			}
+			if got := rrTypes(res.Ns); !equalTypes(got, tt.wantNs) {
+				t.Errorf("expected authority types %v; got %v", tt.wantNs, got)
+			}
+			if opt := res.IsEdns0(); tt.do != (opt != nil && opt.Do()) {
+				t.Errorf("expected DO to be echoed as %v", tt.do)
+			}
+
+			if e.last == nil {
+				return
+			}
+			if opt := e.last.IsEdns0(); tt.do != (opt != nil && opt.Do()) {
+				t.Errorf("expected DO to be forwarded as %v", tt.do)
+			}
+			if !e.last.CheckingDisabled {
+				t.Error("expected CD to be forwarded")
+			}
+		})
+	}
+}
+
+func rrTypes(rrs []dns.RR) []uint16 {
+	var types []uint16
+	for _, rr := range rrs {
+		types = append(types, rr.Header().Rrtype)
+	}
+	return types
+}
+
+func equalTypes(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cnameExchanger answers A queries with a CNAME record pointing to its target,
+// followed by an A record of the target.
+type cnameExchanger string
+
+func (e cnameExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetReply(m)
+	res.Answer = append(res.Answer,
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: string(e),
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: string(e), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.10"),
+		},
+	)
+	return res, 0, nil
+}
+
+func TestCNAMEInspection(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		opts    []dnsqueryhandler.Option
+		blocked bool
+	}{
+		{"clean target", "shop.cdn.example.", nil, false},
+		{"blocked target", "shop.tracker.example.", nil, true},
+		{"disabled", "shop.tracker.example.", []dnsqueryhandler.Option{dnsqueryhandler.WithCNAMEInspection(false)}, false},
+		{"target allowed by policy", "shop.tracker.example.", []dnsqueryhandler.Option{dnsqueryhandler.WithPolicy(rulesOf{"shop.tracker.example.": policy.Allow})}, false},
+		{"target not in sinkhole allowlist", "shop.cdn.example.", []dnsqueryhandler.Option{dnsqueryhandler.WithSinkhole(allowlistOf{"metrics.shop.example."})}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				cnameExchanger(tt.target),
+				fixedChooser("192.0.2.1:53"),
+				onlySet{"shop.tracker.example."},
+				tt.opts...,
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("metrics.shop.example.", dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			if tt.blocked {
+				assertAnswerIPs(t, res, "0.0.0.0")
+				return
+			}
+			if len(res.Answer) != 2 {
+				t.Fatalf("expected the CNAME and A records; got %v", res.Answer)
+			}
+			if cname, ok := res.Answer[0].(*dns.CNAME); !ok || cname.Target != tt.target {
+				t.Errorf("expected a CNAME record pointing to %s; got %v", tt.target, res.Answer[0])
+			}
+		})
+	}
+}
+
+func TestLocalTLD(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.50"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithStaticRecords(staticRecords{
+			"www.test.": {net.ParseIP("192.0.2.99")},
+		}),
+		dnsqueryhandler.WithLocalTLD("test", net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")),
+		dnsqueryhandler.WithLocalTLD("lab.", net.ParseIP("192.0.2.20")),
+		dnsqueryhandler.WithLocalTLD("eu.lab.", net.ParseIP("192.0.2.21")),
+	)
+
+	tests := []struct {
+		fqdn          string
+		qtype         uint16
+		want          []string
+		authoritative bool
+	}{
+		{"app.test.", dns.TypeA, []string{"192.0.2.10"}, true},
+		{"App.Test.", dns.TypeAAAA, []string{"2001:db8::10"}, true},
+		{"test.", dns.TypeA, []string{"192.0.2.10"}, true},
+		{"db.us.lab.", dns.TypeA, []string{"192.0.2.20"}, true},
+		{"db.eu.lab.", dns.TypeA, []string{"192.0.2.21"}, true},
+		{"db.eu.lab.", dns.TypeAAAA, nil, true},
+		{"www.test.", dns.TypeA, []string{"192.0.2.99"}, false},
+		{"contest.", dns.TypeA, []string{"192.0.2.50"}, false},
+		{"www.example.com.", dns.TypeA, []string{"192.0.2.50"}, false},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, tt.qtype)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		assertAnswerIPs(t, res, tt.want...)
+		if res.Authoritative != tt.authoritative {
+			t.Errorf("%s %s: expected AA to be %v", tt.fqdn, dns.TypeToString[tt.qtype], tt.authoritative)
+		}
+	}
+}
+
+// txtExchanger answers TXT queries with a record holding its string.
+type txtExchanger string
+
+func (e txtExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetReply(m)
+	res.Answer = append(res.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{string(e)},
+	})
+	return res, 0, nil
+}
+
+func TestTXT(t *testing.T) {
+	key := strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8A", 12)
+	records, _, err := txtrecords.Load(strings.NewReader(strings.Join([]string{
+		`mail.dev.local            "v=spf1 ip4:192.0.2.25 -all"`,
+		`sel._domainkey.dev.local  "v=DKIM1; k=rsa; p=` + key + `"`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		txtExchanger("v=spf1 include:_spf.example.net ~all"),
+		fixedChooser("192.0.2.1:53"),
+		onlySet{"blocked.example.com."},
+		dnsqueryhandler.WithTXTRecords(records),
+		dnsqueryhandler.WithStaticRecords(staticRecords{
+			"api.dev.local.": {net.ParseIP("192.0.2.10")},
+		}),
+	)
+
+	tests := []struct {
+		fqdn          string
+		want          []string
+		authoritative bool
+	}{
+		{"example.com.", []string{"v=spf1 include:_spf.example.net ~all"}, false},
+		{"Mail.dev.local.", []string{"v=spf1 ip4:192.0.2.25 -all"}, true},
+		{"sel._domainkey.dev.local.", []string{"v=DKIM1; k=rsa; p=" + key}, true},
+		{"api.dev.local.", nil, false},
+		{"blocked.example.com.", nil, false},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, dns.TypeTXT)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		// check the records as clients see them on the wire
+		packed, err := w.response(t).Pack()
+		if err != nil {
+			t.Fatalf("%s: packing response: %v", tt.fqdn, err)
+		}
+		res := &dns.Msg{}
+		if err := res.Unpack(packed); err != nil {
+			t.Fatalf("%s: unpacking response: %v", tt.fqdn, err)
+		}
+		assertRcode(t, res, dns.RcodeSuccess)
+		if res.Authoritative != tt.authoritative {
+			t.Errorf("%s: expected AA to be %v", tt.fqdn, tt.authoritative)
+		}
+		var got []string
+		for _, rr := range res.Answer {
+			txt, ok := rr.(*dns.TXT)
+			if !ok || txt.Hdr.Name != tt.fqdn {
+				t.Errorf("%s: unexpected answer: %v", tt.fqdn, rr)
+				continue
+			}
+			for _, segment := range txt.Txt {
+				if len(segment) > 255 {
+					t.Errorf("%s: TXT string of %d bytes", tt.fqdn, len(segment))
+				}
+			}
+			got = append(got, strings.Join(txt.Txt, ""))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: expected TXT records %q; got %q", tt.fqdn, tt.want, got)
+		}
+	}
+}
+
+// optionExchanger answers with the NSID and Padding options, and records the
+// last query it received.
+type optionExchanger struct {
+	last *dns.Msg
+}
+
+func (e *optionExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.last = m.Copy()
+	res, rtt, err := answeringExchanger{"192.0.2.10"}.Exchange(m, address)
+	res.SetEdns0(dns.DefaultMsgSize, false)
+	opt := res.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73312e6578616d706c65"},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+	)
+	return res, rtt, err
+}
+
+func optionCodes(m *dns.Msg) []uint16 {
+	var codes []uint16
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			codes = append(codes, o.Option())
+		}
+	}
+	return codes
+}
+
+// cookieReply scripts a response of cookieExchanger. The client cookie sent is
+// echoed unless client is set; omit leaves the COOKIE option out.
+type cookieReply struct {
+	rcode  int
+	client string
+	server string
+	omit   bool
+}
+
+// cookieExchanger answers with its replies in turn, recording the cookies it
+// was sent.
+type cookieExchanger struct {
+	replies []cookieReply
+	sent    []string
+}
+
+func (e *cookieExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	var sent string
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				sent = c.Cookie
+			}
+		}
+	}
+	reply := e.replies[len(e.sent)]
+	e.sent = append(e.sent, sent)
+
+	res, rtt, err := answeringExchanger{"192.0.2.10"}.Exchange(m, address)
+	res.Rcode = reply.rcode
+	if reply.omit {
+		return res, rtt, err
+	}
+	client := reply.client
+	if len(client) < 1 && len(sent) >= 16 {
+		client = sent[:16]
+	}
+	res.SetEdns0(dns.DefaultMsgSize, false)
+	opt := res.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + reply.server})
+	return res, rtt, err
+}
+
+func TestCookies(t *testing.T) {
+	const server = "0102030405060708"
+	tests := []struct {
+		name      string
+		replies   []cookieReply
+		wantRcode []int
+	}{
+		{"accepted", []cookieReply{{rcode: dns.RcodeSuccess, server: server}}, []int{dns.RcodeSuccess}},
+		{"BADCOOKIE retry", []cookieReply{{rcode: dns.RcodeBadCookie, server: server}, {rcode: dns.RcodeSuccess, server: server}}, []int{dns.RcodeSuccess}},
+		{"client cookie mismatch", []cookieReply{{rcode: dns.RcodeSuccess, client: "ffffffffffffffff", server: server}}, []int{dns.RcodeServerFailure}},
+		{"missing cookie", []cookieReply{{rcode: dns.RcodeSuccess, server: server}, {rcode: dns.RcodeSuccess, omit: true}}, []int{dns.RcodeSuccess, dns.RcodeServerFailure}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &cookieExchanger{replies: tt.replies}
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				e,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+				dnsqueryhandler.WithCookies(ednscookie.New()),
+			)
+
+			for _, rcode := range tt.wantRcode {
+				req := &dns.Msg{}
+				req.SetQuestion("www.example.com.", dns.TypeA)
+				w := &fakeResponseWriter{}
+				h.HandleAandAAAA(w, req)
+				assertRcode(t, w.response(t), rcode)
+			}
+
+			if len(e.sent) != len(tt.replies) {
+				t.Fatalf("expected %d upstream queries; got %d", len(tt.replies), len(e.sent))
+			}
+			// every query after the first carries the server cookie learned
+			for i, sent := range e.sent[1:] {
+				if want := e.sent[0] + server; sent != want {
+					t.Errorf("query %d: expected cookie %q; got %q", i+2, want, sent)
+				}
+			}
+		})
+	}
+}
+
+func TestEDNSPassthrough(t *testing.T) {
+	tests := []struct {
+		name         string
+		codes        []uint16
+		wantUpstream []uint16
+		wantClient   []uint16
+	}{
+		{"none", nil, nil, nil},
+		{"NSID and Client Subnet", []uint16{dns.EDNS0NSID, dns.EDNS0SUBNET}, []uint16{dns.EDNS0NSID, dns.EDNS0SUBNET}, []uint16{dns.EDNS0NSID}},
+		{"Padding", []uint16{dns.EDNS0PADDING}, nil, []uint16{dns.EDNS0PADDING}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &optionExchanger{}
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				e,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+				dnsqueryhandler.WithEDNSPassthrough(tt.codes...),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option,
+				&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+				&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4()},
+				&dns.EDNS0_LOCAL{Code: 65001, Data: []byte("private")},
+			)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			if got := optionCodes(e.last); !equalTypes(got, tt.wantUpstream) {
+				t.Errorf("expected upstream options %v; got %v", tt.wantUpstream, got)
+			}
+			if got := optionCodes(res); !equalTypes(got, tt.wantClient) {
+				t.Errorf("expected client options %v; got %v", tt.wantClient, got)
+			}
+		})
+	}
+}
+
+func TestStaticPTR(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		failingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithStaticRecords(staticRecords{
+			"v4.dev.local.": {net.ParseIP("192.0.2.10")},
+			"v6.dev.local.": {net.ParseIP("2001:db8::1")},
+		}),
+	)
+
+	tests := []struct {
+		fqdn      string
+		wantRcode int
+		want      string
+	}{
+		{"10.2.0.192.in-addr.arpa.", dns.RcodeSuccess, "v4.dev.local."},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.RcodeSuccess, "v6.dev.local."},
+		{"11.2.0.192.in-addr.arpa.", dns.RcodeRefused, ""},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, dns.TypePTR)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, tt.wantRcode)
+		if len(tt.want) < 1 {
+			continue
+		}
+		if len(res.Answer) != 1 {
+			t.Errorf("%s: expected one answer; got %v", tt.fqdn, res.Answer)
+			continue
+		}
+		if ptr, ok := res.Answer[0].(*dns.PTR); !ok || ptr.Ptr != tt.want || ptr.Hdr.Name != tt.fqdn {
+			t.Errorf("%s: expected PTR %s; got %v", tt.fqdn, tt.want, res.Answer[0])
+		}
+	}
+}
+
+func TestBlockedAnswer(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		failingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		fullSet{},
+	)
+
+	tests := []struct {
+		qtype uint16
+		want  string
+	}{
+		{dns.TypeA, "0.0.0.0"},
+		{dns.TypeAAAA, "::"},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion("ads.example.com.", tt.qtype)
+
+		w := &fakeResponseWriter{remote: &net.TCPAddr{IP: net.IPv6loopback, Port: 5353}}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		assertAnswerIPs(t, res, tt.want)
+		if hdr := res.Answer[0].Header(); hdr.Rrtype != tt.qtype || hdr.Class != dns.ClassINET {
+			t.Errorf("%s: unexpected answer header: %v", dns.TypeToString[tt.qtype], hdr)
+		}
+	}
+}
+
+// answeringExchanger answers A queries with its IPs.
+type answeringExchanger []string
+
+func (e answeringExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetReply(m)
+	for _, ip := range e {
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+	}
+	return res, 0, nil
+}
+
+type filterFunc func(q dns.Question, res *dns.Msg) *dns.Msg
+
+func (f filterFunc) Filter(q dns.Question, res *dns.Msg) *dns.Msg { return f(q, res) }
+
+func TestResponseFilters(t *testing.T) {
+	var seen []string
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.1", "192.0.2.2"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithResponseFilters(
+			filterFunc(func(q dns.Question, res *dns.Msg) *dns.Msg {
+				seen = append(seen, q.Name)
+				res.Answer = res.Answer[:1]
+				return nil
+			}),
+			filterFunc(func(q dns.Question, res *dns.Msg) *dns.Msg {
+				replaced := res.Copy()
+				replaced.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.53")
+				return replaced
+			}),
+		),
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	w := &fakeResponseWriter{}
+	h.HandleAandAAAA(w, req)
+
+	assertAnswerIPs(t, w.response(t), "192.0.2.53")
+	if len(seen) != 1 || seen[0] != "www.example.com." {
+		t.Errorf("expected the first filter to see www.example.com.; got %v", seen)
+	}
+}
+
+// dualStackExchanger answers from its A and AAAA records by name, and with
+// NXDOMAIN for unknown names. Negative answers carry a SOA with a minimum TTL
+// of 30.
+type dualStackExchanger map[string][]string
+
+func (e dualStackExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	q := m.Question[0]
+	res := &dns.Msg{}
+	res.SetReply(m)
+
+	ips, ok := e[q.Name]
+	if !ok {
+		res.Rcode = dns.RcodeNameError
+	}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		v6 := strings.Contains(s, ":")
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch {
+		case q.Qtype == dns.TypeA && !v6:
+			res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: ip})
+		case q.Qtype == dns.TypeAAAA && v6:
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(res.Answer) < 1 {
+		res.Ns = append(res.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns.example.com.",
+			Mbox:   "hostmaster.example.com.",
+			Minttl: 30,
+		})
+	}
+	return res, 0, nil
+}
+
+type prefix64 struct{}
+
+func (prefix64) Synthesize(v4 net.IP) net.IP {
+	ip := net.ParseIP("64:ff9b::")
+	copy(ip[12:], v4.To4())
+	return ip
+}
+
+func TestDNS64(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		dualStackExchanger{
+			"v4.example.com.":     {"192.0.2.1", "192.0.2.2"},
+			"dual.example.com.":   {"192.0.2.1", "2001:db8::1"},
+			"mapped.example.com.": {"192.0.2.3", "::ffff:192.0.2.3"},
+			"v6.example.com.":     {"2001:db8::1"},
+		},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithDNS64(prefix64{}),
+	)
+
+	tests := []struct {
+		fqdn      string
+		wantRcode int
+		want      []string
+		wantTTL   uint32
+	}{
+		// capped by the SOA minimum of the AAAA response
+		{"v4.example.com.", dns.RcodeSuccess, []string{"64:ff9b::c000:201", "64:ff9b::c000:202"}, 30},
+		{"dual.example.com.", dns.RcodeSuccess, []string{"2001:db8::1"}, 300},
+		{"mapped.example.com.", dns.RcodeSuccess, []string{"64:ff9b::c000:203"}, 300},
+		{"v6.example.com.", dns.RcodeSuccess, []string{"2001:db8::1"}, 300},
+		{"nx.example.com.", dns.RcodeNameError, nil, 0},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, dns.TypeAAAA)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, tt.wantRcode)
+		assertAnswerIPs(t, res, tt.want...)
+		for _, rr := range res.Answer {
+			if ttl := rr.Header().Ttl; ttl != tt.wantTTL {
+				t.Errorf("%s: expected TTL %d; got %d", tt.fqdn, tt.wantTTL, ttl)
+			}
+		}
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("v4.example.com.", dns.TypeA)
+	w := &fakeResponseWriter{}
+	h.HandleAandAAAA(w, req)
+	assertAnswerIPs(t, w.response(t), "192.0.2.1", "192.0.2.2")
+}
+
+func TestDuplicateAnswers(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.10", "192.0.2.11", "192.0.2.10"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	w := &fakeResponseWriter{}
+	h.HandleAandAAAA(w, req)
+
+	res := w.response(t)
+	assertRcode(t, res, dns.RcodeSuccess)
+	assertAnswerIPs(t, res, "192.0.2.10", "192.0.2.11")
+}
+
+// negativeExchanger answers without records, with its rcode and an SOA record
+// in the authority section.
+type negativeExchanger int
+
+func (e negativeExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetRcode(m, int(e))
+	soa, err := dns.NewRR("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 900 1209600 300")
+	if err != nil {
+		return nil, 0, err
+	}
+	res.Ns = append(res.Ns, soa)
+	return res, 0, nil
+}
+
+func TestNXDOMAINRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchanger negativeExchanger
+		qtype     uint16
+		wantRcode int
+		wantIPs   []string
+	}{
+		{"A", negativeExchanger(dns.RcodeNameError), dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.80"}},
+		{"AAAA without IPv6", negativeExchanger(dns.RcodeNameError), dns.TypeAAAA, dns.RcodeNameError, nil},
+		{"NODATA", negativeExchanger(dns.RcodeSuccess), dns.TypeA, dns.RcodeSuccess, nil},
+		{"SERVFAIL", negativeExchanger(dns.RcodeServerFailure), dns.TypeA, dns.RcodeServerFailure, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.exchanger,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+				dnsqueryhandler.WithNXDOMAINRedirect(net.ParseIP("192.0.2.80").To4(), nil),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("typo.example.com.", tt.qtype)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, tt.wantRcode)
+			assertAnswerIPs(t, res, tt.wantIPs...)
+		})
+	}
+}
+
+func TestEmptyAnswers(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream negativeExchanger
+		want     int
+	}{
+		{"NODATA", negativeExchanger(dns.RcodeSuccess), dns.RcodeSuccess},
+		{"NXDOMAIN", negativeExchanger(dns.RcodeNameError), dns.RcodeNameError},
+		{"SERVFAIL", negativeExchanger(dns.RcodeServerFailure), dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.upstream,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeAAAA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, tt.want)
+			assertAnswerIPs(t, res)
+			if len(res.Ns) != 1 || res.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("expected the SOA record in the authority section; got %v", res.Ns)
+			}
+		})
+	}
+}
+
+// authenticatingExchanger answers with the AD bit set.
+type authenticatingExchanger struct{}
+
+func (authenticatingExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	res, rtt, err := answeringExchanger{"192.0.2.10"}.Exchange(m, address)
+	res.AuthenticatedData = true
+	return res, rtt, err
+}
+
+func TestAuthenticatedDataCleared(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		authenticatingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.AuthenticatedData = true
+
+	w := &fakeResponseWriter{}
+	h.HandleAandAAAA(w, req)
+
+	res := w.response(t)
+	assertRcode(t, res, dns.RcodeSuccess)
+	if res.AuthenticatedData {
+		t.Error("expected AD bit to be clear")
+	}
+}
+
+func manyAnswers(n int) answeringExchanger {
+	var e answeringExchanger
+	for i := 0; i < n; i++ {
+		e = append(e, fmt.Sprintf("192.0.2.%d", i+1))
+	}
+	return e
+}
+
+func TestMaxAnswers(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		manyAnswers(40),
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithMaxAnswers(3),
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	w := &fakeResponseWriter{}
+	h.HandleAandAAAA(w, req)
+
+	res := w.response(t)
+	assertRcode(t, res, dns.RcodeSuccess)
+	assertAnswerIPs(t, res, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	if res.Truncated {
+		t.Error("expected TC to be clear")
+	}
+}
+
+func TestUDPTruncation(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		manyAnswers(40),
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+	)
+
+	tests := []struct {
+		name    string
+		remote  net.Addr
+		want    bool
+		wantKey string
+	}{
+		{"UDP", nil, true, "udp_truncated"},
+		{"TCP", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 5353}, false, "tcp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+
+			sizes := metrics.ResponseBytes.Get(tt.wantKey).(*metrics.Histogram)
+			before := sizes.Count(-1)
+			w := &fakeResponseWriter{remote: tt.remote}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			if res.Truncated != tt.want {
+				t.Errorf("expected TC %v; got %v", tt.want, res.Truncated)
+			}
+			if tt.want && res.Len() > dns.MinMsgSize {
+				t.Errorf("expected at most %d bytes; got %d", dns.MinMsgSize, res.Len())
+			}
+			if got := sizes.Count(-1) - before; got != 1 {
+				t.Errorf("expected 1 response size in %s; got %d", tt.wantKey, got)
+			}
+		})
+	}
+}
+
+type ipSet []string
+
+func (s ipSet) Contains(ip net.IP) bool {
+	for _, x := range s {
+		if ip.Equal(net.ParseIP(x)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBlockedIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream answeringExchanger
+		want     []string
+	}{
+		{"clean", answeringExchanger{"192.0.2.10", "192.0.2.11"}, []string{"192.0.2.10", "192.0.2.11"}},
+		{"one blocked", answeringExchanger{"192.0.2.10", "198.51.100.66"}, []string{"0.0.0.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.upstream,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+				dnsqueryhandler.WithBlockedIPs(ipSet{"198.51.100.66"}),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("flux.example.com.", dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			assertAnswerIPs(t, res, tt.want...)
+		})
+	}
+}
+
+func TestBlockAnswers(t *testing.T) {
+	tests := []struct {
+		name  string
+		ip4   net.IP
+		ip6   net.IP
+		qtype uint16
+		want  string
+	}{
+		{"A", net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53"), dns.TypeA, "192.0.2.53"},
+		{"AAAA", net.ParseIP("192.0.2.53"), net.ParseIP("2001:db8::53"), dns.TypeAAAA, "2001:db8::53"},
+		{"AAAA without IPv6", net.ParseIP("192.0.2.53"), nil, dns.TypeAAAA, "::"},
+		{"A without IPv4", nil, net.ParseIP("2001:db8::53"), dns.TypeA, "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				nil,
+				fixedChooser("192.0.2.1:53"),
+				fullSet{},
+				dnsqueryhandler.WithBlockAnswers(tt.ip4, tt.ip6),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("ads.example.com.", tt.qtype)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			assertAnswerIPs(t, res, tt.want)
+		})
+	}
+}
+
+type readyFlag bool
+
+func (r *readyFlag) Ready() bool { return bool(*r) }
+
+func TestBlocklistReadiness(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		ready := readyFlag(false)
+		h := dnsqueryhandler.New(
+			zap.NewNop(),
+			answeringExchanger{"192.0.2.1"},
+			fixedChooser("192.0.2.1:53"),
+			fullSet{},
+			dnsqueryhandler.WithBlocklistReadiness(&ready, failOpen),
+		)
+
+		req := &dns.Msg{}
+		req.SetQuestion("ads.example.com.", dns.TypeA)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+		res := w.response(t)
+		if failOpen {
+			assertRcode(t, res, dns.RcodeSuccess)
+			assertAnswerIPs(t, res, "192.0.2.1")
+		} else {
+			assertRcode(t, res, dns.RcodeRefused)
+		}
+
+		ready = true
+		w = &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+		res = w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		assertAnswerIPs(t, res, "0.0.0.0")
+	}
+}
+
+type allowlistOf []string
+
+func (l allowlistOf) Allows(fqdn string) bool {
+	for _, name := range l {
+		if name == fqdn {
+			return true
+		}
+	}
+	return false
+}
+
+type rulesOf map[string]policy.Action
+
+func (r rulesOf) Decide(fqdn string, _ net.IP) (policy.Action, bool) {
+	action, ok := r[fqdn]
+	return action, ok
+}
+
+func TestSinkhole(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.1"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithSinkhole(allowlistOf{"allowed.example.com."}),
+		dnsqueryhandler.WithPolicy(rulesOf{
+			"portal.example.com.":  policy.Allow,
+			"allowed.example.com.": policy.Block,
+		}),
+		dnsqueryhandler.WithBlockAnswers(net.ParseIP("192.0.2.53"), nil),
+	)
+
+	tests := []struct {
+		fqdn string
+		want string
+	}{
+		{"guest.example.com.", "192.0.2.53"},
+		{"portal.example.com.", "192.0.2.1"},
+		{"allowed.example.com.", "192.0.2.53"},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, dns.TypeA)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		assertAnswerIPs(t, res, tt.want)
+	}
+
+	h = dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.1"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithSinkhole(allowlistOf{"allowed.example.com."}),
+	)
+	req := &dns.Msg{}
+	req.SetQuestion("allowed.example.com.", dns.TypeA)
+	w := &fakeResponseWriter{}
+	h.HandleAandAAAA(w, req)
+	assertAnswerIPs(t, w.response(t), "192.0.2.1")
+}
+
+func TestPolicyPerClient(t *testing.T) {
+	p, _, err := policy.Load(strings.NewReader(strings.Join([]string{
+		"block social.example.com 192.0.2.128/25",
+		"allow social.example.com",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.1"},
+		fixedChooser("192.0.2.1:53"),
+		fullSet{},
+		dnsqueryhandler.WithPolicy(p),
+		dnsqueryhandler.WithBlockAnswers(net.ParseIP("192.0.2.53"), nil),
+	)
+
+	tests := []struct {
+		name   string
+		remote net.Addr
+		want   string
+	}{
+		{"blocked subnet", &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5353}, "192.0.2.53"},
+		{"other subnet", &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 5353}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion("social.example.com.", dns.TypeA)
+
+			w := &fakeResponseWriter{remote: tt.remote}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			assertAnswerIPs(t, res, tt.want)
+		})
+	}
+}
+
+func TestHINFOBlocks(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		nil,
+		fixedChooser("192.0.2.1:53"),
+		fullSet{},
+		dnsqueryhandler.WithHINFOBlocks("BLOCKED", "policy"),
+	)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := &dns.Msg{}
+		req.SetQuestion("ads.example.com.", qtype)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		if len(res.Answer) != 1 {
+			t.Fatalf("expected one answer; got %v", res.Answer)
+		}
+		hinfo, ok := res.Answer[0].(*dns.HINFO)
+		if !ok || hinfo.Cpu != "BLOCKED" || hinfo.Os != "policy" {
+			t.Errorf("expected HINFO BLOCKED policy; got %v", res.Answer[0])
+		}
+	}
+}
+
+// onlySet contains exactly its names.
+type onlySet []string
+
+func (s onlySet) Contains(fqdn string) bool {
+	for _, x := range s {
+		if x == fqdn {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCNAMEBlocks(t *testing.T) {
+	tests := []struct {
+		name      string
+		blocklist onlySet
+		want      string
+	}{
+		{"CNAME", onlySet{"ads.example.com."}, "ads.example.com.\t0\tIN\tCNAME\tblocked.mynetwork.local."},
+		{"blocked target", onlySet{"ads.example.com.", "blocked.mynetwork.local."}, "ads.example.com.\t0\tIN\tA\t0.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				nil,
+				fixedChooser("192.0.2.1:53"),
+				tt.blocklist,
+				dnsqueryhandler.WithCNAMEBlocks("blocked.mynetwork.local"),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("ads.example.com.", dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			if len(res.Answer) != 1 || res.Answer[0].String() != tt.want {
+				t.Errorf("expected %q; got %v", tt.want, res.Answer)
+			}
+		})
+	}
+}
+
+type rotatingChooser struct {
+	nameservers []string
+	i           int
+}
+
+func (c *rotatingChooser) Next() string {
+	ns := c.nameservers[c.i%len(c.nameservers)]
+	c.i++
+	return ns
+}
+
+// downExchanger fails for nameservers that are down, and answers otherwise.
+type downExchanger map[string]bool
+
+func (e downExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if e[address] {
+		return nil, 0, errors.New("connection refused")
+	}
+	return answeringExchanger{"192.0.2.10"}.Exchange(m, address)
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    time.Duration
+		wantRcode int
+	}{
+		{"disabled", 0, dns.RcodeServerFailure},
+		{"fails over", time.Second, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				downExchanger{"192.0.2.1:53": true},
+				&rotatingChooser{nameservers: []string{"192.0.2.1:53", "192.0.2.2:53"}},
+				emptySet{},
+				dnsqueryhandler.WithRetry(tt.window, time.Millisecond),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("example.com.", dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			assertRcode(t, w.response(t), tt.wantRcode)
+		})
+	}
+}
+
+// rcodeExchanger answers with the rcode of the nameserver, and with an answer
+// if there is none.
+type rcodeExchanger map[string]int
+
+func (e rcodeExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if rcode, ok := e[address]; ok {
+		res := &dns.Msg{}
+		res.SetRcode(m, rcode)
+		return res, 0, nil
+	}
+	return answeringExchanger{"192.0.2.10"}.Exchange(m, address)
+}
+
+func TestRcodeRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		exchanger   rcodeExchanger
+		rcodes      []int
+		max         int
+		wantRcode   int
+		wantRetries int64
+	}{
+		{"disabled", rcodeExchanger{"192.0.2.1:53": dns.RcodeServerFailure}, nil, 0, dns.RcodeServerFailure, 0},
+		{"fails over", rcodeExchanger{"192.0.2.1:53": dns.RcodeServerFailure}, []int{dns.RcodeServerFailure}, 2, dns.RcodeSuccess, 1},
+		{"other rcode", rcodeExchanger{"192.0.2.1:53": dns.RcodeRefused}, []int{dns.RcodeServerFailure}, 2, dns.RcodeRefused, 0},
+		{"all fail", rcodeExchanger{"192.0.2.1:53": dns.RcodeServerFailure, "192.0.2.2:53": dns.RcodeServerFailure}, []int{dns.RcodeServerFailure}, 3, dns.RcodeServerFailure, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.exchanger,
+				&rotatingChooser{nameservers: []string{"192.0.2.1:53", "192.0.2.2:53"}},
+				emptySet{},
+				dnsqueryhandler.WithRcodeRetries(tt.rcodes, tt.max),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("example.com.", dns.TypeA)
+
+			before := metrics.UpstreamRcodeRetries.Value()
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			assertRcode(t, w.response(t), tt.wantRcode)
+			if got := metrics.UpstreamRcodeRetries.Value() - before; got != tt.wantRetries {
+				t.Errorf("expected %d retries; got %d", tt.wantRetries, got)
+			}
+		})
+	}
+}
+
+func TestFallbackRecords(t *testing.T) {
+	fallback := dnsqueryhandler.WithFallbackRecords(staticRecords{
+		"intranet.example.com.": {net.ParseIP("192.0.2.80")},
+	})
+	tests := []struct {
+		name      string
+		exchanger interface {
+			Exchange(*dns.Msg, string) (*dns.Msg, time.Duration, error)
+		}
+		fqdn      string
+		wantRcode int
+		want      []string
+	}{
+		{"upstream answers", answeringExchanger{"192.0.2.1"}, "intranet.example.com.", dns.RcodeSuccess, []string{"192.0.2.1"}},
+		{"upstream unreachable", failingExchanger{}, "intranet.example.com.", dns.RcodeSuccess, []string{"192.0.2.80"}},
+		{"upstream SERVFAIL", rcodeExchanger{"192.0.2.1:53": dns.RcodeServerFailure}, "intranet.example.com.", dns.RcodeSuccess, []string{"192.0.2.80"}},
+		{"upstream NXDOMAIN", rcodeExchanger{"192.0.2.1:53": dns.RcodeNameError}, "intranet.example.com.", dns.RcodeNameError, nil},
+		{"no fallback records", failingExchanger{}, "www.example.com.", dns.RcodeServerFailure, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.exchanger,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+				fallback,
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion(tt.fqdn, dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, tt.wantRcode)
+			assertAnswerIPs(t, res, tt.want...)
+		})
+	}
+}
+
+func TestFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchanger downExchanger
+		want      int
+		wantFalls int64
+	}{
+		{"primary up", downExchanger{"192.0.2.9:53": true}, dns.RcodeSuccess, 0},
+		{"primary down", downExchanger{"192.0.2.1:53": true}, dns.RcodeSuccess, 1},
+		{"both down", downExchanger{"192.0.2.1:53": true, "192.0.2.9:53": true}, dns.RcodeServerFailure, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.exchanger,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+				dnsqueryhandler.WithFallback("192.0.2.9:53"),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+
+			before := metrics.UpstreamFallbacks.Value()
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			assertRcode(t, w.response(t), tt.want)
+			if got := metrics.UpstreamFallbacks.Value() - before; got != tt.wantFalls {
+				t.Errorf("expected %d fallbacks; got %d", tt.wantFalls, got)
+			}
+		})
+	}
+}
+
+func TestRetryWindow(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		failingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithRetry(50*time.Millisecond, 5*time.Millisecond),
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	w := &fakeResponseWriter{}
+	start := time.Now()
+	h.HandleAandAAAA(w, req)
+	elapsed := time.Since(start)
+
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("expected retries to stop after the window; took %v", elapsed)
+	}
+	assertRcode(t, w.response(t), dns.RcodeServerFailure)
+}
+
+func TestUnsupportedRcodes(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		failingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithUnsupportedRcodes(dns.RcodeSuccess, dns.RcodeNotImplemented),
+	)
+
+	tests := []struct {
+		name   string
+		qclass uint16
+		qtype  uint16
+		want   int
+	}{
+		{"unsupported class", dns.ClassCHAOS, dns.TypeA, dns.RcodeSuccess},
+		{"unsupported type", dns.ClassINET, dns.TypeMX, dns.RcodeNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion("example.com.", tt.qtype)
+			req.Question[0].Qclass = tt.qclass
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, tt.want)
+			assertAnswerIPs(t, res)
+		})
+	}
+}
+
+func TestUnsupportedOpcode(t *testing.T) {
+	for _, rcode := range []int{dns.RcodeRefused, dns.RcodeNotImplemented} {
+		opts := []dnsqueryhandler.Option{}
+		if rcode != dns.RcodeRefused {
+			opts = append(opts, dnsqueryhandler.WithUnsupportedOpcodeRcode(rcode))
+		}
+		h := dnsqueryhandler.New(
+			zap.NewNop(),
+			answeringExchanger{"192.0.2.1"},
+			fixedChooser("192.0.2.1:53"),
+			emptySet{},
+			opts...,
+		)
+
+		req := &dns.Msg{}
+		req.SetUpdate("example.com.")
+		req.Insert([]dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		}})
+
+		before := metrics.UnsupportedOpcodes.Value()
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, rcode)
+		if res.Opcode != dns.OpcodeUpdate || len(res.Answer) > 0 {
+			t.Errorf("expected an empty UPDATE response; got %v", res)
+		}
+		if got := metrics.UnsupportedOpcodes.Value() - before; got != 1 {
+			t.Errorf("expected one unsupported opcode to be counted; got %d", got)
+		}
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		failingExchanger{},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithWhoami("whoami.mydns"),
+	)
+
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::100"), Port: 5353}
+	tests := []struct {
+		name   string
+		remote net.Addr
+		qtype  uint16
+		want   string
+	}{
+		{"A from IPv4", nil, dns.TypeA, "192.0.2.100"},
+		{"AAAA from IPv4", nil, dns.TypeAAAA, ""},
+		{"TXT from IPv4", nil, dns.TypeTXT, "192.0.2.100"},
+		{"AAAA from IPv6", v6, dns.TypeAAAA, "2001:db8::100"},
+		{"TXT from IPv6", v6, dns.TypeTXT, "2001:db8::100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion("WhoAmI.mydns.", tt.qtype)
+
+			w := &fakeResponseWriter{remote: tt.remote}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			if len(tt.want) < 1 {
+				assertAnswerIPs(t, res)
+				return
+			}
+			if tt.qtype != dns.TypeTXT {
+				assertAnswerIPs(t, res, tt.want)
+				return
+			}
+			if len(res.Answer) != 1 {
+				t.Fatalf("expected one answer; got %v", res.Answer)
+			}
+			txt, ok := res.Answer[0].(*dns.TXT)
+			if !ok || len(txt.Txt) != 1 || txt.Txt[0] != tt.want {
+				t.Errorf("expected TXT %q; got %v", tt.want, res.Answer[0])
+			}
+		})
+	}
+}
+
+func TestCasePreserved(t *testing.T) {
+	const name = "Ads.ExAmple.COM."
+
+	tests := []struct {
+		name      string
+		exchanger answeringExchanger
+		blocklist interface{ Contains(string) bool }
+	}{
+		{"blocked", nil, fullSet{}},
+		{"forwarded", answeringExchanger{"192.0.2.10"}, emptySet{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.exchanger,
+				fixedChooser("192.0.2.1:53"),
+				tt.blocklist,
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion(name, dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			if len(res.Question) != 1 || res.Question[0].Name != name {
+				t.Errorf("expected question %q to be echoed; got %v", name, res.Question)
+			}
+			if len(res.Answer) != 1 || res.Answer[0].Header().Name != name {
+				t.Errorf("expected one answer for %q; got %v", name, res.Answer)
+			}
+		})
+	}
+}
+
+type suppressAAAA struct{}
+
+func (suppressAAAA) Suppressed(fqdn string, qtype uint16) bool {
+	return fqdn == "legacy.example.com." && qtype == dns.TypeAAAA
+}
+
+func TestSuppressedTypes(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.10"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithSuppressedTypes(suppressAAAA{}),
+	)
+
+	tests := []struct {
+		fqdn  string
+		qtype uint16
+		want  []string
+	}{
+		{"legacy.example.com.", dns.TypeAAAA, nil},
+		{"legacy.example.com.", dns.TypeA, []string{"192.0.2.10"}},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, tt.qtype)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		assertAnswerIPs(t, res, tt.want...)
+	}
+}
+
+// rewritingExchanger answers, but rewrites the question of the response.
+type rewritingExchanger func(q *dns.Question)
+
+func (e rewritingExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	res, rtt, err := answeringExchanger{"192.0.2.10"}.Exchange(m, address)
+	e(&res.Question[0])
+	return res, rtt, err
+}
+
+func TestQuestionMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite rewritingExchanger
+		want    int
+	}{
+		{"same", func(q *dns.Question) {}, dns.RcodeSuccess},
+		{"case", func(q *dns.Question) { q.Name = "WWW.Example.COM." }, dns.RcodeSuccess},
+		{"name", func(q *dns.Question) { q.Name = "evil.example.com." }, dns.RcodeServerFailure},
+		{"type", func(q *dns.Question) { q.Qtype = dns.TypeAAAA }, dns.RcodeServerFailure},
+		{"class", func(q *dns.Question) { q.Qclass = dns.ClassCHAOS }, dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.rewrite,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+
+			before := metrics.SpoofedResponses.Value()
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			assertRcode(t, w.response(t), tt.want)
+			var want int64
+			if tt.want != dns.RcodeSuccess {
+				want = 1
+			}
+			if got := metrics.SpoofedResponses.Value() - before; got != want {
+				t.Errorf("expected %d spoofed responses; got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestCaseMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite rewritingExchanger
+		want    int64
+	}{
+		{"same", func(q *dns.Question) {}, 0},
+		{"case", func(q *dns.Question) { q.Name = "WWW.Example.COM." }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				tt.rewrite,
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+
+			before := metrics.CaseMismatches.Value()
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			assertRcode(t, w.response(t), dns.RcodeSuccess)
+			if got := metrics.CaseMismatches.Value() - before; got != tt.want {
+				t.Errorf("expected %d case mismatches; got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.10"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithTCPKeepalive(2*time.Minute),
+	)
+
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 5353}
+	tests := []struct {
+		name      string
+		remote    net.Addr
+		keepalive bool
+		want      []byte
+	}{
+		{"TCP with option", tcp, true, []byte{0x04, 0xb0}},
+		{"TCP without option", tcp, false, nil},
+		{"UDP with option", nil, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			if tt.keepalive {
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+			}
+
+			w := &fakeResponseWriter{remote: tt.remote}
+			h.HandleAandAAAA(w, req)
+
+			var got []byte
+			if opt := w.response(t).IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == dns.EDNS0TCPKEEPALIVE {
+						got = l.Data
+					}
+				}
+			}
+			if string(got) != string(tt.want) {
+				t.Errorf("expected keepalive %x; got %x", tt.want, got)
+			}
+		})
+	}
+}
+
+// recordingExchanger remembers the nameserver and name of the last query, and
+// answers it.
+type recordingExchanger struct {
+	address string
+	name    string
+}
+
+func (e *recordingExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.address = address
+	e.name = m.Question[0].Name
+	return answeringExchanger{"192.0.2.10"}.Exchange(m, address)
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	overrides := map[string]string{
+		"192.0.2.2":   "192.0.2.2:53",
+		"2001:db8::1": "[2001:db8::1]:53",
+	}
+	tests := []struct {
+		name        string
+		allow       bool
+		qname       string
+		option      string
+		wantRcode   int
+		wantAddress string
+		wantName    string
+	}{
+		{"no override", true, "example.com.", "", dns.RcodeSuccess, "192.0.2.1:53", "example.com."},
+		{"IPv4 suffix", true, "example.com.via.192-0-2-2.", "", dns.RcodeSuccess, "192.0.2.2:53", "example.com."},
+		{"IPv6 suffix", true, "example.com.VIA.2001-db8--1.", "", dns.RcodeSuccess, "[2001:db8::1]:53", "example.com."},
+		{"EDNS0 option", true, "example.com.", "192.0.2.2", dns.RcodeSuccess, "192.0.2.2:53", "example.com."},
+		{"unknown nameserver", true, "example.com.via.192-0-2-9.", "", dns.RcodeRefused, "", ""},
+		{"blocked", true, "blocked.example.com.via.192-0-2-2.", "", dns.RcodeSuccess, "", ""},
+		{"not an IP", true, "www.via.example.", "", dns.RcodeSuccess, "192.0.2.1:53", "www.via.example."},
+		{"via label with EDNS0 option", true, "www.via.com.", "192.0.2.2", dns.RcodeSuccess, "192.0.2.2:53", "www.via.com."},
+		{"inner via label with EDNS0 option", true, "a.b.via.net.", "192.0.2.2", dns.RcodeSuccess, "192.0.2.2:53", "a.b.via.net."},
+		{"disabled", false, "example.com.via.192-0-2-2.", "", dns.RcodeSuccess, "192.0.2.1:53", "example.com.via.192-0-2-2."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &recordingExchanger{}
+			opts := []dnsqueryhandler.Option{}
+			if tt.allow {
+				opts = append(opts, dnsqueryhandler.WithUpstreamOverride(overrides))
+			}
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				e,
+				fixedChooser("192.0.2.1:53"),
+				onlySet{"blocked.example.com."},
+				opts...,
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion(tt.qname, dns.TypeA)
+			if len(tt.option) > 0 {
+				req.SetEdns0(dns.DefaultMsgSize, false)
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+					Code: dnsqueryhandler.EDNS0UpstreamOverride,
+					Data: []byte(tt.option),
+				})
+			}
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, tt.wantRcode)
+			if e.address != tt.wantAddress || e.name != tt.wantName {
+				t.Errorf("expected %q to be sent to %q; got %q to %q", tt.wantName, tt.wantAddress, e.name, e.address)
+			}
+			if q := res.Question[0].Name; q != tt.qname {
+				t.Errorf("expected question %q to be echoed; got %q", tt.qname, q)
+			}
+		})
+	}
+}
+
+type drainFlag bool
+
+func (d *drainFlag) Draining() bool { return bool(*d) }
+
+func TestDrain(t *testing.T) {
+	var draining drainFlag
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.10"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithDrain(&draining),
+	)
+
+	query := func() *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+		return w.response(t)
+	}
+
+	res := query()
+	assertRcode(t, res, dns.RcodeSuccess)
+	assertAnswerIPs(t, res, "192.0.2.10")
+
+	draining = true
+	res = query()
+	assertRcode(t, res, dns.RcodeRefused)
+	if len(res.Answer) > 0 {
+		t.Errorf("expected no answers while draining; got %v", res.Answer)
+	}
+}
+
+type maintenanceFlag bool
+
+func (m *maintenanceFlag) InMaintenance() bool { return bool(*m) }
+
+func TestMaintenance(t *testing.T) {
+	var draining drainFlag
+	var maintenance maintenanceFlag
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.10"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithDrain(&draining),
+		dnsqueryhandler.WithMaintenance(&maintenance, dns.RcodeServerFailure),
+	)
+
+	query := func() *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+		return w.response(t)
+	}
+
+	maintenance = true
+	res := query()
+	assertRcode(t, res, dns.RcodeServerFailure)
+	if len(res.Answer) > 0 {
+		t.Errorf("expected no answers in maintenance mode; got %v", res.Answer)
+	}
+
+	// draining takes precedence
+	draining = true
+	assertRcode(t, query(), dns.RcodeRefused)
+
+	draining = false
+	maintenance = false
+	res = query()
+	assertRcode(t, res, dns.RcodeSuccess)
+	assertAnswerIPs(t, res, "192.0.2.10")
+}
+
+// tlsResponseWriter is a fakeResponseWriter for a client connected over TLS.
+type tlsResponseWriter struct {
+	*fakeResponseWriter
+}
+
+func (w tlsResponseWriter) ConnectionState() *tls.ConnectionState {
+	return &tls.ConnectionState{}
+}
+
+func TestPadding(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 5353}
+	tests := []struct {
+		name      string
+		blockSize int
+		tls       bool
+		remote    net.Addr
+		edns      bool
+		padding   bool
+		udpSize   uint16
+		wantLen   int // the padded length is a multiple of it; 0 means unpadded
+	}{
+		{"option over UDP", 128, false, nil, true, true, dns.DefaultMsgSize, 128},
+		{"option over TCP", 468, false, tcp, true, true, dns.DefaultMsgSize, 468},
+		{"TLS without option", 468, true, tcp, true, false, dns.DefaultMsgSize, 468},
+		{"UDP without option", 128, false, nil, true, false, dns.DefaultMsgSize, 0},
+		{"TLS without EDNS0", 468, true, tcp, false, false, 0, 0},
+		{"capped at UDP size", 1024, false, nil, true, true, 512, 512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				answeringExchanger{"192.0.2.10"},
+				fixedChooser("192.0.2.1:53"),
+				emptySet{},
+				dnsqueryhandler.WithPadding(tt.blockSize),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			if tt.edns {
+				req.SetEdns0(tt.udpSize, false)
+			}
+			if tt.padding {
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+			}
+
+			fw := &fakeResponseWriter{remote: tt.remote}
+			var w dns.ResponseWriter = fw
+			if tt.tls {
+				w = tlsResponseWriter{fw}
+			}
+			h.HandleAandAAAA(w, req)
+
+			res := fw.response(t)
+			padded := false
+			if opt := res.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if _, ok := o.(*dns.EDNS0_PADDING); ok {
+						padded = true
+					}
+				}
+			}
+			if padded != (tt.wantLen > 0) {
+				t.Fatalf("expected padded %v; got %v", tt.wantLen > 0, padded)
+			}
+			if !padded {
+				return
+			}
+			wire, err := res.Pack()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(wire)%tt.wantLen != 0 {
+				t.Errorf("expected length to be a multiple of %d; got %d", tt.wantLen, len(wire))
+			}
+			assertAnswerIPs(t, res, "192.0.2.10")
+		})
+	}
+}
+
+type quotaOf int
+
+func (q *quotaOf) Allow(net.IP) bool {
+	*q--
+	return *q >= 0
+}
+
+func TestClientQuota(t *testing.T) {
+	q := quotaOf(1)
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.10"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithClientQuota(&q),
+	)
+
+	for _, want := range []int{dns.RcodeSuccess, dns.RcodeRefused} {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		assertRcode(t, w.response(t), want)
+	}
+}
+
+func TestMaxLabels(t *testing.T) {
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		answeringExchanger{"192.0.2.10"},
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+		dnsqueryhandler.WithMaxLabels(4),
+	)
+
+	// four labels, but 255 bytes
+	long := strings.Repeat(strings.Repeat("a", 63)+".", 4)
+	tests := []struct {
+		fqdn string
+		want int
+	}{
+		{"a.b.example.com.", dns.RcodeSuccess},
+		{"a.b.c.example.com.", dns.RcodeRefused},
+		{long, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.fqdn, dns.TypeA)
+
+		before := metrics.OversizedQueries.Value()
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		assertRcode(t, w.response(t), tt.want)
+		var want int64
+		if tt.want == dns.RcodeRefused {
+			want = 1
+		}
+		if got := metrics.OversizedQueries.Value() - before; got != want {
+			t.Errorf("%q: expected %d oversized queries; got %d", tt.fqdn, want, got)
+		}
+	}
+}
+
+func TestQNAMENormalization(t *testing.T) {
+	for _, normalize := range []bool{true, false} {
+		var opts []dnsqueryhandler.Option
+		if normalize {
+			opts = append(opts, dnsqueryhandler.WithQNAMENormalization())
+		}
+		e := &dnssecExchanger{}
+		h := dnsqueryhandler.New(
+			zap.NewNop(),
+			e,
+			fixedChooser("192.0.2.1:53"),
+			emptySet{},
+			opts...,
+		)
+
+		req := &dns.Msg{}
+		req.SetQuestion("Sub.Example.COM.", dns.TypeDS)
+
+		w := &fakeResponseWriter{}
+		h.HandleAandAAAA(w, req)
+
+		want := "Sub.Example.COM."
+		if normalize {
+			want = "sub.example.com."
+		}
+		if got := e.last.Question[0].Name; got != want {
+			t.Errorf("normalize %v: expected upstream query for %s; got %s", normalize, want, got)
+		}
+
+		res := w.response(t)
+		assertRcode(t, res, dns.RcodeSuccess)
+		if got := res.Question[0].Name; got != "Sub.Example.COM." {
+			t.Errorf("normalize %v: expected the client's question; got %s", normalize, got)
+		}
+		if len(res.Answer) != 2 {
+			t.Fatalf("normalize %v: expected 2 answers; got %v", normalize, res.Answer)
+		}
+		for _, rr := range res.Answer {
+			if rr.Header().Name != "Sub.Example.COM." {
+				t.Errorf("normalize %v: expected answer in the client's case; got %v", normalize, rr)
+			}
+		}
+	}
+}
+
+func TestCorrelationIDs(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	e := &dnssecExchanger{}
+	h := dnsqueryhandler.New(
+		zap.New(core),
+		e,
+		fixedChooser("192.0.2.1:53"),
+		emptySet{},
+	)
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeDNSKEY)
+	req.Id = 4242
+	h.HandleAandAAAA(&fakeResponseWriter{}, req)
+
+	entries := logs.FilterMessage("answer").All()
+	if len(entries) < 1 {
+		t.Fatal("expected the answer to be logged")
+	}
+	fields := entries[0].ContextMap()
+	if got := fields["query.ID"]; got != uint16(4242) {
+		t.Errorf("expected query.ID 4242; got %v", got)
+	}
+	if got := fields["upstreamQuery.ID"]; got != e.last.Id {
+		t.Errorf("expected upstreamQuery.ID %d; got %v", e.last.Id, got)
+	}
+	if _, ok := fields["request.ID"]; !ok {
+		t.Error("expected request.ID")
+	}
+}
+
+func TestAnswerLog(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		core, logs := observer.New(zap.InfoLevel)
+		h := dnsqueryhandler.New(
+			zap.New(core),
+			answeringExchanger{"192.0.2.10"},
+			fixedChooser("192.0.2.1:53"),
+			onlySet{"ads.example.com."},
+			dnsqueryhandler.WithAnswerLog(enabled),
+		)
+
+		sizes := metrics.ResponseBytes.Get("udp").(*metrics.Histogram)
+		before := sizes.Count(-1)
+		for _, name := range []string{"www.example.com.", "ads.example.com."} {
+			req := &dns.Msg{}
+			req.SetQuestion(name, dns.TypeA)
+			h.HandleAandAAAA(&fakeResponseWriter{}, req)
+		}
+
+		want := 0
+		if enabled {
+			want = 1
+		}
+		if got := logs.FilterMessage("answer").Len(); got != want {
+			t.Errorf("enabled %v: expected %d answer lines; got %d", enabled, want, got)
+		}
+		if got := logs.FilterMessage("block").Len(); got != 1 {
+			t.Errorf("enabled %v: expected the block to be logged; got %d lines", enabled, got)
+		}
+		if got := sizes.Count(-1) - before; got != 2 {
+			t.Errorf("enabled %v: expected 2 responses to be counted; got %d", enabled, got)
+		}
+	}
+}
+
+func TestUpstreamDump(t *testing.T) {
+	for _, level := range []zapcore.Level{zap.DebugLevel, zap.InfoLevel} {
+		core, logs := observer.New(level)
+		h := dnsqueryhandler.New(
+			zap.New(core),
+			answeringExchanger{"192.0.2.10"},
+			fixedChooser("192.0.2.1:53"),
+			emptySet{},
+		)
+
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		h.HandleAandAAAA(&fakeResponseWriter{}, req)
+
+		dumps := logs.FilterMessage("upstream exchange").All()
+		if level == zap.InfoLevel {
+			if len(dumps) != 0 {
+				t.Errorf("expected no dumps at info level; got %d", len(dumps))
+			}
+			continue
+		}
+		if len(dumps) != 1 {
+			t.Fatalf("expected one dump at debug level; got %d", len(dumps))
+		}
+		fields := dumps[0].ContextMap()
+		for _, key := range []string{"upstreamQuery", "upstreamQuery.wire", "upstreamResponse", "upstreamResponse.wire"} {
+			if _, ok := fields[key]; !ok {
+				t.Errorf("expected dump to have %q", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// edeOptionCode is the EDNS0 option code for Extended DNS Errors.
+const edeOptionCode = 15
+
+// extendedError is an Extended DNS Error (RFC 8914).
+type extendedError struct {
+	infoCode  uint16
+	extraText string
+}
+
+var (
+	edeOther            = &extendedError{infoCode: 0}
+	edeIDMismatch       = &extendedError{infoCode: 0, extraText: "upstream response ID mismatch"}
+	edeInvalidCookie    = &extendedError{infoCode: 0, extraText: "invalid upstream cookie"}
+	edeQuestionMismatch = &extendedError{infoCode: 0, extraText: "upstream response question mismatch"}
+	edeDraining         = &extendedError{infoCode: 0, extraText: "server is draining"}
+	edeMaintenance      = &extendedError{infoCode: 0, extraText: "server is in maintenance"}
+	edeQuotaExceeded    = &extendedError{infoCode: 18, extraText: "client quota exceeded"}
+	edeNotReady         = &extendedError{infoCode: 14, extraText: "blocklist not ready"}
+	edeBlocked          = &extendedError{infoCode: 15}
+	edeNotSupported     = &extendedError{infoCode: 21}
+	edeNetworkError     = &extendedError{infoCode: 23}
+)
+
+// option returns the EDNS0 option carrying the error. The version of the `dns`
+// package in use has no dedicated type for it, so it is packed by hand.
+func (e *extendedError) option() dns.EDNS0 {
+	data := make([]byte, 2, 2+len(e.extraText))
+	binary.BigEndian.PutUint16(data, e.infoCode)
+	data = append(data, e.extraText...)
+
+	return &dns.EDNS0_LOCAL{
+		Code: edeOptionCode,
+		Data: data,
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MaxTCPKeepalive is the longest idle timeout the TCP Keepalive option can
+// carry, as it is encoded in units of 100 milliseconds.
+const MaxTCPKeepalive = 65535 * 100 * time.Millisecond
+
+// tcpKeepaliveOption returns the EDNS0 TCP Keepalive option (RFC 7828)
+// advertising timeout. The version of the `dns` package in use does not pack
+// its dedicated type correctly, so it is packed by hand.
+func tcpKeepaliveOption(timeout time.Duration) dns.EDNS0 {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(timeout/(100*time.Millisecond)))
+
+	return &dns.EDNS0_LOCAL{
+		Code: dns.EDNS0TCPKEEPALIVE,
+		Data: data,
+	}
+}
+
+// wantsTCPKeepalive reports whether r was received over TCP and carries the TCP
+// Keepalive option. Only then may the response carry it.
+func wantsTCPKeepalive(w dns.ResponseWriter, r *dns.Msg) bool {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		return false
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0UpstreamOverride is the code of the EDNS0 option naming the upstream
+// nameserver a query is to be sent to, by its IP as text, e.g. `192.0.2.1`.
+// It is taken from the range reserved for local use (RFC 6891).
+const EDNS0UpstreamOverride = 65001
+
+// overrideLabel is the next to last label of names carrying an upstream
+// override, followed by the IP of the nameserver with its dots or colons
+// replaced by dashes, e.g. `example.com.via.192-0-2-1.` or
+// `example.com.via.2001-db8--1.`.
+const overrideLabel = "via"
+
+// parseOverride returns the IP of the upstream nameserver that r names, via
+// the EDNS0 option or the suffix of fqdn, and fqdn without that suffix. The
+// option takes precedence, but the suffix is stripped either way. Names whose
+// last label is not an IP have no suffix, even if the next to last label is
+// `via`, e.g. `www.via.com.`. ok is false if r names no nameserver.
+func parseOverride(r *dns.Msg, fqdn string) (name string, ip net.IP, ok bool) {
+	name = fqdn
+	labels := dns.SplitDomainName(fqdn)
+	if n := len(labels); n > 2 && strings.EqualFold(labels[n-2], overrideLabel) {
+		if ip = parseOverrideLabel(labels[n-1]); ip != nil {
+			name = dns.Fqdn(strings.Join(labels[:n-2], "."))
+		}
+	}
+
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == EDNS0UpstreamOverride {
+				ip = net.ParseIP(string(l.Data))
+			}
+		}
+	}
+
+	return name, ip, ip != nil
+}
+
+func parseOverrideLabel(label string) net.IP {
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ".")); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// wantsPadding reports whether the response to r should be padded, i.e. r
+// carries the EDNS0 Padding option (RFC 7830) or was received over TLS. As the
+// option can only be sent to clients that support EDNS0, r must have an OPT
+// record either way.
+func wantsPadding(w dns.ResponseWriter, r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return true
+	}
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// pad adds the EDNS0 Padding option to m, padding its length up to the next
+// multiple of blockSize (RFC 8467), but never beyond limit. If m is already
+// at or past limit, it is padded as far as possible, i.e. not at all.
+func pad(m *dns.Msg, blockSize, limit int) {
+	padding := &dns.EDNS0_PADDING{}
+	addOption(m, padding)
+
+	l := m.Len()
+	n := (blockSize - l%blockSize) % blockSize
+	if l+n > limit {
+		n = limit - l
+	}
+	if n > 0 {
+		padding.Padding = make([]byte, n)
+	}
+}
+
+// paddingLimit returns the longest the response to r may get through padding:
+// the client's UDP buffer size over UDP, and the maximum message size over TCP.
+func paddingLimit(w dns.ResponseWriter, r *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
+	return udpSize(r)
+}
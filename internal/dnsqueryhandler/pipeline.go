@@ -0,0 +1,149 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Names of the stages a query passes through until one of them answers it. By
+// default, they are run in this order:
+//   - quota refuses clients that have exceeded their quota
+//   - class refuses classes other than INET
+//   - whoami answers the whoami name with the client's IP
+//   - any answers ANY with a minimal HINFO record
+//   - type refuses unsupported types
+//   - static answers names with static records, and names under local TLDs
+//   - block answers blocked names with the blocked answer
+//   - suppress answers suppressed types with NODATA
+//
+// Queries that pass all stages are forwarded to the upstream nameservers.
+const (
+	StageQuota    = "quota"
+	StageClass    = "class"
+	StageWhoami   = "whoami"
+	StageANY      = "any"
+	StageType     = "type"
+	StageStatic   = "static"
+	StageBlock    = "block"
+	StageSuppress = "suppress"
+)
+
+// DefaultStageOrder returns the default order of the stages.
+func DefaultStageOrder() []string {
+	return []string{
+		StageQuota,
+		StageClass,
+		StageWhoami,
+		StageANY,
+		StageType,
+		StageStatic,
+		StageBlock,
+		StageSuppress,
+	}
+}
+
+// ValidateStageOrder checks that order holds every stage exactly once.
+func ValidateStageOrder(order []string) error {
+	want := map[string]bool{}
+	for _, name := range DefaultStageOrder() {
+		want[name] = true
+	}
+	for _, name := range order {
+		if !want[name] {
+			return fmt.Errorf("unknown or repeated stage: %q", name)
+		}
+		delete(want, name)
+	}
+	for _, name := range DefaultStageOrder() {
+		if want[name] {
+			return fmt.Errorf("missing stage: %q", name)
+		}
+	}
+	return nil
+}
+
+// query is a client query on its way through the pipeline.
+type query struct {
+	msg        *dns.Msg
+	question   dns.Question // the first one; the others are ignored
+	fqdn       string
+	reqID      string
+	remoteAddr net.IP
+	nameserver string // picked by the client, if not empty
+	logger     *zap.Logger
+}
+
+// response is the answer of a stage to a query.
+type response struct {
+	msg *dns.Msg
+	ede *extendedError
+}
+
+func answerResponse(r *dns.Msg, ede *extendedError, ans ...dns.RR) *response {
+	res := &dns.Msg{
+		Answer: ans,
+	}
+	res.SetReply(r)
+	return &response{msg: res, ede: ede}
+}
+
+func errResponse(r *dns.Msg, code int, ede *extendedError) *response {
+	res := &dns.Msg{}
+	res.SetRcode(r, code)
+	return &response{msg: res, ede: ede}
+}
+
+// stage is one step of answering a query. It either handles the query,
+// returning the response, or passes it on to the next stage.
+type stage interface {
+	Stage(ctx context.Context, q *query) (handled bool, res *response)
+}
+
+type stageFunc func(ctx context.Context, q *query) (bool, *response)
+
+func (f stageFunc) Stage(ctx context.Context, q *query) (bool, *response) {
+	return f(ctx, q)
+}
+
+// pipeline runs its stages in order until one of them handles the query.
+type pipeline []stage
+
+// newPipeline returns the pipeline of s with its stages in order, followed by
+// forwarding. Unknown stages in order are skipped.
+func newPipeline(s *DNSQueryHandler, order []string) pipeline {
+	stages := map[string]stageFunc{
+		StageQuota:    s.stageQuota,
+		StageClass:    s.stageClass,
+		StageWhoami:   s.stageWhoami,
+		StageANY:      s.stageANY,
+		StageType:     s.stageType,
+		StageStatic:   s.stageStatic,
+		StageBlock:    s.stageBlock,
+		StageSuppress: s.stageSuppress,
+	}
+
+	var p pipeline
+	for _, name := range order {
+		if st, ok := stages[name]; ok {
+			p = append(p, st)
+		}
+	}
+	return append(p, stageFunc(s.stageForward))
+}
+
+func (p pipeline) run(ctx context.Context, q *query) *response {
+	for _, st := range p {
+		if handled, res := st.Stage(ctx, q); handled {
+			return res
+		}
+	}
+	q.logger.Error("no stage handled the query")
+	return errResponse(q.msg, dns.RcodeServerFailure, edeOther)
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/dnsqueryhandler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestValidateStageOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   []string
+		wantErr bool
+	}{
+		{"default", dnsqueryhandler.DefaultStageOrder(), false},
+		{"reordered", []string{"block", "static", "quota", "class", "whoami", "any", "type", "suppress"}, false},
+		{"missing", []string{"quota", "class", "whoami", "any", "type", "static", "block"}, true},
+		{"repeated", []string{"quota", "class", "whoami", "any", "type", "static", "block", "block"}, true},
+		{"unknown", []string{"quota", "class", "whoami", "any", "type", "static", "block", "suppress", "cache"}, true},
+	}
+	for _, tt := range tests {
+		if err := dnsqueryhandler.ValidateStageOrder(tt.order); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v; got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestStageOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+		want  string
+	}{
+		{"static overrides block", dnsqueryhandler.DefaultStageOrder(), "192.0.2.10"},
+		{"block overrides static", []string{"quota", "class", "whoami", "any", "type", "block", "static", "suppress"}, "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := dnsqueryhandler.New(
+				zap.NewNop(),
+				failingExchanger{},
+				fixedChooser("192.0.2.1:53"),
+				fullSet{},
+				dnsqueryhandler.WithStaticRecords(staticRecords{
+					"ads.example.com.": {net.ParseIP("192.0.2.10")},
+				}),
+				dnsqueryhandler.WithStageOrder(tt.order),
+			)
+
+			req := &dns.Msg{}
+			req.SetQuestion("ads.example.com.", dns.TypeA)
+
+			w := &fakeResponseWriter{}
+			h.HandleAandAAAA(w, req)
+
+			res := w.response(t)
+			assertRcode(t, res, dns.RcodeSuccess)
+			assertAnswerIPs(t, res, tt.want)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dnsqueryhandler_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var defaultRemoteAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 5353}
+
+// fakeResponseWriter captures the message written by the handler. Its remote
+// address defaults to a UDP client, but can be set to any net.Addr, e.g. a
+// *net.TCPAddr.
+type fakeResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *fakeResponseWriter) RemoteAddr() net.Addr {
+	if w.remote == nil {
+		return defaultRemoteAddr
+	}
+	return w.remote
+}
+
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// response returns the written message, failing the test if there is none.
+func (w *fakeResponseWriter) response(t *testing.T) *dns.Msg {
+	t.Helper()
+
+	if w.msg == nil {
+		t.Fatal("expected a response")
+	}
+	return w.msg
+}
+
+func assertRcode(t *testing.T, m *dns.Msg, want int) {
+	t.Helper()
+
+	if m.Rcode != want {
+		t.Errorf("expected %s; got %s", dns.RcodeToString[want], dns.RcodeToString[m.Rcode])
+	}
+}
+
+// assertAnswerIPs checks that the A and AAAA records of m hold exactly the
+// given IPs, in order.
+func assertAnswerIPs(t *testing.T, m *dns.Msg, want ...string) {
+	t.Helper()
+
+	if len(m.Answer) != len(want) {
+		t.Fatalf("expected %d answers; got %v", len(want), m.Answer)
+	}
+	for i, rr := range m.Answer {
+		var got net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			got = rr.A
+		case *dns.AAAA:
+			got = rr.AAAA
+		default:
+			t.Errorf("answer %d: expected A or AAAA; got %T", i, rr)
+			continue
+		}
+		if !got.Equal(net.ParseIP(want[i])) {
+			t.Errorf("answer %d: expected %s; got %v", i, want[i], rr)
+		}
+	}
+}
+
+func TestFakeResponseWriterRemoteAddr(t *testing.T) {
+	w := &fakeResponseWriter{}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Errorf("expected UDP remote address by default; got %T", w.RemoteAddr())
+	}
+
+	w = &fakeResponseWriter{remote: &net.TCPAddr{IP: net.IPv6loopback, Port: 5353}}
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("expected TCP remote address; got %T", w.RemoteAddr())
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package dscp
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Max is the largest valid DSCP value.
+const Max = 63
+
+// Control returns a control function for net.ListenConfig and net.Dialer that
+// marks the sockets' traffic with the DSCP value v, by setting the IPv4 TOS
+// byte and the IPv6 traffic class. It is a no-op where Supported is false.
+func Control(v int) (func(network, address string, c syscall.RawConn) error, error) {
+	if v < 0 || v > Max {
+		return nil, fmt.Errorf("invalid DSCP value %d: must be between 0 and %d", v, Max)
+	}
+
+	// DSCP is the upper six bits of the TOS byte; the lower two are ECN
+	tos := v << 2
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = setTOS(fd, tos)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("setting DSCP on %s %s: %w", network, address, err)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,23 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package dscp
+
+import "syscall"
+
+// Supported reports whether DSCP marking is supported on this platform.
+const Supported = true
+
+// setTOS sets both the IPv4 and the IPv6 option, since a dual-stack socket
+// may carry either. It only fails if neither could be set.
+func setTOS(fd uintptr, tos int) error {
+	err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build linux
+// +build linux
+
+package dscp_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/dscp"
+)
+
+func TestControl(t *testing.T) {
+	control, err := dscp.Control(46)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lc := net.ListenConfig{Control: control}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer pc.Close()
+
+	raw, err := pc.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("getting raw conn: %v", err)
+	}
+	var tos int
+	raw.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if err != nil {
+		t.Fatalf("getting IP_TOS: %v", err)
+	}
+	if tos != 46<<2 {
+		t.Errorf("expected TOS %#x; got %#x", 46<<2, tos)
+	}
+}
+
+func TestControlInvalid(t *testing.T) {
+	for _, v := range []int{-1, 64} {
+		if _, err := dscp.Control(v); err == nil {
+			t.Errorf("expected an error for %d", v)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package dscp
+
+// Supported reports whether DSCP marking is supported on this platform.
+const Supported = false
+
+func setTOS(fd uintptr, tos int) error {
+	return nil
+}
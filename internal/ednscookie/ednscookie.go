@@ -0,0 +1,135 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package ednscookie
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	clientCookieLen    = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+type cookie struct {
+	client string
+	server string
+}
+
+// Jar keeps track of DNS Cookies (RFC 7873) for upstream nameservers. Each
+// nameserver gets its own random client cookie, and the server cookie it
+// returns is remembered and sent back on subsequent queries.
+type Jar struct {
+	cookies map[string]*cookie
+	mu      sync.Mutex
+}
+
+// New returns a new, empty Jar.
+func New() *Jar {
+	return &Jar{
+		cookies: map[string]*cookie{},
+	}
+}
+
+// Attach adds a COOKIE option for nameserver to m, adding an OPT record if m
+// does not already have one.
+func (j *Jar) Attach(m *dns.Msg, nameserver string) error {
+	c, err := j.get(nameserver)
+	if err != nil {
+		return err
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: c.client + c.server,
+	})
+
+	return nil
+}
+
+// Validate checks the COOKIE option in a response from nameserver. A response
+// without a cookie is accepted, since not all servers support them, but only
+// until nameserver has returned a server cookie; after that, it is expected in
+// every response (RFC 7873, Section 5.3). If the client cookie does not match
+// the one sent, or the server cookie is malformed, an error is returned.
+// Otherwise, the server cookie is stored for reuse.
+func (j *Jar) Validate(res *dns.Msg, nameserver string) error {
+	var got *dns.EDNS0_COOKIE
+	if opt := res.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				got = c
+				break
+			}
+		}
+	}
+	if got == nil {
+		if j.knowsServer(nameserver) {
+			return errors.New("missing cookie from a server that sent one before")
+		}
+		return nil
+	}
+
+	c, err := j.get(nameserver)
+	if err != nil {
+		return err
+	}
+
+	raw, err := hex.DecodeString(got.Cookie)
+	if err != nil {
+		return fmt.Errorf("decoding cookie: %w", err)
+	}
+	if len(raw) < clientCookieLen+minServerCookieLen || len(raw) > clientCookieLen+maxServerCookieLen {
+		return fmt.Errorf("invalid cookie length: %d", len(raw))
+	}
+	if client := hex.EncodeToString(raw[:clientCookieLen]); client != c.client {
+		return fmt.Errorf("client cookie mismatch: sent %s, got %s", c.client, client)
+	}
+
+	j.mu.Lock()
+	j.cookies[nameserver].server = hex.EncodeToString(raw[clientCookieLen:])
+	j.mu.Unlock()
+
+	return nil
+}
+
+// knowsServer reports whether nameserver has returned a server cookie.
+func (j *Jar) knowsServer(nameserver string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	c, ok := j.cookies[nameserver]
+	return ok && len(c.server) > 0
+}
+
+func (j *Jar) get(nameserver string) (cookie, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if c, ok := j.cookies[nameserver]; ok {
+		return *c, nil
+	}
+
+	var buf [clientCookieLen]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return cookie{}, fmt.Errorf("generating client cookie: %w", err)
+	}
+
+	c := &cookie{client: hex.EncodeToString(buf[:])}
+	j.cookies[nameserver] = c
+	return *c, nil
+}
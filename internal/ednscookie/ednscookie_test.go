@@ -0,0 +1,90 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package ednscookie_test
+
+import (
+	"testing"
+
+	"github.com/execjosh/mydns/internal/ednscookie"
+	"github.com/miekg/dns"
+)
+
+func sentCookie(t *testing.T, m *dns.Msg) string {
+	t.Helper()
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		t.Fatal("expected OPT record")
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie
+		}
+	}
+	t.Fatal("expected COOKIE option")
+	return ""
+}
+
+func response(cookie string) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetEdns0(dns.DefaultMsgSize, false)
+	opt := res.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: cookie,
+	})
+	return res
+}
+
+func TestJar(t *testing.T) {
+	const ns = "192.0.2.1:53"
+	const serverCookie = "0102030405060708"
+
+	jar := ednscookie.New()
+
+	q1 := &dns.Msg{}
+	if err := jar.Attach(q1, ns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := sentCookie(t, q1)
+	if len(client) != 16 {
+		t.Fatalf("expected 8 byte client cookie; got %q", client)
+	}
+
+	if err := jar.Validate(&dns.Msg{}, ns); err != nil {
+		t.Errorf("expected response without cookie to be accepted; got %v", err)
+	}
+
+	if err := jar.Validate(response("ffffffffffffffff"+serverCookie), ns); err == nil {
+		t.Error("expected mismatched client cookie to give error")
+	}
+
+	if err := jar.Validate(response(client+"01"), ns); err == nil {
+		t.Error("expected short server cookie to give error")
+	}
+
+	if err := jar.Validate(response(client+serverCookie), ns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	q2 := &dns.Msg{}
+	if err := jar.Attach(q2, ns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := sentCookie(t, q2), client+serverCookie; got != want {
+		t.Errorf("expected cookie %q; got %q", want, got)
+	}
+
+	if err := jar.Validate(&dns.Msg{}, ns); err == nil {
+		t.Error("expected response without cookie to give error once a server cookie is known")
+	}
+
+	q3 := &dns.Msg{}
+	if err := jar.Attach(q3, "192.0.2.2:53"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := sentCookie(t, q3); got == client {
+		t.Error("expected a different client cookie per nameserver")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package filewatch watches files for changes by polling them, which works
+// everywhere without platform-specific notification APIs.
+package filewatch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Watcher polls a file and calls a function whenever it has changed: its size
+// or modification time differs, or the path now refers to another file, as
+// after an editor saves by writing a new file and renaming it over the old
+// one. A file that vanishes is not a change; its reappearance is.
+type Watcher struct {
+	path     string
+	onChange func()
+
+	last os.FileInfo
+	stop chan struct{}
+	once sync.Once
+}
+
+// Watch starts polling path every interval, calling onChange from the polling
+// goroutine on every change. The state of the file at the time of the call is
+// the baseline.
+func Watch(path string, interval time.Duration, onChange func()) *Watcher {
+	w := &Watcher{
+		path:     path,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+	}
+	w.last, _ = os.Stat(path)
+
+	t := time.NewTicker(interval)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-t.C:
+				w.poll()
+			}
+		}
+	}()
+
+	return w
+}
+
+func (w *Watcher) poll() {
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return
+	}
+	changed := w.last == nil ||
+		!os.SameFile(w.last, fi) ||
+		fi.Size() != w.last.Size() ||
+		!fi.ModTime().Equal(w.last.ModTime())
+	w.last = fi
+	if changed {
+		w.onChange()
+	}
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	w.once.Do(func() { close(w.stop) })
+	return nil
+}
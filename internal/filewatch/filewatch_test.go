@@ -0,0 +1,58 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package filewatch_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/filewatch"
+)
+
+func waitFor(t *testing.T, changes <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a change to be noticed")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "block.list")
+	if err := ioutil.WriteFile(path, []byte("sub1.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan struct{}, 10)
+	w := filewatch.Watch(path, 10*time.Millisecond, func() { changes <- struct{}{} })
+	defer w.Close()
+
+	// written in place
+	if err := ioutil.WriteFile(path, []byte("sub1.example.com\nsub2.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, changes)
+
+	// written to a temporary file, which is renamed over the original
+	tmp := filepath.Join(dir, "block.list.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("sub3.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, changes)
+
+	select {
+	case <-changes:
+		t.Error("expected no change without writes")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -79,68 +79,99 @@ func (lm *GlobTrie) Insert(s string) error {
 }
 
 // Contains returns whether the GlobTrie contains the fqdn.
+//
+// Matching walks the trie from the TLD towards the leftmost label. At each node
+// an exact label match is tried first and, failing that, a `*` glob, which
+// consumes exactly one label. If a branch dead-ends, the matcher backtracks and
+// tries the next alternative. Once all labels are consumed, the current node
+// must contain a full stop (`!`) for the fqdn to match.
+//
+// Each trie node is reachable by at most one sequence of query labels, so a
+// single lookup visits every node at most once and always terminates.
 func (lm *GlobTrie) Contains(s string) bool {
+	_, ok := lm.Match(s)
+	return ok
+}
+
+// Match returns the inserted pattern that matches the fqdn, in canonical form
+// (e.g. `*.example.com.`). If several patterns match, the one found first by
+// the matching algorithm described for Contains wins; that is, exact labels
+// take precedence over globs, starting from the TLD.
+func (lm *GlobTrie) Match(s string) (string, bool) {
 	s = strings.ToLower(s)
 
 	if _, ok := dns.IsDomainName(s); !ok {
-		return false
+		return "", false
 	}
 
 	if strings.ContainsAny(s, "!*") {
-		return false
+		return "", false
 	}
 
 	labels := dns.SplitDomainName(s)
 	if len(labels) < 2 {
-		return false
+		return "", false
 	}
 
-	currNode := lm.root
-	var prevNode node
-	for i := len(labels) - 1; i >= 0; i-- {
-		label := labels[i]
-
-		// exact match
-		if nextNode, ok := currNode[label]; ok {
-			prevNode = currNode
-			currNode = nextNode
-			continue
-		}
+	return lm.root.match(labels)
+}
 
-		// check curr glob match
-		glob, hasGlob := currNode["*"]
-		if hasGlob {
-			prevNode = nil
-			currNode = glob
-			continue
-		}
+// match returns the pattern below n that matches labels, ordered as they
+// appear in a domain name. Labels are consumed from the right.
+func (n node) match(labels []string) (string, bool) {
+	if len(labels) < 1 {
+		// `!` means full stop:
+		//   - `com-->example-->!` means `example.com` and
+		//   - `com-->example-->www-->!` means `www.example.com`
+		// If there is no full stop record at this node in the trie, then there
+		// is no match. For example, if the trie contained only
+		// `com-->example-->www-->!`, then it would not match `example.com`. In
+		// order to match `example.com` and `www.example.com`, the node at
+		// `com-->example` would need to have both `!` and `www-->!` (or
+		// `*-->!`) subtries.
+		_, ok := n["!"]
+		return "", ok
+	}
 
-		// check prev glob match
+	last := len(labels) - 1
+	label, rest := labels[last], labels[:last]
 
-		if prevNode == nil {
-			return false // no previous node; no match
+	// exact match
+	if next, ok := n[label]; ok {
+		if pattern, ok := next.match(rest); ok {
+			return pattern + label + ".", true
 		}
+	}
 
-		glob, hasGlob = prevNode["*"]
-		if !hasGlob {
-			return false // no glob; no match
+	// glob match
+	if glob, ok := n["*"]; ok {
+		if pattern, ok := glob.match(rest); ok {
+			return pattern + "*.", true
 		}
-
-		prevNode = nil
-		currNode = glob
-		i++ // keep the label position
 	}
 
-	// `!` means full stop:
-	//   - `com-->example-->!` means `example.com` and
-	//   - `com-->example-->www-->!` means `www.example.com`
-	// If there is no full stop record at this node in the trie, then there is
-	// no match. For example, if the trie contained only
-	// `com-->example-->www-->!`, then it would not match `example.com`. In
-	// order to match `example.com` and `www.example.com`, the node at
-	// `com-->example` would need to have both `!` and `www-->!` (or `*-->!`)
-	// subtries.
-	_, ok := currNode["!"]
+	return "", false
+}
 
-	return ok
+// Patterns returns every inserted pattern in canonical form, e.g.
+// `*.example.com.`, in no particular order.
+func (lm *GlobTrie) Patterns() []string {
+	var patterns []string
+	lm.root.walk(nil, func(pattern string) {
+		patterns = append(patterns, pattern)
+	})
+	return patterns
+}
+
+// walk calls f with the pattern of every full stop below n. suffix holds the
+// labels on the path from the root to n, ordered as they appear in a domain
+// name.
+func (n node) walk(suffix []string, f func(pattern string)) {
+	for label, next := range n {
+		if label == "!" {
+			f(strings.Join(suffix, ".") + ".")
+			continue
+		}
+		next.walk(append([]string{label}, suffix...), f)
+	}
 }
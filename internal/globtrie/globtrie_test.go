@@ -4,6 +4,8 @@
 package globtrie_test
 
 import (
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/execjosh/mydns/internal/globtrie"
@@ -69,3 +71,118 @@ func TestContains(t *testing.T) {
 		t.Error("expected sub4.example.com to be contained")
 	}
 }
+
+func TestContainsBacktracking(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		fqdn     string
+		want     bool
+	}{
+		{"exact", []string{"www.example.com."}, "www.example.com.", true},
+		{"exact case-insensitive", []string{"www.example.com."}, "WWW.Example.COM.", true},
+		{"exact parent not matched", []string{"www.example.com."}, "example.com.", false},
+		{"exact child not matched", []string{"www.example.com."}, "a.www.example.com.", false},
+		{"glob single label", []string{"*.example.com."}, "a.example.com.", true},
+		{"glob does not match apex", []string{"*.example.com."}, "example.com.", false},
+		{"glob does not match two labels", []string{"*.example.com."}, "a.b.example.com.", false},
+		{"glob in middle", []string{"a.*.example.com."}, "a.b.example.com.", true},
+		{"glob in middle wrong leaf", []string{"a.*.example.com."}, "c.b.example.com.", false},
+		{"glob in middle too short", []string{"a.*.example.com."}, "a.example.com.", false},
+		{"consecutive globs", []string{"*.*.example.com."}, "a.b.example.com.", true},
+		{"consecutive globs too short", []string{"*.*.example.com."}, "a.example.com.", false},
+		{"consecutive globs too long", []string{"*.*.example.com."}, "a.b.c.example.com.", false},
+		{"globs at multiple depths", []string{"a.*.b.*.example.com."}, "a.x.b.y.example.com.", true},
+		{"globs at multiple depths mismatch", []string{"a.*.b.*.example.com."}, "a.x.c.y.example.com.", false},
+		{"glob tld", []string{"example.*."}, "example.org.", true},
+		{
+			name:     "exact prefix dead-ends before glob",
+			patterns: []string{"a.b.example.com.", "*.example.com."},
+			fqdn:     "b.example.com.",
+			want:     true,
+		},
+		{
+			name:     "backtrack to grandparent glob",
+			patterns: []string{"q.b.c.example.com.", "r.b.*.example.com."},
+			fqdn:     "r.b.c.example.com.",
+			want:     true,
+		},
+		{
+			name:     "backtrack to parent glob",
+			patterns: []string{"a.b.example.com.", "c.*.example.com."},
+			fqdn:     "c.b.example.com.",
+			want:     true,
+		},
+		{
+			name:     "backtrack exhausts all alternatives",
+			patterns: []string{"q.b.c.example.com.", "r.b.*.example.com.", "s.*.c.example.com."},
+			fqdn:     "t.b.c.example.com.",
+			want:     false,
+		},
+		{
+			name:     "glob and exact both present deep",
+			patterns: []string{"a.*.*.example.com.", "b.x.y.example.com."},
+			fqdn:     "a.x.y.example.com.",
+			want:     true,
+		},
+		{"query with glob is rejected", []string{"*.example.com."}, "*.example.com.", false},
+		{"query with full stop is rejected", []string{"*.example.com."}, "!.example.com.", false},
+		{"empty trie", nil, "example.com.", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lm := globtrie.New()
+			for _, p := range tt.patterns {
+				if err := lm.Insert(p); err != nil {
+					t.Fatalf("inserting %q: %v", p, err)
+				}
+			}
+
+			if got := lm.Contains(tt.fqdn); got != tt.want {
+				t.Errorf("Contains(%q) = %v; want %v", tt.fqdn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	lm := globtrie.New()
+	lm.Insert("*.example.com.")
+	lm.Insert("www.example.com.")
+	lm.Insert("a.*.example.com.")
+
+	tests := []struct {
+		fqdn        string
+		wantPattern string
+		wantOK      bool
+	}{
+		{"www.example.com.", "www.example.com.", true},
+		{"WWW.Example.com", "www.example.com.", true},
+		{"foo.example.com.", "*.example.com.", true},
+		{"a.www.example.com.", "a.*.example.com.", true},
+		{"b.www.example.com.", "", false},
+	}
+	for _, tt := range tests {
+		pattern, ok := lm.Match(tt.fqdn)
+		if pattern != tt.wantPattern || ok != tt.wantOK {
+			t.Errorf("Match(%q) = (%q, %v); want (%q, %v)", tt.fqdn, pattern, ok, tt.wantPattern, tt.wantOK)
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	lm := globtrie.New()
+	for _, s := range []string{"example.com.", "Sub1.example.com", "*.example.com.", "sub2.*.example.com.", "sub3.sub1.example.com.", "*.example.com."} {
+		if err := lm.Insert(s); err != nil {
+			t.Fatalf("Insert(%q): %v", s, err)
+		}
+	}
+
+	got := lm.Patterns()
+	sort.Strings(got)
+	want := []string{"*.example.com.", "example.com.", "sub1.example.com.", "sub2.*.example.com.", "sub3.sub1.example.com."}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package hosts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/execjosh/mydns/internal/globtrie"
+	"github.com/execjosh/mydns/internal/roundrobin"
+	"github.com/miekg/dns"
+)
+
+// Hosts represents a set of static records, mapping FQDNs to IPs. Names may
+// contain globs, e.g. `*.dev.local`, which match any single label. An exact
+// name takes precedence over a glob.
+//
+// The records themselves are immutable, but names with several IPs of the same
+// family rotate their order on every lookup to spread load across them.
+//
+// Exact names are also indexed by the reverse name of their IPs, i.e. under
+// in-addr.arpa or, in nibble format, ip6.arpa, to answer PTR queries.
+type Hosts struct {
+	exact   map[string]*record
+	glob    *globtrie.GlobTrie
+	globs   map[string]*record
+	reverse map[string][]string
+}
+
+type record struct {
+	v4 family
+	v6 family
+}
+
+type family struct {
+	ips []net.IP
+	rr  *roundrobin.RoundRobin // nil unless there are several IPs
+}
+
+func (f *family) add(ip net.IP) {
+	for _, x := range f.ips {
+		if x.Equal(ip) {
+			return
+		}
+	}
+	f.ips = append(f.ips, ip)
+}
+
+func (f *family) initRotation() {
+	if len(f.ips) < 2 {
+		return
+	}
+	ss := make([]string, len(f.ips))
+	for i, ip := range f.ips {
+		ss[i] = ip.String()
+	}
+	f.rr = roundrobin.New(ss)
+}
+
+// rotated returns the IPs, starting at the next one in turn.
+func (f *family) rotated() []net.IP {
+	if f.rr == nil {
+		return f.ips
+	}
+
+	first := f.rr.Next()
+	for i, ip := range f.ips {
+		if ip.String() == first {
+			ips := make([]net.IP, 0, len(f.ips))
+			return append(append(ips, f.ips[i:]...), f.ips[:i]...)
+		}
+	}
+	return f.ips
+}
+
+// Empty returns an empty Hosts.
+func Empty() *Hosts {
+	return &Hosts{
+		exact:   map[string]*record{},
+		glob:    globtrie.New(),
+		globs:   map[string]*record{},
+		reverse: map[string][]string{},
+	}
+}
+
+// Load loads static records in hosts file format from an io.Reader. Each line
+// holds an IP followed by one or more names; `#` starts a comment. It returns
+// the number of names loaded.
+func Load(r io.Reader) (*Hosts, uint, error) {
+	h := Empty()
+
+	var cnt uint
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		if idx := strings.IndexByte(l, '#'); idx >= 0 {
+			l = l[:idx]
+		}
+		fields := strings.Fields(l)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			log.Printf("invalid static record IP: %q", fields[0])
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			if err := h.insert(name, ip); err != nil {
+				log.Println(err)
+			} else {
+				cnt++
+			}
+		}
+	}
+	for _, records := range []map[string]*record{h.exact, h.globs} {
+		for _, rec := range records {
+			rec.v4.initRotation()
+			rec.v6.initRotation()
+		}
+	}
+	if err := s.Err(); err != nil {
+		return h, cnt, fmt.Errorf("loading static records: %w", err)
+	}
+
+	return h, cnt, nil
+}
+
+func (h *Hosts) insert(name string, ip net.IP) error {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid static record name: %q", name)
+	}
+	name = dns.CanonicalName(name)
+
+	records := h.exact
+	if strings.Contains(name, "*") {
+		if err := h.glob.Insert(name); err != nil {
+			return fmt.Errorf("invalid static record name %q: %w", name, err)
+		}
+		records = h.globs
+	} else {
+		h.insertReverse(name, ip)
+	}
+
+	rec, ok := records[name]
+	if !ok {
+		rec = &record{}
+		records[name] = rec
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		rec.v4.add(ip4)
+	} else {
+		rec.v6.add(ip)
+	}
+	return nil
+}
+
+// insertReverse indexes name under the reverse name of ip. Globs cannot be
+// reversed, so they are never indexed.
+func (h *Hosts) insertReverse(name string, ip net.IP) {
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return
+	}
+	for _, n := range h.reverse[arpa] {
+		if n == name {
+			return
+		}
+	}
+	h.reverse[arpa] = append(h.reverse[arpa], name)
+}
+
+// LookupPTR returns the names with an IP whose reverse name, e.g.
+// 1.2.0.192.in-addr.arpa., is fqdn, in the order they were loaded.
+func (h *Hosts) LookupPTR(fqdn string) ([]string, bool) {
+	names, ok := h.reverse[dns.CanonicalName(fqdn)]
+	return names, ok
+}
+
+// Lookup returns the IPs of fqdn for qtype, which is either A or AAAA, in
+// rotated order. An exact record takes precedence over a matching glob. If
+// fqdn has records, but none for qtype, the result is empty, but ok.
+func (h *Hosts) Lookup(fqdn string, qtype uint16) ([]net.IP, bool) {
+	fqdn = dns.CanonicalName(fqdn)
+
+	rec, ok := h.exact[fqdn]
+	if !ok {
+		pattern, matched := h.glob.Match(fqdn)
+		if !matched {
+			return nil, false
+		}
+		rec = h.globs[pattern]
+	}
+
+	switch qtype {
+	case dns.TypeA:
+		return rec.v4.rotated(), true
+	case dns.TypeAAAA:
+		return rec.v6.rotated(), true
+	}
+	return nil, true
+}
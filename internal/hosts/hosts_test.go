@@ -0,0 +1,133 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package hosts_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/hosts"
+	"github.com/miekg/dns"
+)
+
+func TestLookup(t *testing.T) {
+	h, cnt, err := hosts.Load(strings.NewReader(strings.Join([]string{
+		"# development",
+		"127.0.0.1 *.dev.local",
+		"192.0.2.10 api.dev.local # pinned",
+		"192.0.2.11 db.dev.local db2.dev.local",
+		"::1        *.dev.local",
+		"not-an-ip  broken.dev.local",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 5 {
+		t.Errorf("expected 5 names; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn   string
+		want   []string
+		wantOK bool
+	}{
+		{"api.dev.local.", []string{"192.0.2.10"}, true},
+		{"API.Dev.Local.", []string{"192.0.2.10"}, true},
+		{"db2.dev.local.", []string{"192.0.2.11"}, true},
+		{"web.dev.local.", []string{"127.0.0.1", "::1"}, true},
+		{"a.web.dev.local.", nil, false},
+		{"dev.local.", nil, false},
+		{"broken.dev.local.", []string{"127.0.0.1", "::1"}, true},
+	}
+	for _, tt := range tests {
+		ips, ok := h.Lookup(tt.fqdn, dns.TypeA)
+		ips6, ok6 := h.Lookup(tt.fqdn, dns.TypeAAAA)
+		if ok != tt.wantOK || ok6 != tt.wantOK {
+			t.Errorf("Lookup(%q): expected ok to be %v", tt.fqdn, tt.wantOK)
+			continue
+		}
+		ips = append(ips, ips6...)
+		assertIPs(t, ips, tt.want...)
+	}
+}
+
+func TestLookupPTR(t *testing.T) {
+	h, _, err := hosts.Load(strings.NewReader(strings.Join([]string{
+		"192.0.2.10  api.dev.local api2.dev.local",
+		"2001:db8::1 api.dev.local",
+		"2001:db8:0:0:0:0:0:1 API.dev.local",
+		"fe80::a:bc:def:1234 link.dev.local",
+		"127.0.0.1   *.dev.local",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		fqdn   string
+		want   []string
+		wantOK bool
+	}{
+		{"10.2.0.192.in-addr.arpa.", []string{"api.dev.local.", "api2.dev.local."}, true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", []string{"api.dev.local."}, true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.IP6.ARPA.", []string{"api.dev.local."}, true},
+		{"4.3.2.1.f.e.d.0.c.b.0.0.a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.", []string{"link.dev.local."}, true},
+		{"1.0.0.127.in-addr.arpa.", nil, false},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", nil, false},
+	}
+	for _, tt := range tests {
+		names, ok := h.LookupPTR(tt.fqdn)
+		if ok != tt.wantOK || strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("LookupPTR(%q) = %v, %v; want %v, %v", tt.fqdn, names, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func assertIPs(t *testing.T, ips []net.IP, want ...string) {
+	t.Helper()
+
+	if len(ips) != len(want) {
+		t.Errorf("got %v; want %v", ips, want)
+		return
+	}
+	for i, ip := range ips {
+		if !ip.Equal(net.ParseIP(want[i])) {
+			t.Errorf("got %v; want %v", ips, want)
+			return
+		}
+	}
+}
+
+func TestLookupRotation(t *testing.T) {
+	h, _, err := hosts.Load(strings.NewReader(strings.Join([]string{
+		"192.0.2.1 lb.dev.local",
+		"192.0.2.2 lb.dev.local",
+		"192.0.2.3 lb.dev.local",
+		"::1       lb.dev.local",
+		"192.0.2.9 single.dev.local",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range [][]string{
+		{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		{"192.0.2.2", "192.0.2.3", "192.0.2.1"},
+		{"192.0.2.3", "192.0.2.1", "192.0.2.2"},
+		{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+	} {
+		ips, _ := h.Lookup("lb.dev.local.", dns.TypeA)
+		assertIPs(t, ips, want...)
+
+		// AAAA lookups must not disturb the rotation of A records
+		ips, _ = h.Lookup("lb.dev.local.", dns.TypeAAAA)
+		assertIPs(t, ips, "::1")
+	}
+
+	for i := 0; i < 2; i++ {
+		ips, _ := h.Lookup("single.dev.local.", dns.TypeA)
+		assertIPs(t, ips, "192.0.2.9")
+	}
+}
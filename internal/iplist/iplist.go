@@ -8,10 +8,14 @@ import (
 	"fmt"
 	"net"
 	"strings"
+
+	"github.com/execjosh/mydns/internal/upstream"
+	"github.com/miekg/dns"
 )
 
-// IPList represents a comma-separated list of IP addresses to be used with the
-// `flag` package.
+// IPList represents a comma-separated list of upstream nameservers, i.e. IP
+// addresses or specs as accepted by upstream.Parse, to be used with the `flag`
+// package.
 type IPList struct {
 	values []string
 }
@@ -39,13 +43,15 @@ func (l *IPList) Set(s string) error {
 	ss := strings.Split(s, ",")
 
 	seen := map[string]struct{}{}
-	for _, ipStr := range ss {
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			return fmt.Errorf("invalid nameserver IP: %q", ipStr)
+	for _, spec := range ss {
+		if _, err := upstream.Parse(spec); err != nil {
+			return err
 		}
 
-		addr := ip.String()
+		addr := spec
+		if ip := net.ParseIP(spec); ip != nil {
+			addr = ip.String()
+		}
 		if _, ok := seen[addr]; ok {
 			continue
 		}
@@ -70,3 +76,23 @@ func (l *IPList) Uniq() []string {
 	}
 	return uniq
 }
+
+// LoadResolvConf appends the nameservers of a resolv.conf(5) file, e.g.
+// /etc/resolv.conf, to the list. Nameservers that are not valid upstreams,
+// such as link-local IPv6 addresses with a zone, are skipped. Duplicates are
+// removed by Uniq as usual. It returns the number of nameservers read.
+func (l *IPList) LoadResolvConf(path string) (int, error) {
+	cfg, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("reading nameservers: %w", err)
+	}
+
+	var cnt int
+	for _, ns := range cfg.Servers {
+		if err := l.Set(ns); err != nil {
+			continue
+		}
+		cnt++
+	}
+	return cnt, nil
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package iplist_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/iplist"
+)
+
+func TestLoadResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := `# generated
+nameserver 192.0.2.1
+nameserver 2001:db8::1
+nameserver fe80::1%eth0
+nameserver 192.0.2.2
+search example.com
+options ndots:2
+`
+	if err := ioutil.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := iplist.New()
+	if err := l.Set("192.0.2.2,tls://192.0.2.3#dns.example"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := l.LoadResolvConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 nameservers read, got %d", n)
+	}
+
+	want := []string{"192.0.2.2", "tls://192.0.2.3#dns.example", "192.0.2.1", "2001:db8::1"}
+	if got := l.Uniq(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLoadResolvConfMissing(t *testing.T) {
+	l := iplist.New()
+	if _, err := l.LoadResolvConf(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
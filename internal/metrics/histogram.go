@@ -0,0 +1,92 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+)
+
+// Histogram counts observations into buckets with fixed upper bounds. Like a
+// Prometheus histogram, each bucket also counts the observations of the
+// buckets below it. It implements expvar.Var, and is published as JSON, e.g.
+// `{"buckets":{"512":3,"1232":5,"+Inf":6},"count":6,"sum":4711}`.
+type Histogram struct {
+	bounds []int64
+
+	mu     sync.Mutex
+	counts []int64 // per bucket, not cumulative; the last one is +Inf
+	sum    int64
+}
+
+var _ expvar.Var = (*Histogram)(nil)
+
+// NewHistogram returns an empty Histogram with the given upper bounds, which
+// must be in increasing order.
+func NewHistogram(bounds ...int64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v int64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// Count returns the number of observations less than or equal to bound, or of
+// all observations if bound is not one of the upper bounds.
+func (h *Histogram) Count(bound int64) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var n int64
+	for i, c := range h.counts {
+		n += c
+		if i < len(h.bounds) && h.bounds[i] == bound {
+			break
+		}
+	}
+	return n
+}
+
+// String implements expvar.Var.
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// written by hand, as encoding/json would sort the buckets as strings
+	buf := []byte(`{"buckets":{`)
+	var n int64
+	for i, c := range h.counts {
+		n += c
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		bound := "+Inf"
+		if i < len(h.bounds) {
+			bound = strconv.FormatInt(h.bounds[i], 10)
+		}
+		buf = append(buf, '"')
+		buf = append(buf, bound...)
+		buf = append(buf, '"', ':')
+		buf = strconv.AppendInt(buf, n, 10)
+	}
+	buf = append(buf, `},"count":`...)
+	buf = strconv.AppendInt(buf, n, 10)
+	buf = append(buf, `,"sum":`...)
+	buf = strconv.AppendInt(buf, h.sum, 10)
+	buf = append(buf, '}')
+	return string(buf)
+}
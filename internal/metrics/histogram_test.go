@@ -0,0 +1,37 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/execjosh/mydns/internal/metrics"
+)
+
+func TestHistogram(t *testing.T) {
+	h := metrics.NewHistogram(512, 1232, 4096)
+	for _, v := range []int64{100, 512, 513, 1232, 2000, 9000} {
+		h.Observe(v)
+	}
+
+	tests := []struct {
+		bound int64
+		want  int64
+	}{
+		{512, 2},
+		{1232, 4},
+		{4096, 5},
+		{-1, 6}, // not a bound, i.e. all
+	}
+	for _, tt := range tests {
+		if got := h.Count(tt.bound); got != tt.want {
+			t.Errorf("Count(%d) = %d; want %d", tt.bound, got, tt.want)
+		}
+	}
+
+	want := `{"buckets":{"512":2,"1232":4,"4096":5,"+Inf":6},"count":6,"sum":13357}`
+	if got := h.String(); got != want {
+		t.Errorf("expected %s; got %s", want, got)
+	}
+}
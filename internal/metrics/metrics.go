@@ -0,0 +1,96 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package metrics defines the process-wide metrics of mydns. They are published
+// via the standard `expvar` package.
+package metrics
+
+import "expvar"
+
+var (
+	// UpstreamInFlight is the number of upstream exchanges currently in
+	// flight.
+	UpstreamInFlight = expvar.NewInt("mydns_upstream_inflight")
+
+	// UpstreamRejected counts upstream exchanges rejected because the
+	// concurrency limit was reached.
+	UpstreamRejected = expvar.NewInt("mydns_upstream_rejected_total")
+
+	// CoalescedQueries counts upstream queries that were not sent, but
+	// answered with the response of an identical query already in flight.
+	// CoalescingInFlight is the number of distinct upstream queries
+	// currently in flight that others may join.
+	CoalescedQueries   = expvar.NewInt("mydns_coalesced_queries_total")
+	CoalescingInFlight = expvar.NewInt("mydns_coalescing_inflight_keys")
+
+	// UpstreamFallbacks counts upstream queries that failed against the
+	// rotating nameservers and fell back to the nameserver of last resort.
+	UpstreamFallbacks = expvar.NewInt("mydns_upstream_fallbacks_total")
+
+	// FallbackRecordAnswers counts queries answered with fallback records
+	// because upstream failed them.
+	FallbackRecordAnswers = expvar.NewInt("mydns_fallback_record_answers_total")
+
+	// UpstreamConnsCreated and UpstreamConnsReused count the connections
+	// dialed to upstream nameservers by connection pools, and the queries
+	// sent over pooled connections, respectively.
+	UpstreamConnsCreated = expvar.NewInt("mydns_upstream_conns_created_total")
+	UpstreamConnsReused  = expvar.NewInt("mydns_upstream_conns_reused_total")
+
+	// UpstreamRcodeRetries counts upstream queries retried against the next
+	// nameserver because of the rcode they were answered with, e.g. SERVFAIL.
+	UpstreamRcodeRetries = expvar.NewInt("mydns_upstream_rcode_retries_total")
+
+	// TCPConnsAccepted and TCPConnsRejected count the TCP and DoT client
+	// connections accepted within the connection limit, and those closed
+	// right away because it was reached, respectively. Without a limit,
+	// neither is counted.
+	TCPConnsAccepted = expvar.NewInt("mydns_tcp_conns_accepted_total")
+	TCPConnsRejected = expvar.NewInt("mydns_tcp_conns_rejected_total")
+
+	// SpoofedResponses counts upstream responses rejected because their ID
+	// or question did not match the query sent.
+	SpoofedResponses = expvar.NewInt("mydns_spoofed_responses_total")
+
+	// CaseMismatches counts upstream responses whose question name differs
+	// in case from the query sent. They are accepted.
+	CaseMismatches = expvar.NewInt("mydns_case_mismatch_total")
+
+	// OversizedQueries counts queries refused because their name was too
+	// long or had too many labels.
+	OversizedQueries = expvar.NewInt("mydns_oversized_queries_total")
+
+	// UnsupportedOpcodes counts messages refused because their opcode was
+	// not QUERY, e.g. UPDATE or NOTIFY.
+	UnsupportedOpcodes = expvar.NewInt("mydns_unsupported_opcodes_total")
+
+	// ResponseBytes holds histograms of the sizes of the responses written
+	// to clients, in bytes, by transport (`udp`, `tcp`, or `tls`), with
+	// `_truncated` appended for truncated ones, e.g. `udp_truncated`.
+	ResponseBytes = newResponseBytes()
+)
+
+// responseSizeBounds are the upper bounds of the ResponseBytes buckets. They
+// cover the common EDNS0 buffer sizes, e.g. 1232 and 4096.
+var responseSizeBounds = []int64{128, 256, 512, 1024, 1232, 1452, 2048, 4096, 8192, 16384, 65535}
+
+func newResponseBytes() *expvar.Map {
+	m := expvar.NewMap("mydns_response_bytes")
+	for _, transport := range []string{"udp", "tcp", "tls"} {
+		m.Set(transport, NewHistogram(responseSizeBounds...))
+		m.Set(transport+"_truncated", NewHistogram(responseSizeBounds...))
+	}
+	return m
+}
+
+// ObserveResponseBytes records the size of a response written over transport,
+// which is one of `udp`, `tcp`, or `tls`.
+func ObserveResponseBytes(transport string, truncated bool, size int) {
+	key := transport
+	if truncated {
+		key += "_truncated"
+	}
+	if h, ok := ResponseBytes.Get(key).(*Histogram); ok {
+		h.Observe(int64(size))
+	}
+}
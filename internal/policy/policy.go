@@ -0,0 +1,143 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Action is what to do with a query matching a rule.
+type Action int
+
+// The possible actions.
+const (
+	Allow Action = iota
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Block:
+		return "block"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+type rule struct {
+	action  Action
+	labels  []string
+	clients *net.IPNet // nil matches any client
+}
+
+// Policy represents an immutable, ordered list of allow and block rules that
+// is evaluated like a firewall: the first matching rule decides.
+type Policy struct {
+	rules []rule
+}
+
+// Load loads a policy from an io.Reader. Each line holds an action (`allow` or
+// `block`) followed by a domain name pattern, which may contain `*` globs that
+// match exactly one label, and optionally a client range in CIDR notation, e.g.
+// `192.0.2.0/24`, that limits the rule to clients within it. `#` starts a
+// comment. It returns the number of rules loaded.
+func Load(r io.Reader) (*Policy, uint, error) {
+	p := &Policy{}
+
+	s := bufio.NewScanner(r)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		l := s.Text()
+		if idx := strings.IndexByte(l, '#'); idx >= 0 {
+			l = l[:idx]
+		}
+		fields := strings.Fields(l)
+		if len(fields) < 1 {
+			continue
+		}
+
+		rule, err := parseRule(fields)
+		if err != nil {
+			log.Printf("policy line %d: %v", lineNo, err)
+			continue
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return p, uint(len(p.rules)), fmt.Errorf("loading policy: %w", err)
+	}
+
+	return p, uint(len(p.rules)), nil
+}
+
+func parseRule(fields []string) (rule, error) {
+	if len(fields) != 2 && len(fields) != 3 {
+		return rule{}, fmt.Errorf("expected `allow|block <pattern> [<client-cidr>]`; got %q", strings.Join(fields, " "))
+	}
+
+	var action Action
+	switch fields[0] {
+	case "allow":
+		action = Allow
+	case "block":
+		action = Block
+	default:
+		return rule{}, fmt.Errorf("unknown action: %q", fields[0])
+	}
+
+	pattern := fields[1]
+	if _, ok := dns.IsDomainName(pattern); !ok {
+		return rule{}, fmt.Errorf("invalid pattern: %q", pattern)
+	}
+
+	var clients *net.IPNet
+	if len(fields) == 3 {
+		_, n, err := net.ParseCIDR(fields[2])
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid client CIDR: %q", fields[2])
+		}
+		clients = n
+	}
+
+	return rule{
+		action:  action,
+		labels:  dns.SplitDomainName(dns.CanonicalName(pattern)),
+		clients: clients,
+	}, nil
+}
+
+// Decide returns the action of the first rule matching fqdn queried by client.
+// Rules limited to a client range never match a nil client. If no rule
+// matches, matched is false.
+func (p *Policy) Decide(fqdn string, client net.IP) (action Action, matched bool) {
+	labels := dns.SplitDomainName(dns.CanonicalName(fqdn))
+	for _, r := range p.rules {
+		if r.match(labels, client) {
+			return r.action, true
+		}
+	}
+	return Allow, false
+}
+
+func (r rule) match(labels []string, client net.IP) bool {
+	if r.clients != nil && (client == nil || !r.clients.Contains(client)) {
+		return false
+	}
+	if len(labels) != len(r.labels) {
+		return false
+	}
+	for i, l := range r.labels {
+		if l != "*" && l != labels[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package policy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/policy"
+)
+
+func TestDecide(t *testing.T) {
+	p, cnt, err := policy.Load(strings.NewReader(strings.Join([]string{
+		"# first match wins",
+		"allow www.example.com",
+		"block *.example.com",
+		"allow ads.example.com # never reached",
+		"block ads.*.example.org",
+		"deny typo.example.net",
+		"allow",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 4 {
+		t.Errorf("expected 4 rules; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn        string
+		wantAction  policy.Action
+		wantMatched bool
+	}{
+		{"www.example.com.", policy.Allow, true},
+		{"WWW.EXAMPLE.COM", policy.Allow, true},
+		{"ads.example.com.", policy.Block, true},
+		{"example.com.", policy.Allow, false},
+		{"a.b.example.com.", policy.Allow, false},
+		{"ads.eu.example.org.", policy.Block, true},
+		{"ads.example.org.", policy.Allow, false},
+		{"typo.example.net.", policy.Allow, false},
+	}
+	for _, tt := range tests {
+		action, matched := p.Decide(tt.fqdn, net.ParseIP("192.0.2.1"))
+		if action != tt.wantAction || matched != tt.wantMatched {
+			t.Errorf("Decide(%q) = (%v, %v); want (%v, %v)", tt.fqdn, action, matched, tt.wantAction, tt.wantMatched)
+		}
+	}
+}
+
+func TestDecideClient(t *testing.T) {
+	p, cnt, err := policy.Load(strings.NewReader(strings.Join([]string{
+		"block social.example.com 192.0.2.0/28",
+		"block *.example.com 2001:db8::/32",
+		"allow social.example.com",
+		"block other.example.com 192.0.2.300/28",
+		"block other.example.com 192.0.2.0/28 extra",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 rules; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn        string
+		client      net.IP
+		wantAction  policy.Action
+		wantMatched bool
+	}{
+		{"social.example.com.", net.ParseIP("192.0.2.1"), policy.Block, true},
+		{"social.example.com.", net.ParseIP("192.0.2.16"), policy.Allow, true},
+		{"social.example.com.", net.ParseIP("2001:db8::1"), policy.Block, true},
+		{"social.example.com.", nil, policy.Allow, true},
+		{"other.example.com.", net.ParseIP("2001:db8::1"), policy.Block, true},
+		{"other.example.com.", net.ParseIP("192.0.2.1"), policy.Allow, false},
+	}
+	for _, tt := range tests {
+		action, matched := p.Decide(tt.fqdn, tt.client)
+		if action != tt.wantAction || matched != tt.wantMatched {
+			t.Errorf("Decide(%q, %v) = (%v, %v); want (%v, %v)", tt.fqdn, tt.client, action, matched, tt.wantAction, tt.wantMatched)
+		}
+	}
+}
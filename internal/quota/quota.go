@@ -0,0 +1,139 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package quota enforces hard query quotas per client IP.
+package quota
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/execjosh/mydns/internal/clock"
+)
+
+// Quota allows each client IP a fixed number of queries per fixed window. A
+// client's window starts with its first query; once it has elapsed, the count
+// starts over. Clients whose window has elapsed are reclaimed by Prune.
+type Quota struct {
+	limit  uint64
+	window time.Duration
+	clock  clock.Clock
+
+	mu      sync.Mutex
+	clients map[string]*usage
+}
+
+type usage struct {
+	start time.Time
+	count uint64
+}
+
+// Option configures a Quota.
+type Option func(*Quota)
+
+// WithClock makes the quota use c instead of the real clock to track windows,
+// e.g. for testing.
+func WithClock(c clock.Clock) Option {
+	return func(q *Quota) {
+		q.clock = c
+	}
+}
+
+// New returns a Quota allowing limit queries per window per client.
+func New(limit uint64, window time.Duration, opts ...Option) *Quota {
+	q := &Quota{
+		limit:   limit,
+		window:  window,
+		clock:   clock.Real,
+		clients: map[string]*usage{},
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// Parse parses a quota of the form `<limit>/<window>`, e.g. `10000/24h`.
+func Parse(s string) (limit uint64, window time.Duration, err error) {
+	idx := strings.IndexByte(s, '/')
+	if idx < 0 {
+		return 0, 0, fmt.Errorf("invalid quota %q: expected <limit>/<window>", s)
+	}
+	limit, err = strconv.ParseUint(s[:idx], 10, 64)
+	if err != nil || limit < 1 {
+		return 0, 0, fmt.Errorf("invalid quota limit: %q", s[:idx])
+	}
+	window, err = time.ParseDuration(s[idx+1:])
+	if err != nil || window <= 0 {
+		return 0, 0, fmt.Errorf("invalid quota window: %q", s[idx+1:])
+	}
+	return limit, window, nil
+}
+
+// Limit returns the number of queries allowed per window.
+func (q *Quota) Limit() uint64 {
+	return q.limit
+}
+
+// Allow counts a query of ip and reports whether it is within the quota.
+// Queries over the quota are not counted.
+func (q *Quota) Allow(ip net.IP) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.current(ip.String())
+	if u.count >= q.limit {
+		return false
+	}
+	u.count++
+	return true
+}
+
+// Remaining returns the number of queries ip has left in its current window,
+// and when the window resets. A client without queries in the current window
+// has the full limit left and a zero reset time.
+func (q *Quota) Remaining(ip net.IP) (remaining uint64, reset time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.clients[ip.String()]
+	if !ok || q.expired(u) {
+		return q.limit, time.Time{}
+	}
+	return q.limit - u.count, u.start.Add(q.window)
+}
+
+// Prune frees the clients whose window has elapsed. It returns the number of
+// clients freed.
+func (q *Quota) Prune() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var n int
+	for ip, u := range q.clients {
+		if q.expired(u) {
+			delete(q.clients, ip)
+			n++
+		}
+	}
+	return n
+}
+
+// current returns the usage of ip in its current window, starting a new one if
+// needed. q.mu must be held.
+func (q *Quota) current(ip string) *usage {
+	u, ok := q.clients[ip]
+	if !ok || q.expired(u) {
+		u = &usage{start: q.clock.Now()}
+		q.clients[ip] = u
+	}
+	return u
+}
+
+func (q *Quota) expired(u *usage) bool {
+	return !q.clock.Now().Before(u.start.Add(q.window))
+}
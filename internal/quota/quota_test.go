@@ -0,0 +1,87 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package quota_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/clock"
+	"github.com/execjosh/mydns/internal/quota"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in         string
+		wantLimit  uint64
+		wantWindow time.Duration
+		wantErr    bool
+	}{
+		{"10000/24h", 10000, 24 * time.Hour, false},
+		{"50/1m", 50, time.Minute, false},
+		{"10000", 0, 0, true},
+		{"0/1h", 0, 0, true},
+		{"ten/1h", 0, 0, true},
+		{"10/0s", 0, 0, true},
+		{"10/day", 0, 0, true},
+	}
+	for _, tt := range tests {
+		limit, window, err := quota.Parse(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v; got %v", tt.in, tt.wantErr, err)
+			continue
+		}
+		if limit != tt.wantLimit || window != tt.wantWindow {
+			t.Errorf("%q: expected %d/%s; got %d/%s", tt.in, tt.wantLimit, tt.wantWindow, limit, window)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	c := clock.NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := quota.New(2, time.Hour, quota.WithClock(c))
+
+	guest := net.ParseIP("192.0.2.10")
+	other := net.ParseIP("192.0.2.11")
+
+	for i, want := range []bool{true, true, false} {
+		if got := q.Allow(guest); got != want {
+			t.Errorf("query %d: expected %v; got %v", i+1, want, got)
+		}
+	}
+	if !q.Allow(other) {
+		t.Error("expected other client to have its own quota")
+	}
+
+	remaining, reset := q.Remaining(guest)
+	if remaining != 0 || !reset.Equal(c.Now().Add(time.Hour)) {
+		t.Errorf("expected 0 remaining until %s; got %d until %s", c.Now().Add(time.Hour), remaining, reset)
+	}
+
+	c.Advance(time.Hour)
+	if remaining, _ := q.Remaining(guest); remaining != 2 {
+		t.Errorf("expected quota to reset after the window; got %d remaining", remaining)
+	}
+	if !q.Allow(guest) {
+		t.Error("expected query to be allowed in the new window")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	c := clock.NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	q := quota.New(10, time.Hour, quota.WithClock(c))
+
+	q.Allow(net.ParseIP("192.0.2.10"))
+	c.Advance(30 * time.Minute)
+	q.Allow(net.ParseIP("192.0.2.11"))
+
+	if n := q.Prune(); n != 0 {
+		t.Errorf("expected nothing to be pruned; got %d", n)
+	}
+	c.Advance(30 * time.Minute)
+	if n := q.Prune(); n != 1 {
+		t.Errorf("expected 1 idle client to be pruned; got %d", n)
+	}
+}
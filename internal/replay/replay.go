@@ -0,0 +1,150 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Query is a query recovered from JSON logs, along with whether it was
+// blocked.
+type Query struct {
+	FQDN    string
+	Qtype   uint16
+	Blocked bool
+}
+
+type entry struct {
+	Msg   string `json:"msg"`
+	ID    string `json:"request.ID"`
+	FQDN  string `json:"query.fqdn"`
+	Qtype string `json:"query.type"`
+}
+
+// Read recovers queries from JSON logs, as written with -log-json, in the
+// order they were first logged. Entries of one query share a request ID; a
+// `block` entry marks it as blocked. Lines that are not JSON, and entries that
+// do not belong to a query, are skipped. Queries logged without their type are
+// assumed to be A queries.
+func Read(r io.Reader) ([]Query, error) {
+	var queries []Query
+	byID := map[string]int{}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		var e entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil || len(e.ID) < 1 || len(e.FQDN) < 1 {
+			continue
+		}
+
+		idx, ok := byID[e.ID]
+		if !ok {
+			qtype, ok := dns.StringToType[e.Qtype]
+			if !ok {
+				qtype = dns.TypeA
+			}
+			idx = len(queries)
+			byID[e.ID] = idx
+			queries = append(queries, Query{FQDN: e.FQDN, Qtype: qtype})
+		}
+		if e.Msg == "block" {
+			queries[idx].Blocked = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return queries, fmt.Errorf("reading logs: %w", err)
+	}
+
+	return queries, nil
+}
+
+// Change is a name whose outcome changed on replay.
+type Change struct {
+	FQDN    string
+	Qtype   uint16
+	Blocked bool // whether it is blocked now
+	Count   int  // how many logged queries changed
+}
+
+// Recorder is the block reporter of the handler being replayed against, which
+// records whether the current query was blocked.
+type Recorder struct {
+	blocked bool
+}
+
+// ReportBlock implements the block reporter interface.
+func (r *Recorder) ReportBlock(string, string, string, net.IP) error {
+	r.blocked = true
+	return nil
+}
+
+// Exchanger answers every query with NOERROR and no records, so that replayed
+// queries are only blocked by name.
+type Exchanger struct{}
+
+// Exchange implements the exchanger interface.
+func (Exchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetReply(m)
+	return res, 0, nil
+}
+
+type responseWriter struct {
+	dns.ResponseWriter
+}
+
+func (responseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (responseWriter) WriteMsg(*dns.Msg) error {
+	return nil
+}
+
+// Run replays queries through h, which must report blocks to rec, one at a
+// time. It returns the names whose outcome changed, newly blocked ones first,
+// each sorted by name.
+func Run(h dns.Handler, rec *Recorder, queries []Query) []Change {
+	type key struct {
+		fqdn    string
+		qtype   uint16
+		blocked bool
+	}
+	changed := map[key]int{}
+	for _, q := range queries {
+		req := &dns.Msg{}
+		req.SetQuestion(dns.Fqdn(q.FQDN), q.Qtype)
+
+		rec.blocked = false
+		h.ServeDNS(responseWriter{}, req)
+		if rec.blocked != q.Blocked {
+			changed[key{q.FQDN, q.Qtype, rec.blocked}]++
+		}
+	}
+
+	changes := make([]Change, 0, len(changed))
+	for k, cnt := range changed {
+		changes = append(changes, Change{FQDN: k.fqdn, Qtype: k.qtype, Blocked: k.blocked, Count: cnt})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Blocked != b.Blocked {
+			return a.Blocked
+		}
+		if a.FQDN != b.FQDN {
+			return a.FQDN < b.FQDN
+		}
+		return a.Qtype < b.Qtype
+	})
+	return changes
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package replay_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/dnsqueryhandler"
+	"github.com/execjosh/mydns/internal/replay"
+	"github.com/execjosh/mydns/internal/roundrobin"
+	"github.com/execjosh/mydns/internal/stringset"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const logs = `{"level":"INFO","msg":"upstream servers","nameservers":["192.0.2.1:53"]}
+{"level":"INFO","msg":"answer","request.ID":"1","query.fqdn":"www.example.com.","query.type":"A"}
+{"level":"INFO","msg":"block","request.ID":"2","query.fqdn":"ads.example.com.","query.type":"AAAA"}
+2021-03-01T12:00:00.000Z	INFO	not json
+{"level":"INFO","msg":"answer","request.ID":"3","query.fqdn":"tracker.example.net."}
+{"level":"INFO","msg":"answer","request.ID":"4","query.fqdn":"tracker.example.net.","query.type":"A"}
+{"level":"INFO","msg":"block","request.ID":"5","query.fqdn":"cdn.example.org.","query.type":"A"}
+`
+
+func TestRead(t *testing.T) {
+	queries, err := replay.Read(strings.NewReader(logs))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []replay.Query{
+		{FQDN: "www.example.com.", Qtype: dns.TypeA},
+		{FQDN: "ads.example.com.", Qtype: dns.TypeAAAA, Blocked: true},
+		{FQDN: "tracker.example.net.", Qtype: dns.TypeA},
+		{FQDN: "tracker.example.net.", Qtype: dns.TypeA},
+		{FQDN: "cdn.example.org.", Qtype: dns.TypeA, Blocked: true},
+	}
+	if !reflect.DeepEqual(queries, want) {
+		t.Errorf("expected %v; got %v", want, queries)
+	}
+}
+
+func TestRun(t *testing.T) {
+	queries, err := replay.Read(strings.NewReader(logs))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bl := stringset.New()
+	bl.Insert("ads.example.com.")
+	bl.Insert("tracker.example.net.")
+
+	rec := &replay.Recorder{}
+	h := dnsqueryhandler.New(
+		zap.NewNop(),
+		replay.Exchanger{},
+		roundrobin.New([]string{"replay"}),
+		bl,
+		dnsqueryhandler.WithBlockReporter(rec),
+	)
+
+	want := []replay.Change{
+		{FQDN: "tracker.example.net.", Qtype: dns.TypeA, Blocked: true, Count: 2},
+		{FQDN: "cdn.example.org.", Qtype: dns.TypeA, Blocked: false, Count: 1},
+	}
+	if got := replay.Run(dns.HandlerFunc(h.HandleAandAAAA), rec, queries); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+}
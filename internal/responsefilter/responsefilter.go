@@ -0,0 +1,80 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package responsefilter
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// StripTypes removes records of its types from the answer and authority
+// sections of responses.
+type StripTypes map[uint16]struct{}
+
+// NewStripTypes returns a StripTypes removing records of qtypes.
+func NewStripTypes(qtypes ...uint16) StripTypes {
+	f := StripTypes{}
+	for _, qtype := range qtypes {
+		f[qtype] = struct{}{}
+	}
+	return f
+}
+
+// Filter implements the response filter interface.
+func (f StripTypes) Filter(_ dns.Question, res *dns.Msg) *dns.Msg {
+	res.Answer = f.strip(res.Answer)
+	res.Ns = f.strip(res.Ns)
+	return res
+}
+
+func (f StripTypes) strip(rrs []dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if _, ok := f[rr.Header().Rrtype]; !ok {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// RewriteIPs replaces IPs in A and AAAA answers, e.g. to answer with the
+// internal IPs of hosts behind NAT (split-horizon).
+type RewriteIPs map[string]net.IP
+
+// NewRewriteIPs returns a RewriteIPs for rewrites, which maps IPs to their
+// replacements. Both must be of the same family.
+func NewRewriteIPs(rewrites map[string]string) (RewriteIPs, error) {
+	f := RewriteIPs{}
+	for from, to := range rewrites {
+		fromIP := net.ParseIP(from)
+		toIP := net.ParseIP(to)
+		if fromIP == nil || toIP == nil {
+			return nil, fmt.Errorf("invalid IP rewrite: %q to %q", from, to)
+		}
+		if (fromIP.To4() == nil) != (toIP.To4() == nil) {
+			return nil, fmt.Errorf("IP rewrite across families: %q to %q", from, to)
+		}
+		f[fromIP.String()] = toIP
+	}
+	return f, nil
+}
+
+// Filter implements the response filter interface.
+func (f RewriteIPs) Filter(_ dns.Question, res *dns.Msg) *dns.Msg {
+	for _, rr := range res.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if ip, ok := f[rr.A.String()]; ok {
+				rr.A = ip.To4()
+			}
+		case *dns.AAAA:
+			if ip, ok := f[rr.AAAA.String()]; ok {
+				rr.AAAA = ip
+			}
+		}
+	}
+	return res
+}
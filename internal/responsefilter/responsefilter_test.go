@@ -0,0 +1,79 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package responsefilter_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/responsefilter"
+	"github.com/miekg/dns"
+)
+
+func response(rrs ...dns.RR) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetQuestion("www.example.com.", dns.TypeA)
+	res.Answer = rrs
+	return res
+}
+
+func a(ip string) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   net.ParseIP(ip),
+	}
+}
+
+func TestStripTypes(t *testing.T) {
+	f := responsefilter.NewStripTypes(dns.TypeCNAME)
+
+	res := response(
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "cdn.example.net."},
+		a("192.0.2.1"),
+	)
+	res = f.Filter(res.Question[0], res)
+	if len(res.Answer) != 1 || res.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("expected only the A record to remain; got %v", res.Answer)
+	}
+}
+
+func TestRewriteIPs(t *testing.T) {
+	f, err := responsefilter.NewRewriteIPs(map[string]string{
+		"203.0.113.10": "192.168.1.10",
+		"2001:db8::10": "fd00::10",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res := response(
+		a("203.0.113.10"),
+		a("203.0.113.11"),
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("2001:db8::10")},
+	)
+	res = f.Filter(res.Question[0], res)
+
+	want := []string{"192.168.1.10", "203.0.113.11", "fd00::10"}
+	for i, rr := range res.Answer {
+		var got net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			got = rr.A
+		case *dns.AAAA:
+			got = rr.AAAA
+		}
+		if !got.Equal(net.ParseIP(want[i])) {
+			t.Errorf("answer %d: expected %s; got %s", i, want[i], got)
+		}
+	}
+
+	for _, rewrites := range []map[string]string{
+		{"203.0.113.10": "fd00::10"},
+		{"www.example.com": "192.168.1.10"},
+	} {
+		if _, err := responsefilter.NewRewriteIPs(rewrites); err == nil {
+			t.Errorf("%v: expected an error", rewrites)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package sockbuf
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Control returns a control function for net.ListenConfig that sets the
+// receive and send buffer sizes of the sockets to rcvbuf and sndbuf bytes,
+// i.e. SO_RCVBUF and SO_SNDBUF. A size of 0 leaves that buffer at the system
+// default. The kernel may adjust or cap the sizes, so use Sizes to read the
+// effective ones. It is a no-op where Supported is false.
+func Control(rcvbuf, sndbuf int) (func(network, address string, c syscall.RawConn) error, error) {
+	if rcvbuf < 0 {
+		return nil, fmt.Errorf("invalid receive buffer size: %d", rcvbuf)
+	}
+	if sndbuf < 0 {
+		return nil, fmt.Errorf("invalid send buffer size: %d", sndbuf)
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = setSizes(fd, rcvbuf, sndbuf)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("setting socket buffer sizes on %s %s: %w", network, address, err)
+		}
+		return nil
+	}, nil
+}
+
+// Sizes returns the effective receive and send buffer sizes of c. They are 0
+// where Supported is false.
+func Sizes(c syscall.RawConn) (rcvbuf, sndbuf int, err error) {
+	if cerr := c.Control(func(fd uintptr) {
+		rcvbuf, sndbuf, err = getSizes(fd)
+	}); cerr != nil {
+		return 0, 0, cerr
+	}
+	return rcvbuf, sndbuf, err
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package sockbuf
+
+import "syscall"
+
+// Supported reports whether socket buffer sizes can be set on this platform.
+const Supported = true
+
+func setSizes(fd uintptr, rcvbuf, sndbuf int) error {
+	if rcvbuf > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); err != nil {
+			return err
+		}
+	}
+	if sndbuf > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndbuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getSizes(fd uintptr) (rcvbuf, sndbuf int, err error) {
+	rcvbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	sndbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rcvbuf, sndbuf, nil
+}
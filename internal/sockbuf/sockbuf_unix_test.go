@@ -0,0 +1,52 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build linux
+// +build linux
+
+package sockbuf_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/sockbuf"
+)
+
+func TestControl(t *testing.T) {
+	// stay well below net.core.rmem_max and wmem_max, which cap the sizes
+	const rcvbuf, sndbuf = 4096, 8192
+	control, err := sockbuf.Control(rcvbuf, sndbuf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lc := net.ListenConfig{Control: control}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer pc.Close()
+
+	raw, err := pc.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("getting raw conn: %v", err)
+	}
+	rcv, snd, err := sockbuf.Sizes(raw)
+	if err != nil {
+		t.Fatalf("getting sizes: %v", err)
+	}
+	// Linux doubles the requested sizes to account for bookkeeping overhead
+	if rcv != 2*rcvbuf || snd != 2*sndbuf {
+		t.Errorf("expected sizes (%d, %d); got (%d, %d)", 2*rcvbuf, 2*sndbuf, rcv, snd)
+	}
+}
+
+func TestControlInvalid(t *testing.T) {
+	for _, sizes := range [][2]int{{-1, 0}, {0, -1}} {
+		if _, err := sockbuf.Control(sizes[0], sizes[1]); err == nil {
+			t.Errorf("expected an error for %v", sizes)
+		}
+	}
+}
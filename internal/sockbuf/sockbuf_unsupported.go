@@ -0,0 +1,18 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package sockbuf
+
+// Supported reports whether socket buffer sizes can be set on this platform.
+const Supported = false
+
+func setSizes(fd uintptr, rcvbuf, sndbuf int) error {
+	return nil
+}
+
+func getSizes(fd uintptr) (rcvbuf, sndbuf int, err error) {
+	return 0, 0, nil
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package txtlist
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type exchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+// Fetch queries nameserver for the TXT records of name and returns the
+// entries they hold. Each TXT string may hold several entries separated by
+// whitespace, so that a list can be spread over as many records as needed.
+func Fetch(e exchanger, nameserver string, name string) ([]string, error) {
+	q := &dns.Msg{}
+	q.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+
+	res, _, err := e.Exchange(q, nameserver)
+	if err != nil {
+		return nil, fmt.Errorf("querying TXT records of %s: %w", name, err)
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("querying TXT records of %s: unexpected rcode: %s", name, dns.RcodeToString[res.Rcode])
+	}
+	if res.Truncated {
+		return nil, fmt.Errorf("querying TXT records of %s: response truncated", name)
+	}
+
+	var entries []string
+	for _, rr := range res.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		for _, s := range txt.Txt {
+			entries = append(entries, strings.Fields(s)...)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package txtlist_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/txtlist"
+	"github.com/miekg/dns"
+)
+
+type fakeExchanger struct {
+	rcode int
+	txt   [][]string
+}
+
+func (e fakeExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	res := &dns.Msg{}
+	res.SetRcode(m, e.rcode)
+	for _, txt := range e.txt {
+		res.Answer = append(res.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: txt,
+		})
+	}
+	return res, 0, nil
+}
+
+func TestFetch(t *testing.T) {
+	e := fakeExchanger{
+		rcode: dns.RcodeSuccess,
+		txt: [][]string{
+			{"ads.example.com *.tracker.example.net"},
+			{"@@www.example.com", "metrics.example.org"},
+		},
+	}
+
+	entries, err := txtlist.Fetch(e, "192.0.2.1:53", "blocklist.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"ads.example.com", "*.tracker.example.net", "@@www.example.com", "metrics.example.org"}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected %v; got %v", want, entries)
+	}
+}
+
+func TestFetchFailure(t *testing.T) {
+	if _, err := txtlist.Fetch(fakeExchanger{rcode: dns.RcodeNameError}, "192.0.2.1:53", "blocklist.example.com"); err == nil {
+		t.Error("expected an error for NXDOMAIN")
+	}
+}
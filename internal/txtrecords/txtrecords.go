@@ -0,0 +1,76 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package txtrecords
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Records represents an immutable set of static TXT records, e.g. SPF or DKIM
+// records of internal mail domains.
+type Records struct {
+	records map[string][]*dns.TXT
+}
+
+// Load loads TXT records from an io.Reader. Each line holds a name followed by
+// one or more strings, as in a zone file, e.g.
+// `mail.dev.local "v=spf1 ip4:192.0.2.25 -all"`. Strings longer than 255 bytes
+// are split into several, as a TXT string cannot hold more. Lines starting
+// with `#` are comments. It returns the number of records loaded.
+func Load(r io.Reader) (*Records, uint, error) {
+	rs := &Records{records: map[string][]*dns.TXT{}}
+
+	var cnt uint
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if len(l) < 1 || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		rr, err := parse(l)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		name := dns.CanonicalName(rr.Hdr.Name)
+		rs.records[name] = append(rs.records[name], rr)
+		cnt++
+	}
+	if err := s.Err(); err != nil {
+		return rs, cnt, fmt.Errorf("loading TXT records: %w", err)
+	}
+
+	return rs, cnt, nil
+}
+
+func parse(l string) (*dns.TXT, error) {
+	fields := strings.Fields(l)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected `<name> <string>...`; got %q", l)
+	}
+	if _, ok := dns.IsDomainName(fields[0]); !ok || strings.Contains(fields[0], "*") {
+		return nil, fmt.Errorf("invalid TXT record name: %q", fields[0])
+	}
+
+	name := dns.Fqdn(fields[0])
+	rr, err := dns.NewRR(name + " 0 IN TXT " + strings.TrimSpace(l[len(fields[0]):]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TXT record %q: %w", l, err)
+	}
+	return rr.(*dns.TXT), nil
+}
+
+// Lookup returns the TXT records of fqdn, in the order they were loaded.
+// Matching is case-insensitive.
+func (rs *Records) Lookup(fqdn string) ([]*dns.TXT, bool) {
+	records, ok := rs.records[dns.CanonicalName(fqdn)]
+	return records, ok
+}
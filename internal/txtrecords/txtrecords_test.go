@@ -0,0 +1,56 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package txtrecords_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/txtrecords"
+)
+
+func TestLookup(t *testing.T) {
+	key := strings.Repeat("A", 300)
+	rs, cnt, err := txtrecords.Load(strings.NewReader(strings.Join([]string{
+		"# internal mail",
+		`mail.dev.local              "v=spf1 ip4:192.0.2.25 -all"`,
+		`mail.dev.local              "first" "second; with \"quotes\""`,
+		`sel._domainkey.dev.local    "v=DKIM1; k=rsa; p=` + key + `"`,
+		`*.dev.local                 "glob"`,
+		`broken.dev.local`,
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 records; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn string
+		want [][]string
+	}{
+		// strings are held in presentation format, as escaped in the file
+		{"mail.dev.local.", [][]string{{"v=spf1 ip4:192.0.2.25 -all"}, {"first", `second; with \"quotes\"`}}},
+		{"SEL._domainkey.dev.local.", [][]string{{("v=DKIM1; k=rsa; p=" + key)[:255], ("v=DKIM1; k=rsa; p=" + key)[255:]}}},
+		{"web.dev.local.", nil},
+		{"broken.dev.local.", nil},
+	}
+	for _, tt := range tests {
+		records, ok := rs.Lookup(tt.fqdn)
+		if ok != (len(tt.want) > 0) {
+			t.Errorf("Lookup(%q): expected ok to be %v", tt.fqdn, !ok)
+			continue
+		}
+		if len(records) != len(tt.want) {
+			t.Errorf("Lookup(%q): expected %d records; got %v", tt.fqdn, len(tt.want), records)
+			continue
+		}
+		for i, rr := range records {
+			if strings.Join(rr.Txt, "|") != strings.Join(tt.want[i], "|") {
+				t.Errorf("Lookup(%q)[%d] = %q; want %q", tt.fqdn, i, rr.Txt, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package typefilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/execjosh/mydns/internal/globtrie"
+	"github.com/miekg/dns"
+)
+
+type types map[uint16]struct{}
+
+// TypeFilter represents an immutable set of query types to suppress per
+// domain, e.g. AAAA for hosts with broken IPv6. Domains may contain globs,
+// which match any single label. An exact domain takes precedence over a glob.
+type TypeFilter struct {
+	exact map[string]types
+	glob  *globtrie.GlobTrie
+	globs map[string]types
+}
+
+// Load loads a type filter from an io.Reader. Each line holds a domain and a
+// query type separated by a colon, e.g. `example.com:AAAA`; `#` starts a
+// comment. It returns the number of entries loaded.
+func Load(r io.Reader) (*TypeFilter, uint, error) {
+	f := &TypeFilter{
+		exact: map[string]types{},
+		glob:  globtrie.New(),
+		globs: map[string]types{},
+	}
+
+	var cnt uint
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		if idx := strings.IndexByte(l, '#'); idx >= 0 {
+			l = l[:idx]
+		}
+		l = strings.TrimSpace(l)
+		if len(l) < 1 {
+			continue
+		}
+
+		if err := f.insert(l); err != nil {
+			log.Println(err)
+			continue
+		}
+		cnt++
+	}
+	if err := s.Err(); err != nil {
+		return f, cnt, fmt.Errorf("loading type filter: %w", err)
+	}
+
+	return f, cnt, nil
+}
+
+func (f *TypeFilter) insert(l string) error {
+	idx := strings.LastIndexByte(l, ':')
+	if idx < 0 {
+		return fmt.Errorf("invalid type filter entry, expected `domain:TYPE`: %q", l)
+	}
+	name, typeName := l[:idx], strings.ToUpper(l[idx+1:])
+
+	qtype, ok := dns.StringToType[typeName]
+	if !ok {
+		return fmt.Errorf("invalid type filter entry, unknown type: %q", l)
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid type filter entry, invalid domain: %q", l)
+	}
+	name = dns.CanonicalName(name)
+
+	entries := f.exact
+	if strings.Contains(name, "*") {
+		if err := f.glob.Insert(name); err != nil {
+			return fmt.Errorf("invalid type filter entry %q: %w", l, err)
+		}
+		entries = f.globs
+	}
+
+	if _, ok := entries[name]; !ok {
+		entries[name] = types{}
+	}
+	entries[name][qtype] = struct{}{}
+	return nil
+}
+
+// Suppressed returns whether queries of qtype for fqdn are suppressed.
+func (f *TypeFilter) Suppressed(fqdn string, qtype uint16) bool {
+	fqdn = dns.CanonicalName(fqdn)
+
+	ts, ok := f.exact[fqdn]
+	if !ok {
+		pattern, matched := f.glob.Match(fqdn)
+		if !matched {
+			return false
+		}
+		ts = f.globs[pattern]
+	}
+
+	_, ok = ts[qtype]
+	return ok
+}
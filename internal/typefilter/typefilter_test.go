@@ -0,0 +1,49 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package typefilter_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/typefilter"
+	"github.com/miekg/dns"
+)
+
+func TestSuppressed(t *testing.T) {
+	f, cnt, err := typefilter.Load(strings.NewReader(strings.Join([]string{
+		"# broken IPv6",
+		"legacy.example.com:AAAA",
+		"*.lab.example.com:aaaa",
+		"v4only.lab.example.com:A",
+		"nocolon.example.com",
+		"bogus.example.com:NOPE",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 entries; got %d", cnt)
+	}
+
+	tests := []struct {
+		fqdn  string
+		qtype uint16
+		want  bool
+	}{
+		{"legacy.example.com.", dns.TypeAAAA, true},
+		{"Legacy.Example.com.", dns.TypeAAAA, true},
+		{"legacy.example.com.", dns.TypeA, false},
+		{"box.lab.example.com.", dns.TypeAAAA, true},
+		{"box.lab.example.com.", dns.TypeA, false},
+		{"v4only.lab.example.com.", dns.TypeA, true},
+		{"v4only.lab.example.com.", dns.TypeAAAA, false},
+		{"example.com.", dns.TypeAAAA, false},
+	}
+	for _, tt := range tests {
+		if got := f.Suppressed(tt.fqdn, tt.qtype); got != tt.want {
+			t.Errorf("Suppressed(%q, %s) = %v; want %v", tt.fqdn, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package upstream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// HTTPSClient exchanges messages with DNS over HTTPS (RFC 8484) servers,
+// POSTing them in wire format.
+type HTTPSClient struct {
+	Client *http.Client
+}
+
+// Exchange implements the exchanger interface, with address being the URL to
+// POST to. As recommended for caching, the message is sent with an ID of 0;
+// the response gets the original ID back.
+func (c *HTTPSClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, address, bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	start := time.Now()
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected HTTP status: %s", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, 0, fmt.Errorf("unexpected content type: %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+
+	r := &dns.Msg{}
+	if err := r.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	if r.Id == 0 {
+		r.Id = m.Id
+	}
+	return r, rtt, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package upstream_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/execjosh/mydns/internal/upstream"
+	"github.com/miekg/dns"
+)
+
+func TestHTTPSClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		q := &dns.Msg{}
+		if err := q.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Id != 0 {
+			http.Error(w, "expected ID 0", http.StatusBadRequest)
+			return
+		}
+
+		res := &dns.Msg{}
+		res.SetReply(q)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 53),
+		})
+		buf, _ := res.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	c := &upstream.HTTPSClient{Client: srv.Client()}
+
+	q := &dns.Msg{}
+	q.SetQuestion("dns.example.", dns.TypeA)
+	res, _, err := c.Exchange(q, srv.URL+"/dns-query")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Id != q.Id {
+		t.Errorf("expected ID %d; got %d", q.Id, res.Id)
+	}
+	if len(res.Answer) != 1 {
+		t.Fatalf("expected one answer; got %v", res.Answer)
+	}
+	if a := res.Answer[0].(*dns.A); !a.A.Equal(net.IPv4(192, 0, 2, 53)) {
+		t.Errorf("expected 192.0.2.53; got %s", a.A)
+	}
+
+	if _, _, err := c.Exchange(q, srv.URL+"/nope"); err == nil {
+		t.Error("expected an error for an unexpected response")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package upstream
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type exchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+type route struct {
+	exchanger exchanger
+	address   string
+}
+
+// Mux dispatches each exchange to the exchanger registered for the upstream,
+// so that upstreams of different protocols can share a single rotation. It
+// must not be modified once in use.
+type Mux struct {
+	routes map[string]route
+}
+
+// NewMux returns a new Mux without any upstreams.
+func NewMux() *Mux {
+	return &Mux{
+		routes: map[string]route{},
+	}
+}
+
+// Handle registers e to exchange messages with u. Exchanges are addressed by
+// u.String(), while e is passed u.Address.
+func (m *Mux) Handle(u Upstream, e exchanger) {
+	m.routes[u.String()] = route{exchanger: e, address: u.Address}
+}
+
+// Exchange implements the exchanger interface, dispatching to the exchanger
+// registered for address.
+func (m *Mux) Exchange(msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	r, ok := m.routes[address]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown upstream: %q", address)
+	}
+	return r.exchanger.Exchange(msg, r.address)
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Protocols an upstream nameserver may be queried over.
+const (
+	// ProtocolDNS is plain DNS over UDP.
+	ProtocolDNS = "dns"
+	// ProtocolTLS is DNS over TLS (RFC 7858).
+	ProtocolTLS = "tls"
+	// ProtocolHTTPS is DNS over HTTPS (RFC 8484).
+	ProtocolHTTPS = "https"
+)
+
+// Upstream is an upstream nameserver along with the protocol to query it over.
+type Upstream struct {
+	Protocol string
+	// Address is host:port, or the URL for ProtocolHTTPS.
+	Address string
+	// ServerName is the name to verify the certificate against for
+	// ProtocolTLS. If empty, it must be filled in before use.
+	ServerName string
+}
+
+// Parse parses an upstream nameserver spec, which is one of:
+//
+//	192.0.2.1                       plain DNS on port 53
+//	192.0.2.1:5353                  plain DNS
+//	dns://192.0.2.1:5353            plain DNS
+//	tls://192.0.2.1#dns.example     DNS over TLS, on port 853 by default
+//	https://dns.example/dns-query   DNS over HTTPS
+//
+// Hosts of plain DNS and DNS over TLS must be IPs.
+func Parse(spec string) (Upstream, error) {
+	if !strings.Contains(spec, "://") {
+		host, port := spec, "53"
+		if h, p, err := net.SplitHostPort(spec); err == nil {
+			host, port = h, p
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return Upstream{}, fmt.Errorf("invalid nameserver IP: %q", spec)
+		}
+		return Upstream{Protocol: ProtocolDNS, Address: net.JoinHostPort(ip.String(), port)}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return Upstream{}, fmt.Errorf("invalid nameserver %q: %w", spec, err)
+	}
+
+	switch u.Scheme {
+	case ProtocolDNS, ProtocolTLS:
+		ip := net.ParseIP(u.Hostname())
+		if ip == nil {
+			return Upstream{}, fmt.Errorf("invalid nameserver IP: %q", spec)
+		}
+		if len(u.Path) > 0 || len(u.RawQuery) > 0 || u.User != nil {
+			return Upstream{}, fmt.Errorf("invalid nameserver %q: unexpected path, query, or user", spec)
+		}
+		port := u.Port()
+		if len(port) < 1 {
+			port = "53"
+			if u.Scheme == ProtocolTLS {
+				port = "853"
+			}
+		}
+		up := Upstream{Protocol: u.Scheme, Address: net.JoinHostPort(ip.String(), port)}
+		if u.Scheme == ProtocolTLS {
+			up.ServerName = u.Fragment
+		} else if len(u.Fragment) > 0 {
+			return Upstream{}, fmt.Errorf("invalid nameserver %q: server names require tls://", spec)
+		}
+		return up, nil
+	case ProtocolHTTPS:
+		if len(u.Host) < 1 {
+			return Upstream{}, fmt.Errorf("invalid nameserver %q: missing host", spec)
+		}
+		u.Fragment = ""
+		return Upstream{Protocol: ProtocolHTTPS, Address: u.String()}, nil
+	}
+	return Upstream{}, fmt.Errorf("invalid nameserver %q: unsupported protocol %q", spec, u.Scheme)
+}
+
+// String returns the canonical spec of u, which also identifies it in logs and
+// metrics. Plain DNS upstreams are just host:port.
+func (u Upstream) String() string {
+	switch u.Protocol {
+	case ProtocolTLS:
+		if len(u.ServerName) > 0 {
+			return "tls://" + u.Address + "#" + u.ServerName
+		}
+		return "tls://" + u.Address
+	}
+	return u.Address
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package upstream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/upstream"
+	"github.com/miekg/dns"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want upstream.Upstream
+		str  string
+	}{
+		{"192.0.2.1", upstream.Upstream{Protocol: upstream.ProtocolDNS, Address: "192.0.2.1:53"}, "192.0.2.1:53"},
+		{"dns://192.0.2.1:5353", upstream.Upstream{Protocol: upstream.ProtocolDNS, Address: "192.0.2.1:5353"}, "192.0.2.1:5353"},
+		{"2001:db8::1", upstream.Upstream{Protocol: upstream.ProtocolDNS, Address: "[2001:db8::1]:53"}, "[2001:db8::1]:53"},
+		{"tls://192.0.2.1#dns.example", upstream.Upstream{Protocol: upstream.ProtocolTLS, Address: "192.0.2.1:853", ServerName: "dns.example"}, "tls://192.0.2.1:853#dns.example"},
+		{"tls://[2001:db8::1]:8853", upstream.Upstream{Protocol: upstream.ProtocolTLS, Address: "[2001:db8::1]:8853"}, "tls://[2001:db8::1]:8853"},
+		{"https://dns.example/dns-query", upstream.Upstream{Protocol: upstream.ProtocolHTTPS, Address: "https://dns.example/dns-query"}, "https://dns.example/dns-query"},
+	} {
+		got, err := upstream.Parse(tc.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %+v; got %+v", tc.spec, tc.want, got)
+		}
+		if got.String() != tc.str {
+			t.Errorf("%s: expected %q; got %q", tc.spec, tc.str, got.String())
+		}
+		if again, err := upstream.Parse(got.String()); err != nil || again != got {
+			t.Errorf("%s: expected %q to round-trip; got %+v, %v", tc.spec, got.String(), again, err)
+		}
+	}
+
+	for _, spec := range []string{
+		"dns.example",
+		"dns://dns.example",
+		"dns://192.0.2.1#dns.example",
+		"tls://192.0.2.1/dns-query",
+		"https:///dns-query",
+		"quic://192.0.2.1",
+	} {
+		if _, err := upstream.Parse(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+type addressRecorder struct {
+	address string
+}
+
+func (e *addressRecorder) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	e.address = address
+	return m, 0, nil
+}
+
+func TestMux(t *testing.T) {
+	plain := &addressRecorder{}
+	tls := &addressRecorder{}
+	m := upstream.NewMux()
+	m.Handle(upstream.Upstream{Protocol: upstream.ProtocolDNS, Address: "192.0.2.1:53"}, plain)
+	m.Handle(upstream.Upstream{Protocol: upstream.ProtocolTLS, Address: "192.0.2.2:853", ServerName: "dns.example"}, tls)
+
+	if _, _, err := m.Exchange(&dns.Msg{}, "tls://192.0.2.2:853#dns.example"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tls.address != "192.0.2.2:853" || len(plain.address) > 0 {
+		t.Errorf("expected the TLS exchanger to get 192.0.2.2:853; got %q (plain %q)", tls.address, plain.address)
+	}
+
+	if _, _, err := m.Exchange(&dns.Msg{}, "192.0.2.3:53"); err == nil {
+		t.Error("expected an error for an unknown upstream")
+	}
+}
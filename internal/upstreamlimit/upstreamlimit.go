@@ -0,0 +1,71 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package upstreamlimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/execjosh/mydns/internal/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/semaphore"
+)
+
+// ErrLimitReached is returned when no slot for an upstream exchange became
+// available in time.
+var ErrLimitReached = errors.New("upstream concurrency limit reached")
+
+type exchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+// Exchanger bounds the number of simultaneous in-flight exchanges of the
+// wrapped exchanger.
+type Exchanger struct {
+	exchanger exchanger
+	sem       *semaphore.Weighted
+	wait      time.Duration
+}
+
+// New returns a new Exchanger allowing at most max simultaneous exchanges.
+// Excess exchanges wait up to wait for a slot; if wait is zero, they fail
+// immediately with ErrLimitReached.
+func New(e exchanger, max int64, wait time.Duration) *Exchanger {
+	return &Exchanger{
+		exchanger: e,
+		sem:       semaphore.NewWeighted(max),
+		wait:      wait,
+	}
+}
+
+// Exchange implements the exchanger interface of the wrapped exchanger.
+func (e *Exchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	if err := e.acquire(); err != nil {
+		metrics.UpstreamRejected.Add(1)
+		return nil, 0, err
+	}
+	defer e.sem.Release(1)
+
+	metrics.UpstreamInFlight.Add(1)
+	defer metrics.UpstreamInFlight.Add(-1)
+
+	return e.exchanger.Exchange(m, address)
+}
+
+func (e *Exchanger) acquire() error {
+	if e.wait <= 0 {
+		if !e.sem.TryAcquire(1) {
+			return ErrLimitReached
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.wait)
+	defer cancel()
+	if err := e.sem.Acquire(ctx, 1); err != nil {
+		return ErrLimitReached
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package upstreamlimit_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/upstreamlimit"
+	"github.com/miekg/dns"
+)
+
+type blockingExchanger struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	e.entered <- struct{}{}
+	<-e.release
+	return m, 0, nil
+}
+
+func TestExchangeLimit(t *testing.T) {
+	for _, wait := range []time.Duration{0, 10 * time.Millisecond} {
+		inner := &blockingExchanger{
+			entered: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		e := upstreamlimit.New(inner, 1, wait)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, _, err := e.Exchange(&dns.Msg{}, "192.0.2.1:53"); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+		<-inner.entered
+
+		if _, _, err := e.Exchange(&dns.Msg{}, "192.0.2.1:53"); !errors.Is(err, upstreamlimit.ErrLimitReached) {
+			t.Errorf("wait %v: expected ErrLimitReached; got %v", wait, err)
+		}
+
+		close(inner.release)
+		<-done
+
+		go func() { <-inner.entered }()
+		if _, _, err := e.Exchange(&dns.Msg{}, "192.0.2.1:53"); err != nil {
+			t.Errorf("wait %v: expected slot to be free again; got %v", wait, err)
+		}
+	}
+}
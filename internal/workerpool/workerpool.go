@@ -0,0 +1,79 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package workerpool
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+type job struct {
+	w    dns.ResponseWriter
+	r    *dns.Msg
+	done chan struct{}
+}
+
+// Pool is a dns.Handler that runs the wrapped handler on a fixed number of
+// worker goroutines, bounding how many queries are processed in parallel.
+// Queries beyond that wait for a free worker.
+type Pool struct {
+	handler dns.Handler
+	jobs    chan job
+	quit    chan struct{}
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+var _ dns.Handler = (*Pool)(nil)
+
+// New starts a Pool of n workers running h.
+func New(h dns.Handler, n int) *Pool {
+	p := &Pool{
+		handler: h,
+		jobs:    make(chan job),
+		quit:    make(chan struct{}),
+	}
+
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case j := <-p.jobs:
+			p.handler.ServeDNS(j.w, j.r)
+			close(j.done)
+		}
+	}
+}
+
+// ServeDNS implements `dns.Handler`. It blocks until a worker has handled the
+// query, since the ResponseWriter must not be used after it returns. Once the
+// Pool is closed, queries are dropped.
+func (p *Pool) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	done := make(chan struct{})
+	select {
+	case <-p.quit:
+		return
+	case p.jobs <- job{w, r, done}:
+	}
+	<-done
+}
+
+// Close stops the workers once they have finished their current queries.
+func (p *Pool) Close() error {
+	p.closeOnce.Do(func() { close(p.quit) })
+	p.wg.Wait()
+	return nil
+}
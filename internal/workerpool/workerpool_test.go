@@ -0,0 +1,107 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package workerpool_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns/internal/workerpool"
+	"github.com/miekg/dns"
+)
+
+type nopWriter struct {
+	dns.ResponseWriter
+}
+
+func (nopWriter) WriteMsg(*dns.Msg) error { return nil }
+
+func TestPoolBoundsParallelism(t *testing.T) {
+	const workers = 2
+
+	var cur, peak int32
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		n := atomic.AddInt32(&cur, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&cur, -1)
+		w.WriteMsg(r)
+	})
+
+	p := workerpool.New(h, workers)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.ServeDNS(nopWriter{}, &dns.Msg{})
+		}()
+	}
+	wg.Wait()
+
+	if peak > workers {
+		t.Errorf("expected at most %d queries in parallel; got %d", workers, peak)
+	}
+}
+
+// BenchmarkPool compares handling queries directly, as the dns package does
+// with a goroutine per query, to handling them on pools of various sizes. The
+// handler burns a little CPU, like parsing and packing a real query would.
+func BenchmarkPool(b *testing.B) {
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		sum := sha256.Sum256([]byte(r.Question[0].Name))
+		for i := 0; i < 50; i++ {
+			sum = sha256.Sum256(sum[:])
+		}
+		w.WriteMsg(r)
+	})
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	b.Run("direct", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				h.ServeDNS(nopWriter{}, req)
+			}
+		})
+	})
+
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			p := workerpool.New(h, n)
+			defer p.Close()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					p.ServeDNS(nopWriter{}, req)
+				}
+			})
+		})
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	var handled int32
+	p := workerpool.New(dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {
+		atomic.AddInt32(&handled, 1)
+	}), 1)
+	p.Close()
+
+	p.ServeDNS(nopWriter{}, &dns.Msg{})
+	if handled != 0 {
+		t.Error("expected queries to be dropped after Close")
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package mydns
+
+import "sync/atomic"
+
+// maintenanceState is set while the server is in maintenance mode. Unlike
+// drainState, it can be unset.
+type maintenanceState struct {
+	on int32
+}
+
+// InMaintenance returns whether the server is in maintenance mode.
+func (m *maintenanceState) InMaintenance() bool {
+	return atomic.LoadInt32(&m.on) == 1
+}
+
+// set enters or leaves maintenance mode, returning false if the server
+// already was in that mode.
+func (m *maintenanceState) set(on bool) bool {
+	if on {
+		return atomic.CompareAndSwapInt32(&m.on, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(&m.on, 1, 0)
+}
+
+// SetMaintenance enters or leaves maintenance mode. While in it, every query
+// is answered with the maintenance rcode, SERVFAIL by default, so that clients
+// move on to their secondary resolver, and the admin API's `/healthz` reports
+// the server unhealthy. Unlike Drain, it can be left again without a restart.
+func (s *Server) SetMaintenance(on bool) {
+	if !s.maintenance.set(on) {
+		return
+	}
+	if on {
+		s.logger.Info("entering maintenance mode: failing all queries")
+	} else {
+		s.logger.Info("leaving maintenance mode: answering queries")
+	}
+}
+
+// InMaintenance returns whether the server is in maintenance mode.
+func (s *Server) InMaintenance() bool {
+	return s.maintenance.InMaintenance()
+}
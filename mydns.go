@@ -0,0 +1,1480 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package mydns provides a blocklisted DNS stub resolver that can be embedded
+// in other programs. The `mydns` command is a thin wrapper around it.
+package mydns
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/execjosh/mydns/internal/adaptive"
+	"github.com/execjosh/mydns/internal/admin"
+	"github.com/execjosh/mydns/internal/blocklist"
+	"github.com/execjosh/mydns/internal/blocksyslog"
+	"github.com/execjosh/mydns/internal/caa"
+	"github.com/execjosh/mydns/internal/certreload"
+	"github.com/execjosh/mydns/internal/cidrlist"
+	"github.com/execjosh/mydns/internal/coalesce"
+	"github.com/execjosh/mydns/internal/connlimit"
+	"github.com/execjosh/mydns/internal/connpool"
+	"github.com/execjosh/mydns/internal/dns64"
+	"github.com/execjosh/mydns/internal/dnsqueryhandler"
+	"github.com/execjosh/mydns/internal/dscp"
+	"github.com/execjosh/mydns/internal/ednscookie"
+	"github.com/execjosh/mydns/internal/hosts"
+	"github.com/execjosh/mydns/internal/policy"
+	"github.com/execjosh/mydns/internal/quota"
+	"github.com/execjosh/mydns/internal/roundrobin"
+	"github.com/execjosh/mydns/internal/sockbuf"
+	"github.com/execjosh/mydns/internal/txtrecords"
+	"github.com/execjosh/mydns/internal/typefilter"
+	"github.com/execjosh/mydns/internal/upstream"
+	"github.com/execjosh/mydns/internal/upstreamlimit"
+	"github.com/execjosh/mydns/internal/workerpool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type exchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+// Options configures a Server.
+type Options struct {
+	// Logger receives all logs. If nil, nothing is logged.
+	Logger *zap.Logger
+
+	// TCPPort and UDPPort are the ports to listen on. At least one of them,
+	// or DoTPort, must be set.
+	TCPPort int
+	UDPPort int
+
+	// DoTPort, if set, is the port to serve DNS over TLS (RFC 7858) on, using
+	// the certificate and key at TLSCertPath and TLSKeyPath.
+	DoTPort     int
+	TLSCertPath string
+	TLSKeyPath  string
+
+	// TLSCertReloadInterval, if positive, reloads the DoT certificate
+	// periodically, e.g. to pick up renewals. It can also be reloaded with
+	// ReloadTLSCertificate.
+	TLSCertReloadInterval time.Duration
+
+	// TCPIdleTimeout, if positive, is how long TCP and DoT connections may be
+	// idle before they are closed. It is advertised to clients with the EDNS0
+	// TCP Keepalive option (RFC 7828), so they know how long to reuse them.
+	TCPIdleTimeout time.Duration
+
+	// MaxTCPConns, if positive, bounds the number of simultaneously open TCP
+	// and DoT client connections, which share the limit. Connections beyond
+	// it are closed right away.
+	MaxTCPConns int
+
+	// MaxConnQueries, if positive, bounds the number of queries answered on a
+	// single TCP or DoT connection, which is closed once it is reached; 128 by
+	// default. Queries on a connection are answered one at a time, so a client
+	// pipelining more queries must reconnect, and cannot make mydns queue
+	// them indefinitely.
+	MaxConnQueries int
+
+	// PaddingBlockSize, if positive, pads responses to DoT clients, and to
+	// clients sending the EDNS0 Padding option (RFC 7830), to a multiple of
+	// it. RFC 8467 recommends 468.
+	PaddingBlockSize int
+
+	// Nameservers are the upstream nameservers to be queried round-robin,
+	// or weighted by latency with AdaptiveUpstreams.
+	// Each is an IP, or a spec with its own protocol, e.g.
+	// tls://192.0.2.1#dns.example or https://dns.example/dns-query; see
+	// the README. At least one is required.
+	Nameservers []string
+
+	// AdaptiveUpstreams picks Nameservers at random, weighted toward those
+	// with the lowest moving average of round-trip times, instead of
+	// round-robin. Slower nameservers still get a small share of queries, so
+	// that their recovery is noticed.
+	AdaptiveUpstreams bool
+
+	// FallbackNameserver, if set, is a nameserver of last resort, in the
+	// same format as Nameservers. It is only queried once a query to the
+	// rotating Nameservers has failed, including any retries.
+	FallbackNameserver string
+
+	// TLSServerName, if set, enables TLS for nameservers given as bare IPs,
+	// and is the default server name of tls:// nameservers.
+	TLSServerName string
+
+	// UpstreamSource, if set, is the local IP that upstream queries are sent
+	// from, e.g. on multi-homed hosts with policy routing.
+	UpstreamSource string
+
+	// UpstreamPoolSize, if positive, keeps up to that many connections per
+	// DNS over TLS upstream open for reuse, saving a TLS handshake per
+	// query. Connections idle for UpstreamPoolIdleTimeout, 10s by default,
+	// are closed. Both also bound the idle connections kept per DNS over
+	// HTTPS host, which are otherwise reused as usual for HTTP.
+	UpstreamPoolSize        int
+	UpstreamPoolIdleTimeout time.Duration
+
+	// AllowUpstreamOverride lets clients pick one of the upstream
+	// nameservers for a query, for debugging, by appending `via.<IP>` with
+	// dashes instead of dots or colons to the name, e.g.
+	// `example.com.via.192-0-2-1`, or with a local EDNS0 option; see
+	// dnsqueryhandler.WithUpstreamOverride.
+	AllowUpstreamOverride bool
+
+	// RetryWindow, if positive, retries upstream queries that fail with a
+	// network error against the next nameserver until it has elapsed since
+	// the first attempt.
+	RetryWindow time.Duration
+
+	// RetryBackoff is how long to wait between retries. It is jittered
+	// slightly.
+	RetryBackoff time.Duration
+
+	// RetryRcodes are the rcodes, e.g. `servfail`, that make upstream
+	// queries be retried against the next nameserver, at most
+	// MaxRcodeRetries times, before the response is passed on.
+	RetryRcodes     []string
+	MaxRcodeRetries int
+
+	// DSCP, if non-zero, marks the traffic of listeners and upstream queries
+	// with this DSCP value (0-63) for QoS. It is ignored on platforms other
+	// than Linux, macOS, and FreeBSD.
+	DSCP int
+
+	// UDPReceiveBuffer and UDPSendBuffer, if positive, set the sizes of the
+	// UDP listener's socket buffers in bytes, e.g. to absorb bursts of
+	// queries that would otherwise be dropped. The kernel may cap them; the
+	// effective sizes are logged. They are ignored on platforms other than
+	// Linux, macOS, and FreeBSD.
+	UDPReceiveBuffer int
+	UDPSendBuffer    int
+
+	// Workers, if positive, bounds how many queries are handled in parallel
+	// by handling them on a fixed pool of goroutines, e.g. to avoid scheduler
+	// thrash on small VMs. Since workers wait for upstream, it also bounds
+	// the number of queries in flight.
+	Workers int
+
+	// BlocklistPath is the path to the blocklist file. It is optional. If it
+	// is `-`, the blocklist is read from stdin and cannot be reloaded.
+	BlocklistPath string
+
+	// BlocklistBloomRate, if positive, holds the exact entries of the
+	// blocklist in a Bloom filter with that false positive rate, e.g.
+	// 0.001, instead of a map. This saves most of the memory of huge
+	// blocklists, at the cost of blocking that share of other names, too.
+	BlocklistBloomRate float64
+
+	// BlocklistExportPath, if set, is where the blocklist is written in
+	// normalized form, one canonical entry per line, whenever it is
+	// (re)loaded, e.g. for auditing the merge of a file and TXT records. It
+	// cannot be combined with BlocklistBloomRate.
+	BlocklistExportPath string
+
+	// BlocklistDNSName, if set, is a control name whose TXT records hold
+	// additional blocklist entries, separated by whitespace. They are
+	// queried via the upstream nameservers, trying each in turn, and
+	// refreshed every BlocklistDNSRefresh, if positive. If no nameserver
+	// answers on startup, the entries of BlocklistPath are loaded alone.
+	BlocklistDNSName    string
+	BlocklistDNSRefresh time.Duration
+
+	// FailClosed and FailOpen load the blocklist in the background once
+	// the server has started, instead of before. Until it is loaded,
+	// queries that would be checked against it are refused if FailClosed
+	// is set, or forwarded unfiltered if FailOpen is set. At most one of
+	// them may be set.
+	FailClosed bool
+	FailOpen   bool
+
+	// WatchBlocklist reloads the blocklist whenever its file changes on disk,
+	// as if scheduled with ScheduleBlocklistReload. It is ignored for a
+	// blocklist read from stdin.
+	WatchBlocklist bool
+
+	// ReloadDebounce, if positive, coalesces blocklist reloads scheduled with
+	// ScheduleBlocklistReload within this window into a single one.
+	ReloadDebounce time.Duration
+
+	// EDNSCookie enables DNS Cookies (RFC 7873) for upstream queries.
+	EDNSCookie bool
+
+	// EDNSPassthrough are the codes of EDNS0 options, e.g. `3` for NSID, that
+	// are copied from client queries to upstream queries, and from upstream
+	// responses back to clients. All other options are stripped. The cookie
+	// option cannot be passed through with EDNSCookie.
+	EDNSPassthrough []string
+
+	// MinimalANY answers ANY queries with an RFC 8482 HINFO record instead of
+	// refusing them.
+	MinimalANY bool
+
+	// NormalizeQNAME lowercases the names of queries sent upstream, so that
+	// queries differing only in case are coalesced. Clients still get answers
+	// in the case they asked in.
+	NormalizeQNAME bool
+
+	// MaxUpstreamConcurrency bounds the number of simultaneous in-flight
+	// upstream exchanges. Zero means unlimited.
+	MaxUpstreamConcurrency int64
+
+	// UpstreamQueueTimeout is how long an upstream exchange waits for a slot
+	// when MaxUpstreamConcurrency is reached. If zero, it fails immediately.
+	UpstreamQueueTimeout time.Duration
+
+	// SyslogAddr, if set, sends block events to syslog, independently of
+	// Logger. It is either `local` or `network://host:port`.
+	SyslogAddr string
+
+	// SyslogFacility is the syslog facility for block events. It defaults to
+	// `daemon`.
+	SyslogFacility string
+
+	// DisableCompression disables DNS name compression in responses, for
+	// legacy clients that mishandle it.
+	DisableCompression bool
+
+	// DisableRecursionAvailable clears the RA bit in responses, which is
+	// otherwise always set, for clients that must not treat mydns as a
+	// recursive resolver.
+	DisableRecursionAvailable bool
+
+	// DisableCNAMEInspection forwards upstream answers whose CNAME records
+	// point to blocked names, which are otherwise answered as blocked.
+	DisableCNAMEInspection bool
+
+	// DisableAnswerLog skips the info log line otherwise written for every
+	// record of an upstream answer, to cut log volume on busy resolvers.
+	// Blocks and errors are still logged.
+	DisableAnswerLog bool
+
+	// ExtendedErrors attaches Extended DNS Errors (RFC 8914) to blocked and
+	// failed responses.
+	ExtendedErrors bool
+
+	// QueryDeadline bounds the total time spent answering a single query,
+	// after which it is answered with SERVFAIL. Zero means no deadline.
+	QueryDeadline time.Duration
+
+	// TestUpstream, if set, sends a control query to each nameserver,
+	// including FallbackNameserver, before the Server is created. It is
+	// either `warn`, to log failures, or `fatal`, to make NewServer fail.
+	TestUpstream string
+
+	// UnsupportedClassRcode and UnsupportedTypeRcode are the rcodes, e.g.
+	// `refused`, `notimp`, or `noerror`, used to answer questions of classes
+	// other than INET and of unsupported types; see the README for the
+	// supported ones. They default to `refused`.
+	UnsupportedClassRcode string
+	UnsupportedTypeRcode  string
+
+	// UnsupportedOpcodeRcode is the rcode used to answer messages with an
+	// opcode other than QUERY, e.g. UPDATE or NOTIFY. It defaults to
+	// `refused`.
+	UnsupportedOpcodeRcode string
+
+	// MaintenanceRcode is the rcode every query is answered with while the
+	// server is in maintenance mode; see SetMaintenance. It defaults to
+	// `servfail`.
+	MaintenanceRcode string
+
+	// WhoamiName, if set, is a name that is answered with the client's own
+	// IP, e.g. `whoami.mydns.`.
+	WhoamiName string
+
+	// BlockMode is how blocked queries are answered: `address` (the default)
+	// answers with an address record, `hinfo` with an HINFO record holding
+	// BlockHINFOCPU and BlockHINFOOS, which default to `BLOCKED` and
+	// `policy`, and `cname` with a CNAME record pointing to
+	// BlockCNAMETarget.
+	BlockMode        string
+	BlockHINFOCPU    string
+	BlockHINFOOS     string
+	BlockCNAMETarget string
+
+	// BlockIP4 and BlockIP6, if set, are the IPs blocked A and AAAA queries
+	// are answered with in `address` mode, e.g. those of a sinkhole. They
+	// default to `0.0.0.0` and `::`, respectively.
+	BlockIP4 string
+	BlockIP6 string
+
+	// NXDOMAINRedirect, if set, holds up to one IPv4 and one IPv6 address
+	// that A and AAAA queries answered with NXDOMAIN by upstream are
+	// answered with instead, e.g. those of an error page. This hijacks
+	// NXDOMAIN and breaks anything relying on it, e.g. mail delivery checks
+	// or typo detection, so it is only meant for captive portals and the
+	// like.
+	NXDOMAINRedirect []string
+
+	// MaxAnswers, if positive, caps the answers to upstream queries at the
+	// first MaxAnswers records.
+	MaxAnswers int
+
+	// MaxQNameLabels, if positive, refuses queries for names with more labels
+	// than it. Names longer than 253 bytes are always refused.
+	MaxQNameLabels int
+
+	// ClientQuota, if set, caps the queries of each client IP per window, in
+	// the form `<limit>/<window>`, e.g. `10000/24h`. Queries over the quota
+	// are refused.
+	ClientQuota string
+
+	// StageOrder, if set, is the order of the stages queries pass through
+	// before they are forwarded, e.g. to let blocks override static records.
+	// It must hold every stage exactly once; see DefaultStageOrder of the
+	// dnsqueryhandler package.
+	StageOrder []string
+
+	// HostsPath is the path to a file of static records in hosts file format.
+	// Names may contain globs. It is optional.
+	HostsPath string
+
+	// FallbackHostsPath is the path to a file of static records in hosts file
+	// format that are only answered once upstream has failed a query for
+	// them, as a safety net for critical names during an outage. It is
+	// optional.
+	FallbackHostsPath string
+
+	// LocalTLDs holds `suffix=IP` entries, e.g. `test=192.0.2.10`. Every name
+	// under a suffix without static records is answered with its IPs,
+	// authoritatively, instead of being forwarded. A suffix may be given
+	// twice, for an IPv4 and an IPv6 address.
+	LocalTLDs []string
+
+	// DNS64Prefix, if set, enables DNS64 (RFC 6147) for NAT64: AAAA
+	// records are synthesized from A records for names without any, by
+	// embedding their IPv4 addresses into this IPv6 prefix, e.g. the
+	// Well-Known Prefix 64:ff9b::/96.
+	DNS64Prefix string
+
+	// ResponseFilters are run, in order, on every response before it is
+	// written, e.g. to strip records or rewrite IPs. They are optional.
+	ResponseFilters []ResponseFilter
+
+	// CAAPath is the path to a file of static CAA records, one per line as
+	// `<name> <flags> <tag> <value>`. It is optional.
+	CAAPath string
+
+	// TXTPath is the path to a file of static TXT records, one per line as
+	// `<name> <string>...`, e.g. SPF or DKIM records. They are answered
+	// authoritatively; TXT queries for other names are forwarded. It is
+	// optional.
+	TXTPath string
+
+	// PolicyPath is the path to an ordered policy file of `allow` and `block`
+	// rules, evaluated before the blocklist. It is optional.
+	PolicyPath string
+
+	// Sinkhole blocks every name that is not explicitly allowed, by an
+	// `allow` rule of the policy file or an exception in the blocklist.
+	Sinkhole bool
+
+	// BlockedIPsPath is the path to a file of CIDRs. Queries whose upstream
+	// answer contains an IP in one of them are blocked. It is optional.
+	BlockedIPsPath string
+
+	// SuppressTypesPath is the path to a file of `domain:TYPE` entries.
+	// Queries of a listed type for a listed domain are answered with NODATA
+	// instead of being forwarded. It is optional.
+	SuppressTypesPath string
+
+	// AdminAddr, if set, is the address the admin HTTP API listens on, e.g.
+	// `127.0.0.1:8053`.
+	AdminAddr string
+
+	// AdminToken is the bearer token required by protected admin endpoints.
+	// If empty, those endpoints are disabled.
+	AdminToken string
+}
+
+// Server represents a mydns server that can be started and shut down.
+type Server struct {
+	logger    *zap.Logger
+	opts      Options
+	handler   dns.Handler
+	blocklist *swappableBlocklist
+	servers   []*dns.Server
+	admin     *http.Server
+	closers   []io.Closer
+	certs     *certreload.Reloader
+	quota     *quota.Quota
+	reloads   *debouncer
+	drain     *drainState
+	pools     []*connpool.Pool
+
+	maintenance *maintenanceState
+
+	blocklistLoader *blocklistLoader
+	listenConfig    net.ListenConfig
+	connLimit       *connlimit.Limiter
+	udpListenConfig net.ListenConfig
+}
+
+// NewServer validates opts and assembles a new Server. It does not start
+// listening; call Start for that.
+func NewServer(opts Options) (*Server, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if opts.TCPPort <= 0 && opts.UDPPort <= 0 && opts.DoTPort <= 0 {
+		return nil, errors.New("at least one port for TCP, UDP, or DoT must be specified")
+	}
+	if opts.DoTPort > 0 && (len(opts.TLSCertPath) < 1 || len(opts.TLSKeyPath) < 1) {
+		return nil, errors.New("DoT requires a TLS certificate and key")
+	}
+	if opts.TCPIdleTimeout > dnsqueryhandler.MaxTCPKeepalive {
+		return nil, fmt.Errorf("TCP idle timeout must not exceed %s", dnsqueryhandler.MaxTCPKeepalive)
+	}
+
+	var upstreams []upstream.Upstream
+	var addrs []string
+	seen := map[string]struct{}{}
+	for _, ns := range opts.Nameservers {
+		u, err := parseUpstream(ns, opts.TLSServerName)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[u.String()]; ok {
+			continue
+		}
+		seen[u.String()] = struct{}{}
+		upstreams = append(upstreams, u)
+		addrs = append(addrs, u.String())
+	}
+	if len(upstreams) < 1 {
+		return nil, errors.New("at least one nameserver required")
+	}
+	nameservers := roundrobin.New(addrs)
+	var fallback string
+	if len(opts.FallbackNameserver) > 0 {
+		u, err := parseUpstream(opts.FallbackNameserver, opts.TLSServerName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback nameserver: %w", err)
+		}
+		fallback = u.String()
+		upstreams = append(upstreams, u)
+		logger.Info("fallback upstream server", zap.String("nameserver", fallback))
+	}
+	logger.Info("upstream servers", zap.Strings("nameservers", addrs))
+
+	var control func(network, address string, c syscall.RawConn) error
+	if opts.DSCP != 0 {
+		c, err := dscp.Control(opts.DSCP)
+		if err != nil {
+			return nil, err
+		}
+		control = c
+		if !dscp.Supported {
+			logger.Warn("DSCP marking is not supported on this platform")
+		}
+	}
+	var connLimit *connlimit.Limiter
+	if opts.MaxTCPConns < 0 {
+		return nil, fmt.Errorf("invalid TCP connection limit: %d", opts.MaxTCPConns)
+	}
+	if opts.MaxTCPConns > 0 {
+		connLimit = connlimit.New(opts.MaxTCPConns)
+	}
+	if opts.MaxConnQueries < 0 {
+		return nil, fmt.Errorf("invalid per-connection query limit: %d", opts.MaxConnQueries)
+	}
+
+	udpControl := control
+	if opts.UDPReceiveBuffer != 0 || opts.UDPSendBuffer != 0 {
+		c, err := sockbuf.Control(opts.UDPReceiveBuffer, opts.UDPSendBuffer)
+		if err != nil {
+			return nil, err
+		}
+		udpControl = chainControl(control, c)
+		if !sockbuf.Supported {
+			logger.Warn("setting UDP socket buffer sizes is not supported on this platform")
+		}
+	}
+
+	dnsCli := &dns.Client{
+		DialTimeout:  2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 2 * time.Second,
+	}
+	// the client ignores DialTimeout once a Dialer is set
+	dialer := &net.Dialer{
+		Timeout: dnsCli.DialTimeout,
+		Control: control,
+	}
+	if len(opts.UpstreamSource) > 0 {
+		ip := net.ParseIP(opts.UpstreamSource)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid upstream source IP: %q", opts.UpstreamSource)
+		}
+
+		dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		logger.Info("upstream source", zap.Stringer("ip", ip))
+	}
+	if dialer.LocalAddr != nil || dialer.Control != nil {
+		dnsCli.Dialer = dialer
+	}
+
+	// each upstream is queried with a client for its protocol; TLS clients
+	// are shared by upstreams with the same server name, and pooled if enabled
+	if opts.UpstreamPoolSize < 0 {
+		return nil, fmt.Errorf("invalid upstream pool size: %d", opts.UpstreamPoolSize)
+	}
+	tlsClients := map[string]exchanger{}
+	var pools []*connpool.Pool
+	var httpsCli *upstream.HTTPSClient
+	for _, u := range upstreams {
+		switch u.Protocol {
+		case upstream.ProtocolTLS:
+			if _, ok := tlsClients[u.ServerName]; !ok {
+				c := streamClient(dnsCli)
+				c.Net = "tcp-tls"
+				c.TLSConfig = &tls.Config{
+					ServerName: u.ServerName,
+					MinVersion: tls.VersionTLS13,
+				}
+				tlsClients[u.ServerName] = c
+				if opts.UpstreamPoolSize > 0 {
+					pool := connpool.New(c, opts.UpstreamPoolSize, upstreamPoolIdleTimeout(opts))
+					pools = append(pools, pool)
+					tlsClients[u.ServerName] = pool
+				}
+			}
+		case upstream.ProtocolHTTPS:
+			if httpsCli == nil {
+				httpsCli = httpsClient(dnsCli, opts)
+			}
+		}
+	}
+	// upstreamMux routes each upstream to its client, using plain for plain
+	// DNS upstreams
+	upstreamMux := func(plain exchanger) *upstream.Mux {
+		m := upstream.NewMux()
+		for _, u := range upstreams {
+			switch u.Protocol {
+			case upstream.ProtocolDNS:
+				m.Handle(u, plain)
+			case upstream.ProtocolTLS:
+				m.Handle(u, tlsClients[u.ServerName])
+			case upstream.ProtocolHTTPS:
+				m.Handle(u, httpsCli)
+			}
+		}
+		return m
+	}
+	mux := upstreamMux(dnsCli)
+
+	loader := &blocklistLoader{path: opts.BlocklistPath}
+	loader.opts = append(loader.opts, blocklist.WithProgress(blocklistProgressLines, func(lines uint) {
+		logger.Info("loading blocklist", zap.Uint("lines", lines))
+	}))
+	if opts.BlocklistBloomRate < 0 || opts.BlocklistBloomRate >= 1 {
+		return nil, fmt.Errorf("invalid blocklist Bloom filter false positive rate: %v", opts.BlocklistBloomRate)
+	}
+	if opts.BlocklistBloomRate > 0 {
+		loader.opts = append(loader.opts, blocklist.WithBloomFilter(opts.BlocklistBloomRate))
+		if len(opts.BlocklistExportPath) > 0 {
+			return nil, errors.New("a blocklist held in a Bloom filter cannot be exported")
+		}
+	}
+	loader.exportPath = opts.BlocklistExportPath
+	if len(opts.BlocklistDNSName) > 0 {
+		if opts.BlocklistPath == stdinPath {
+			return nil, errors.New("a blocklist read from stdin cannot be combined with TXT records")
+		}
+		loader.txtName = opts.BlocklistDNSName
+		loader.exchanger = upstreamMux(streamClient(dnsCli))
+		loader.nameservers = nameservers
+		loader.attempts = len(addrs)
+	}
+	if opts.FailClosed && opts.FailOpen {
+		return nil, errors.New("fail closed and fail open are mutually exclusive")
+	}
+	var blocklist *swappableBlocklist
+	var blockCnt uint
+	if opts.FailClosed || opts.FailOpen {
+		// loaded in the background by Start
+		blocklist = newPendingBlocklist()
+	} else {
+		bl, cnt, err := loader.load()
+		if err != nil {
+			logger.Error("failed to load blocklist", zap.Error(err))
+		} else if err := loader.export(bl); err != nil {
+			logger.Warn("failed to export blocklist", zap.Error(err))
+		}
+		logger.Info(fmt.Sprintf("Blocking %d domains from %s", cnt, loader))
+		blocklist = newSwappableBlocklist(bl, cnt)
+		blocklist.markReady()
+		blockCnt = cnt
+	}
+	if opts.BlocklistPath == stdinPath {
+		logger.Info("blocklist was read from stdin; reloading is disabled")
+	}
+
+	switch opts.TestUpstream {
+	case "":
+	case "warn", "fatal":
+		// the fallback is only needed once the others fail, which is too late
+		// to find out that it does not work either
+		tested := append([]string{}, addrs...)
+		if len(fallback) > 0 {
+			tested = append(tested, fallback)
+		}
+		if err := testUpstreams(logger, mux, tested); err != nil {
+			if opts.TestUpstream == "fatal" {
+				return nil, err
+			}
+			logger.Warn("upstream test failed", zap.Error(err))
+		}
+	default:
+		return nil, fmt.Errorf("invalid upstream test mode: %q", opts.TestUpstream)
+	}
+
+	var exchanger exchanger = mux
+	var chooser interface{ Next() string } = nameservers
+	if opts.AdaptiveUpstreams {
+		// failures count as a timeout; this wraps the clients directly, so
+		// that time spent waiting for a concurrency slot is not counted
+		c := adaptive.New(addrs, dnsCli.ReadTimeout)
+		exchanger = c.Wrap(mux)
+		chooser = c
+	}
+	if opts.MaxUpstreamConcurrency > 0 {
+		exchanger = upstreamlimit.New(exchanger, opts.MaxUpstreamConcurrency, opts.UpstreamQueueTimeout)
+	}
+	// identical queries in flight at the same time are only sent once; this
+	// comes before the concurrency limit, so that they share a single slot
+	exchanger = coalesce.New(exchanger)
+
+	var handlerOpts []dnsqueryhandler.Option
+	if opts.EDNSCookie {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithCookies(ednscookie.New()))
+	}
+	if len(opts.EDNSPassthrough) > 0 {
+		codes := make([]uint16, len(opts.EDNSPassthrough))
+		for i, s := range opts.EDNSPassthrough {
+			code, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+			if err != nil || code == 0 {
+				return nil, fmt.Errorf("invalid EDNS0 option code: %q", s)
+			}
+			if code == uint64(dns.EDNS0COOKIE) && opts.EDNSCookie {
+				return nil, errors.New("the cookie option cannot be passed through with EDNS cookies enabled")
+			}
+			codes[i] = uint16(code)
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithEDNSPassthrough(codes...))
+	}
+	if opts.MinimalANY {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithMinimalANY())
+	}
+	if opts.NormalizeQNAME {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithQNAMENormalization())
+	}
+	if opts.DisableCompression {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithCompression(false))
+	}
+	if opts.DisableRecursionAvailable {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithRecursionAvailable(false))
+	}
+	if opts.DisableCNAMEInspection {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithCNAMEInspection(false))
+	}
+	if opts.DisableAnswerLog {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithAnswerLog(false))
+	}
+	if opts.ExtendedErrors {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithExtendedErrors())
+	}
+	if len(opts.StageOrder) > 0 {
+		if err := dnsqueryhandler.ValidateStageOrder(opts.StageOrder); err != nil {
+			return nil, fmt.Errorf("invalid stage order: %w", err)
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithStageOrder(opts.StageOrder))
+	}
+	if opts.TCPIdleTimeout > 0 {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithTCPKeepalive(opts.TCPIdleTimeout))
+	}
+	if opts.PaddingBlockSize < 0 || opts.PaddingBlockSize > dns.MaxMsgSize {
+		return nil, fmt.Errorf("invalid padding block size: %d", opts.PaddingBlockSize)
+	}
+	if opts.PaddingBlockSize > 0 {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithPadding(opts.PaddingBlockSize))
+	}
+	if opts.QueryDeadline > 0 {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithQueryDeadline(opts.QueryDeadline))
+	}
+	if len(opts.UnsupportedClassRcode) > 0 || len(opts.UnsupportedTypeRcode) > 0 {
+		classRcode, err := parseRcode(opts.UnsupportedClassRcode)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported class rcode: %w", err)
+		}
+		typeRcode, err := parseRcode(opts.UnsupportedTypeRcode)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported type rcode: %w", err)
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithUnsupportedRcodes(classRcode, typeRcode))
+	}
+	if len(opts.UnsupportedOpcodeRcode) > 0 {
+		rcode, err := parseRcode(opts.UnsupportedOpcodeRcode)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported opcode rcode: %w", err)
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithUnsupportedOpcodeRcode(rcode))
+	}
+	if len(opts.WhoamiName) > 0 {
+		if _, ok := dns.IsDomainName(opts.WhoamiName); !ok {
+			return nil, fmt.Errorf("invalid whoami name: %q", opts.WhoamiName)
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithWhoami(opts.WhoamiName))
+	}
+	if len(opts.NXDOMAINRedirect) > 0 {
+		ip4, ip6, err := parseRedirectIPs(opts.NXDOMAINRedirect)
+		if err != nil {
+			return nil, err
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithNXDOMAINRedirect(ip4, ip6))
+	}
+	if opts.AllowUpstreamOverride {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithUpstreamOverride(overrideNameservers(upstreams)))
+	}
+	if len(fallback) > 0 {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithFallback(fallback))
+	}
+	if opts.MaxAnswers > 0 {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithMaxAnswers(opts.MaxAnswers))
+	}
+	if opts.MaxQNameLabels > 0 {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithMaxLabels(opts.MaxQNameLabels))
+	}
+	var q *quota.Quota
+	if len(opts.ClientQuota) > 0 {
+		limit, window, err := quota.Parse(opts.ClientQuota)
+		if err != nil {
+			return nil, err
+		}
+		q = quota.New(limit, window)
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithClientQuota(q))
+	}
+	switch opts.BlockMode {
+	case "", "address":
+		if len(opts.BlockIP4) > 0 || len(opts.BlockIP6) > 0 {
+			ip4, ip6, err := parseBlockIPs(opts.BlockIP4, opts.BlockIP6)
+			if err != nil {
+				return nil, err
+			}
+			handlerOpts = append(handlerOpts, dnsqueryhandler.WithBlockAnswers(ip4, ip6))
+		}
+	case "hinfo":
+		cpu, osName := opts.BlockHINFOCPU, opts.BlockHINFOOS
+		if len(cpu) < 1 {
+			cpu = "BLOCKED"
+		}
+		if len(osName) < 1 {
+			osName = "policy"
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithHINFOBlocks(cpu, osName))
+	case "cname":
+		if _, ok := dns.IsDomainName(opts.BlockCNAMETarget); !ok || len(opts.BlockCNAMETarget) < 1 {
+			return nil, fmt.Errorf("invalid CNAME block target: %q", opts.BlockCNAMETarget)
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithCNAMEBlocks(opts.BlockCNAMETarget))
+	default:
+		return nil, fmt.Errorf("invalid block mode: %q", opts.BlockMode)
+	}
+	if opts.RetryWindow > 0 {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithRetry(opts.RetryWindow, opts.RetryBackoff))
+	}
+	if opts.MaxRcodeRetries < 0 {
+		return nil, fmt.Errorf("invalid max rcode retries: %d", opts.MaxRcodeRetries)
+	}
+	if len(opts.RetryRcodes) > 0 && opts.MaxRcodeRetries > 0 {
+		rcodes := make([]int, len(opts.RetryRcodes))
+		for i, name := range opts.RetryRcodes {
+			rcode, err := parseRcode(name)
+			if err != nil {
+				return nil, err
+			}
+			if rcode == dns.RcodeSuccess {
+				return nil, fmt.Errorf("invalid retry rcode: %q", name)
+			}
+			rcodes[i] = rcode
+		}
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithRcodeRetries(rcodes, opts.MaxRcodeRetries))
+	}
+	if len(opts.HostsPath) > 0 {
+		h, cnt, err := loadHosts(opts.HostsPath)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Serving %d static records from %q", cnt, opts.HostsPath))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithStaticRecords(h))
+	}
+	if len(opts.FallbackHostsPath) > 0 {
+		h, cnt, err := loadHosts(opts.FallbackHostsPath)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Falling back to %d static records from %q", cnt, opts.FallbackHostsPath))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithFallbackRecords(h))
+	}
+	for _, entry := range opts.LocalTLDs {
+		suffix, ip, err := parseLocalTLD(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !isSpecialUse(suffix) {
+			logger.Warn("local TLD may shadow public names", zap.String("suffix", suffix))
+		}
+		logger.Info("serving local TLD", zap.String("suffix", suffix), zap.Stringer("ip", ip))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithLocalTLD(suffix, ip))
+	}
+	if len(opts.CAAPath) > 0 {
+		r, cnt, err := loadCAARecords(opts.CAAPath)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Serving %d CAA records from %q", cnt, opts.CAAPath))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithCAARecords(r))
+	}
+	if len(opts.TXTPath) > 0 {
+		r, cnt, err := loadTXTRecords(opts.TXTPath)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Serving %d TXT records from %q", cnt, opts.TXTPath))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithTXTRecords(r))
+	}
+	if len(opts.PolicyPath) > 0 {
+		p, cnt, err := loadPolicy(opts.PolicyPath)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Applying %d policy rules from %q", cnt, opts.PolicyPath))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithPolicy(p))
+	}
+	if opts.FailClosed || opts.FailOpen {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithBlocklistReadiness(blocklist, opts.FailOpen))
+	}
+	if len(opts.DNS64Prefix) > 0 {
+		p, err := dns64.Parse(opts.DNS64Prefix)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("DNS64", zap.Stringer("prefix", p))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithDNS64(p))
+	}
+	for _, f := range opts.ResponseFilters {
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithResponseFilters(f))
+	}
+	if opts.Sinkhole {
+		logger.Info("sinkhole mode: blocking every name that is not explicitly allowed")
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithSinkhole(blocklist))
+	}
+	if len(opts.BlockedIPsPath) > 0 {
+		l, cnt, err := loadCIDRList(opts.BlockedIPsPath)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Blocking answers in %d IP ranges from %q", cnt, opts.BlockedIPsPath))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithBlockedIPs(l))
+	}
+	if len(opts.SuppressTypesPath) > 0 {
+		f, cnt, err := loadTypeFilter(opts.SuppressTypesPath)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Suppressing %d domain types from %q", cnt, opts.SuppressTypesPath))
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithSuppressedTypes(f))
+	}
+	var closers []io.Closer
+	for _, pool := range pools {
+		closers = append(closers, pool)
+	}
+	var certs *certreload.Reloader
+	if opts.DoTPort > 0 {
+		var err error
+		certs, err = certreload.New(opts.TLSCertPath, opts.TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, certs)
+	}
+	if len(opts.SyslogAddr) > 0 {
+		facility := opts.SyslogFacility
+		if len(facility) < 1 {
+			facility = "daemon"
+		}
+		reporter, err := blocksyslog.New(opts.SyslogAddr, facility)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, reporter)
+		handlerOpts = append(handlerOpts, dnsqueryhandler.WithBlockReporter(reporter))
+	}
+
+	drain := &drainState{}
+	handlerOpts = append(handlerOpts, dnsqueryhandler.WithDrain(drain))
+
+	maintenanceRcode := dns.RcodeServerFailure
+	if len(opts.MaintenanceRcode) > 0 {
+		rcode, err := parseRcode(opts.MaintenanceRcode)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance rcode: %w", err)
+		}
+		maintenanceRcode = rcode
+	}
+	maintenance := &maintenanceState{}
+	handlerOpts = append(handlerOpts, dnsqueryhandler.WithMaintenance(maintenance, maintenanceRcode))
+
+	queryHandler := dnsqueryhandler.New(
+		logger,
+		exchanger,
+		chooser,
+		blocklist,
+		handlerOpts...,
+	)
+
+	var handler dns.Handler = dns.HandlerFunc(queryHandler.HandleAandAAAA)
+	if opts.Workers > 0 {
+		pool := workerpool.New(handler, opts.Workers)
+		closers = append(closers, pool)
+		handler = pool
+		logger.Info(fmt.Sprintf("Handling queries with %d workers", opts.Workers))
+	}
+
+	s := &Server{
+		logger:    logger,
+		opts:      opts,
+		handler:   handler,
+		blocklist: blocklist,
+		closers:   closers,
+		certs:     certs,
+		quota:     q,
+		drain:     drain,
+		pools:     pools,
+
+		maintenance: maintenance,
+
+		blocklistLoader: loader,
+		listenConfig:    net.ListenConfig{Control: control},
+		udpListenConfig: net.ListenConfig{Control: udpControl},
+		connLimit:       connLimit,
+	}
+	if opts.ReloadDebounce > 0 {
+		s.reloads = debounce(opts.ReloadDebounce, s.refreshBlocklist)
+		s.closers = append(s.closers, s.reloads)
+	}
+	logger.Info("configuration", summary(opts, addrs, fallback, loader, blockCnt)...)
+	return s, nil
+}
+
+// Start starts listening on the configured ports. It returns once all
+// listeners are ready to serve queries. If Start fails, Shutdown should still be
+// called to stop any listeners that were already started.
+func (s *Server) Start() error {
+	if s.opts.UDPPort > 0 {
+		pc, err := s.udpListenConfig.ListenPacket(context.Background(), "udp", fmt.Sprintf(":%d", s.opts.UDPPort))
+		if err != nil {
+			return fmt.Errorf("listening on udp: %w", err)
+		}
+		if s.opts.UDPReceiveBuffer != 0 || s.opts.UDPSendBuffer != 0 {
+			s.logSocketBuffers(pc)
+		}
+		if err := s.serve(&dns.Server{PacketConn: pc, Net: "udp"}); err != nil {
+			return err
+		}
+	}
+
+	if s.opts.TCPPort > 0 {
+		l, err := s.listenConfig.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", s.opts.TCPPort))
+		if err != nil {
+			return fmt.Errorf("listening on tcp: %w", err)
+		}
+		l = s.limitConns(l)
+		if err := s.serve(&dns.Server{Listener: l, Net: "tcp"}); err != nil {
+			return err
+		}
+	}
+
+	if s.opts.DoTPort > 0 {
+		l, err := s.listenConfig.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", s.opts.DoTPort))
+		if err != nil {
+			return fmt.Errorf("listening on tcp-tls: %w", err)
+		}
+		l = s.limitConns(l)
+		l = tls.NewListener(l, &tls.Config{
+			GetCertificate: s.certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		})
+		if err := s.serve(&dns.Server{Listener: l, Net: "tcp-tls"}); err != nil {
+			return err
+		}
+		if s.opts.TLSCertReloadInterval > 0 {
+			s.certs.Poll(s.opts.TLSCertReloadInterval, func(err error) {
+				s.logger.Error("failed to reload TLS certificate", zap.Error(err))
+			})
+		}
+	}
+
+	if len(s.opts.BlocklistDNSName) > 0 && s.opts.BlocklistDNSRefresh > 0 {
+		s.closers = append(s.closers, every(s.opts.BlocklistDNSRefresh, s.refreshBlocklist))
+	}
+	s.closers = append(s.closers, every(time.Minute, s.pruneBlocklist))
+	if !s.blocklist.Ready() {
+		go s.loadBlocklistInBackground()
+	}
+	if s.opts.WatchBlocklist {
+		s.watchBlocklist()
+	}
+	if s.quota != nil {
+		s.closers = append(s.closers, every(time.Minute, s.pruneQuota))
+	}
+	if len(s.pools) > 0 {
+		s.closers = append(s.closers, every(upstreamPoolIdleTimeout(s.opts), s.prunePools))
+	}
+
+	if len(s.opts.AdminAddr) > 0 {
+		l, err := net.Listen("tcp", s.opts.AdminAddr)
+		if err != nil {
+			return fmt.Errorf("listening for admin API: %w", err)
+		}
+		s.admin = &http.Server{
+			Handler:           admin.New(s.logger, s.opts.AdminToken, s),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			if err := s.admin.Serve(l); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("serving admin API failed", zap.Error(err))
+			}
+		}()
+		s.logger.Info(fmt.Sprintf("admin API listening at %s", l.Addr()))
+	}
+
+	return nil
+}
+
+// Shutdown gracefully shuts down all listeners, including the admin API.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, srv := range s.servers {
+		if err := srv.ShutdownContext(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("shutting down %s: %w", srv.Net, err)
+		}
+	}
+	s.servers = nil
+
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("shutting down admin API: %w", err)
+		}
+		s.admin = nil
+	}
+
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.closers = nil
+
+	return firstErr
+}
+
+func (s *Server) serve(srv *dns.Server) error {
+	srv.Handler = s.handler
+	if srv.Net != "udp" && s.opts.TCPIdleTimeout > 0 {
+		srv.IdleTimeout = func() time.Duration { return s.opts.TCPIdleTimeout }
+	}
+	if srv.Net != "udp" {
+		srv.MaxTCPQueries = s.opts.MaxConnQueries
+	}
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ActivateAndServe()
+	}()
+
+	select {
+	case <-started:
+	case err := <-errc:
+		return fmt.Errorf("serving %s: %w", srv.Net, err)
+	}
+
+	go func() {
+		if err := <-errc; err != nil {
+			s.logger.Error("serving failed", zap.String("net", srv.Net), zap.Error(err))
+		}
+	}()
+
+	addr := ""
+	if srv.PacketConn != nil {
+		addr = srv.PacketConn.LocalAddr().String()
+	} else {
+		addr = srv.Listener.Addr().String()
+	}
+	s.logger.Info(fmt.Sprintf("listening at %s (%s)", addr, srv.Net))
+
+	s.servers = append(s.servers, srv)
+	return nil
+}
+
+// limitConns makes the connections of l count against the TCP connection
+// limit, if any. It must wrap the raw TCP listener, below TLS.
+func (s *Server) limitConns(l net.Listener) net.Listener {
+	if s.connLimit == nil {
+		return l
+	}
+	return s.connLimit.Listener(l)
+}
+
+// logSocketBuffers logs the effective buffer sizes of pc, which the kernel may
+// have adjusted from the requested ones.
+func (s *Server) logSocketBuffers(pc net.PacketConn) {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		s.logger.Warn("reading UDP socket buffer sizes", zap.Error(err))
+		return
+	}
+	rcvbuf, sndbuf, err := sockbuf.Sizes(raw)
+	if err != nil {
+		s.logger.Warn("reading UDP socket buffer sizes", zap.Error(err))
+		return
+	}
+	s.logger.Info("UDP socket buffers",
+		zap.Int("rcvbuf", rcvbuf),
+		zap.Int("sndbuf", sndbuf),
+	)
+}
+
+// chainControl returns a control function that calls each non-nil f in turn,
+// stopping at the first error.
+func chainControl(fs ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, f := range fs {
+			if f == nil {
+				continue
+			}
+			if err := f(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// testUpstreams sends a control query to each upstream and logs its rtt. It
+// returns an error if any upstream fails to answer.
+func testUpstreams(logger *zap.Logger, e exchanger, upstreams []string) error {
+	const controlName = "example.com."
+
+	var failed []string
+	for _, ns := range upstreams {
+		q := &dns.Msg{}
+		q.SetQuestion(controlName, dns.TypeA)
+
+		res, rtt, err := e.Exchange(q, ns)
+		if err == nil && res.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("unexpected rcode: %s", dns.RcodeToString[res.Rcode])
+		}
+		if err != nil {
+			logger.Warn("upstream test query failed",
+				zap.String("nameserver", ns),
+				zap.Error(err),
+			)
+			failed = append(failed, ns)
+			continue
+		}
+
+		logger.Info("upstream test query succeeded",
+			zap.String("nameserver", ns),
+			zap.Duration("rtt", rtt),
+		)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("nameservers failed to answer: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// parseUpstream parses a nameserver spec. Bare IPs are queried over TLS if
+// tlsServerName is set, which is also the default server name of tls:// specs.
+func parseUpstream(spec, tlsServerName string) (upstream.Upstream, error) {
+	u, err := upstream.Parse(spec)
+	if err != nil {
+		return u, err
+	}
+	if len(tlsServerName) > 0 && net.ParseIP(spec) != nil {
+		host, _, _ := net.SplitHostPort(u.Address)
+		u = upstream.Upstream{Protocol: upstream.ProtocolTLS, Address: net.JoinHostPort(host, "853")}
+	}
+	if u.Protocol == upstream.ProtocolTLS && len(u.ServerName) < 1 {
+		if len(tlsServerName) < 1 {
+			return u, fmt.Errorf("nameserver %q requires a TLS server name", spec)
+		}
+		u.ServerName = tlsServerName
+	}
+	return u, nil
+}
+
+// httpsClient returns a DNS over HTTPS client with the timeouts and dialer of
+// c. If upstream pooling is enabled, it bounds the idle connections per host.
+func httpsClient(c *dns.Client, opts Options) *upstream.HTTPSClient {
+	d := &net.Dialer{Timeout: c.DialTimeout}
+	if c.Dialer != nil {
+		d = streamClient(c).Dialer
+	}
+	t := &http.Transport{
+		DialContext:       d.DialContext,
+		TLSClientConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	if opts.UpstreamPoolSize > 0 {
+		t.MaxIdleConnsPerHost = opts.UpstreamPoolSize
+		t.IdleConnTimeout = upstreamPoolIdleTimeout(opts)
+	}
+	return &upstream.HTTPSClient{
+		Client: &http.Client{
+			Timeout:   c.DialTimeout + c.ReadTimeout + c.WriteTimeout,
+			Transport: t,
+		},
+	}
+}
+
+// streamClient returns a client like c that uses TCP, unless c already uses
+// TLS, for queries whose responses may not fit into a UDP message.
+func streamClient(c *dns.Client) *dns.Client {
+	tc := &dns.Client{
+		Net:          c.Net,
+		TLSConfig:    c.TLSConfig,
+		Dialer:       c.Dialer,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+	}
+	if len(tc.Net) > 0 {
+		return tc
+	}
+
+	tc.Net = "tcp"
+	if tc.Dialer != nil {
+		d := *tc.Dialer
+		if a, ok := d.LocalAddr.(*net.UDPAddr); ok {
+			d.LocalAddr = &net.TCPAddr{IP: a.IP}
+		}
+		tc.Dialer = &d
+	}
+	return tc
+}
+
+// parseBlockIPs parses the IPs to answer blocked queries with. Either may be
+// empty, which results in nil. ip4 must be an IPv4 address and ip6 an IPv6
+// address.
+func parseBlockIPs(ip4, ip6 string) (net.IP, net.IP, error) {
+	var v4, v6 net.IP
+	if len(ip4) > 0 {
+		v4 = net.ParseIP(ip4)
+		if v4 == nil || v4.To4() == nil {
+			return nil, nil, fmt.Errorf("invalid block IPv4 address: %q", ip4)
+		}
+	}
+	if len(ip6) > 0 {
+		v6 = net.ParseIP(ip6)
+		if v6 == nil || v6.To4() != nil {
+			return nil, nil, fmt.Errorf("invalid block IPv6 address: %q", ip6)
+		}
+	}
+	return v4, v6, nil
+}
+
+// upstreamPoolIdleTimeout returns how long pooled upstream connections may be
+// idle.
+func upstreamPoolIdleTimeout(opts Options) time.Duration {
+	if opts.UpstreamPoolIdleTimeout > 0 {
+		return opts.UpstreamPoolIdleTimeout
+	}
+	return 10 * time.Second
+}
+
+// parseRedirectIPs parses the IPs to redirect NXDOMAIN to, which may hold at
+// most one address per family.
+func parseRedirectIPs(ips []string) (net.IP, net.IP, error) {
+	var v4, v6 net.IP
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return nil, nil, fmt.Errorf("invalid NXDOMAIN redirect IP: %q", s)
+		case ip.To4() != nil && v4 == nil:
+			v4 = ip.To4()
+		case ip.To4() == nil && v6 == nil:
+			v6 = ip
+		default:
+			return nil, nil, fmt.Errorf("more than one NXDOMAIN redirect IP per family: %q", s)
+		}
+	}
+	return v4, v6, nil
+}
+
+// specialUseSuffixes are reserved for testing, documentation, or local use
+// (RFC 2606, RFC 6761, RFC 6762, and RFC 8375), so they never exist publicly.
+var specialUseSuffixes = []string{"test.", "example.", "invalid.", "localhost.", "local.", "home.arpa.", "internal."}
+
+// parseLocalTLD parses a `suffix=IP` local TLD entry.
+func parseLocalTLD(entry string) (string, net.IP, error) {
+	idx := strings.LastIndexByte(entry, '=')
+	if idx < 0 {
+		return "", nil, fmt.Errorf("invalid local TLD %q: expected suffix=IP", entry)
+	}
+	suffix, addr := entry[:idx], entry[idx+1:]
+	if _, ok := dns.IsDomainName(suffix); !ok || strings.Contains(suffix, "*") || suffix == "." {
+		return "", nil, fmt.Errorf("invalid local TLD suffix: %q", suffix)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid local TLD IP: %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return dns.CanonicalName(suffix), ip, nil
+}
+
+// isSpecialUse reports whether suffix is, or is under, a special-use name.
+func isSpecialUse(suffix string) bool {
+	for _, name := range specialUseSuffixes {
+		if dns.IsSubDomain(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideNameservers maps the IPs of the plain DNS and DNS over TLS upstreams,
+// which clients may pick with an upstream override, to their addresses. If
+// several share an IP, the first one is picked.
+func overrideNameservers(upstreams []upstream.Upstream) map[string]string {
+	m := map[string]string{}
+	for _, u := range upstreams {
+		if u.Protocol == upstream.ProtocolHTTPS {
+			continue
+		}
+		host, _, err := net.SplitHostPort(u.Address)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if _, ok := m[ip.String()]; !ok {
+			m[ip.String()] = u.String()
+		}
+	}
+	return m
+}
+
+// parseRcode parses the name of an rcode, e.g. `notimp`. Empty means REFUSED.
+func parseRcode(name string) (int, error) {
+	if len(name) < 1 {
+		return dns.RcodeRefused, nil
+	}
+	rcode, ok := dns.StringToRcode[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown rcode: %q", name)
+	}
+	return rcode, nil
+}
+
+func loadHosts(filepath string) (*hosts.Hosts, uint, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening static records: %w", err)
+	}
+	defer f.Close()
+
+	return hosts.Load(f)
+}
+
+func loadCAARecords(filepath string) (*caa.Records, uint, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening CAA records: %w", err)
+	}
+	defer f.Close()
+
+	return caa.Load(f)
+}
+
+func loadTXTRecords(filepath string) (*txtrecords.Records, uint, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening TXT records: %w", err)
+	}
+	defer f.Close()
+
+	return txtrecords.Load(f)
+}
+
+func loadPolicy(filepath string) (*policy.Policy, uint, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening policy: %w", err)
+	}
+	defer f.Close()
+
+	return policy.Load(f)
+}
+
+func loadCIDRList(filepath string) (*cidrlist.CIDRList, uint, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening CIDR list: %w", err)
+	}
+	defer f.Close()
+
+	return cidrlist.Load(f)
+}
+
+func loadTypeFilter(filepath string) (*typefilter.TypeFilter, uint, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("opening type filter: %w", err)
+	}
+	defer f.Close()
+
+	return typefilter.Load(f)
+}
+
+// prunePools closes pooled upstream connections that have been idle for too
+// long.
+func (s *Server) prunePools() {
+	for _, p := range s.pools {
+		if n := p.Prune(); n > 0 {
+			s.logger.Debug(fmt.Sprintf("Closed %d idle upstream connections", n))
+		}
+	}
+}
@@ -0,0 +1,494 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package mydns_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/execjosh/mydns"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNewServerValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		opts mydns.Options
+	}{
+		{"no ports", mydns.Options{Nameservers: []string{"192.0.2.1"}}},
+		{"no nameservers", mydns.Options{UDPPort: 1053}},
+		{"invalid nameserver", mydns.Options{UDPPort: 1053, Nameservers: []string{"dns.example"}}},
+		{"invalid upstream source", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, UpstreamSource: "eth0"}},
+		{"invalid unsupported type rcode", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, UnsupportedTypeRcode: "nope"}},
+		{"DoT without certificate", mydns.Options{DoTPort: 8853, Nameservers: []string{"192.0.2.1"}}},
+		{"IPv6 block IPv4 address", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, BlockIP4: "2001:db8::1"}},
+		{"IPv4 block IPv6 address", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, BlockIP6: "192.0.2.53"}},
+		{"unknown maintenance rcode", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, MaintenanceRcode: "nope"}},
+		{"negative TCP connection limit", mydns.Options{TCPPort: 1053, Nameservers: []string{"192.0.2.1"}, MaxTCPConns: -1}},
+		{"negative per-connection query limit", mydns.Options{TCPPort: 1053, Nameservers: []string{"192.0.2.1"}, MaxConnQueries: -1}},
+		{"TCP idle timeout too long", mydns.Options{TCPPort: 1053, Nameservers: []string{"192.0.2.1"}, TCPIdleTimeout: 2 * time.Hour}},
+		{"invalid client quota", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, ClientQuota: "10000/day"}},
+		{"incomplete stage order", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, StageOrder: []string{"block", "static"}}},
+		{"invalid block mode", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, BlockMode: "nxdomain"}},
+		{"invalid fallback nameserver", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, FallbackNameserver: "dns.example"}},
+		{"CNAME block mode without target", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, BlockMode: "cname"}},
+		{"invalid DSCP", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, DSCP: 64}},
+		{"negative UDP receive buffer", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, UDPReceiveBuffer: -1}},
+		{"invalid unsupported opcode rcode", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, UnsupportedOpcodeRcode: "nope"}},
+		{"NOERROR retry rcode", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, RetryRcodes: []string{"noerror"}, MaxRcodeRetries: 1}},
+		{"negative max rcode retries", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, MaxRcodeRetries: -1}},
+		{"exporting a Bloom filter", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, BlocklistBloomRate: 0.01, BlocklistExportPath: "blocklist.txt"}},
+		{"invalid blocklist Bloom filter rate", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, BlocklistBloomRate: 1}},
+		{"local TLD without IP", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, LocalTLDs: []string{"test"}}},
+		{"invalid local TLD IP", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, LocalTLDs: []string{"test=nope"}}},
+		{"root as local TLD", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, LocalTLDs: []string{".=192.0.2.10"}}},
+		{"invalid EDNS0 option code", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, EDNSPassthrough: []string{"nsid"}}},
+		{"passing cookies through with EDNS cookies", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, EDNSCookie: true, EDNSPassthrough: []string{"3", "10"}}},
+		{"invalid NXDOMAIN redirect IP", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, NXDOMAINRedirect: []string{"nope"}}},
+		{"two NXDOMAIN redirect IPv4 addresses", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, NXDOMAINRedirect: []string{"192.0.2.80", "192.0.2.81"}}},
+		{"negative upstream pool size", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, UpstreamPoolSize: -1}},
+		{"invalid padding block size", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, PaddingBlockSize: -1}},
+		{"invalid DNS64 prefix", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, DNS64Prefix: "64:ff9b::/80"}},
+		{"fail closed and open", mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}, FailClosed: true, FailOpen: true}},
+		{"TLS nameserver without server name", mydns.Options{UDPPort: 1053, Nameservers: []string{"tls://192.0.2.1"}}},
+		{"unsupported nameserver protocol", mydns.Options{UDPPort: 1053, Nameservers: []string{"quic://192.0.2.1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := mydns.NewServer(tt.opts); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	if _, err := mydns.NewServer(mydns.Options{UDPPort: 1053, Nameservers: []string{"192.0.2.1"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMixedNameservers(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	_, err := mydns.NewServer(mydns.Options{
+		Logger:        zap.New(core),
+		UDPPort:       1053,
+		Nameservers:   []string{"192.0.2.1", "tls://192.0.2.2", "tls://192.0.2.3#dns.example", "https://192.0.2.4/dns-query"},
+		TLSServerName: "tls.example",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries := logs.FilterMessage("upstream servers").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected the upstream servers to be logged once; got %d", len(entries))
+	}
+	want := "[tls://192.0.2.1:853#tls.example tls://192.0.2.2:853#tls.example tls://192.0.2.3:853#dns.example https://192.0.2.4/dns-query]"
+	if got := fmt.Sprint(entries[0].ContextMap()["nameservers"]); got != want {
+		t.Errorf("expected %s; got %s", want, got)
+	}
+}
+
+func TestLocalTLDWarning(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	_, err := mydns.NewServer(mydns.Options{
+		Logger:      zap.New(core),
+		UDPPort:     1053,
+		Nameservers: []string{"192.0.2.1"},
+		LocalTLDs:   []string{"test=192.0.2.10", "dev.home.arpa=192.0.2.11", "lab=192.0.2.20", "Corp.Example.COM=192.0.2.30"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var warned []string
+	for _, entry := range logs.FilterMessage("local TLD may shadow public names").All() {
+		warned = append(warned, fmt.Sprint(entry.ContextMap()["suffix"]))
+	}
+	if want := "lab. corp.example.com."; strings.Join(warned, " ") != want {
+		t.Errorf("expected warnings for %s; got %v", want, warned)
+	}
+}
+
+func TestReloadBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.list")
+	if err := ioutil.WriteFile(path, []byte("sub1.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := mydns.NewServer(mydns.Options{
+		UDPPort:       1053,
+		Nameservers:   []string{"192.0.2.1"},
+		BlocklistPath: path,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("sub1.example.com\nsub2.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before, after, err := srv.ReloadBlocklist()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if before != 1 || after != 2 {
+		t.Errorf("expected 1 entry before and 2 after; got %d and %d", before, after)
+	}
+}
+
+func TestExportBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "block.list")
+	exportPath := filepath.Join(dir, "effective.list")
+	if err := ioutil.WriteFile(path, []byte("Sub1.example.com\nsub1.example.com.\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := mydns.NewServer(mydns.Options{
+		UDPPort:             1053,
+		Nameservers:         []string{"192.0.2.1"},
+		BlocklistPath:       path,
+		BlocklistExportPath: exportPath,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertFile(t, exportPath, "sub1.example.com.\n")
+
+	if err := ioutil.WriteFile(path, []byte("sub2.example.com\n@@sub1.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.ReloadBlocklist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertFile(t, exportPath, "sub2.example.com.\n@@sub1.example.com.\n")
+}
+
+func assertFile(t *testing.T, path, want string) {
+	t.Helper()
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("expected %s to hold %q; got %q", path, want, got)
+	}
+}
+
+func TestScheduleBlocklistReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.list")
+	if err := ioutil.WriteFile(path, []byte("sub1.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	srv, err := mydns.NewServer(mydns.Options{
+		Logger:         zap.New(core),
+		UDPPort:        1053,
+		Nameservers:    []string{"192.0.2.1"},
+		BlocklistPath:  path,
+		ReloadDebounce: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+	loads := logs.FilterMessageSnippet("Blocking").Len()
+
+	// an editor writing the file several times in a row
+	var content string
+	for i := 2; i <= 4; i++ {
+		content += fmt.Sprintf("sub%d.example.com\n", i)
+		if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		srv.ScheduleBlocklistReload()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, blocked := srv.MatchBlocklist("sub4.example.com."); blocked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the latest blocklist to be loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if got := logs.FilterMessageSnippet("Blocking").Len() - loads; got != 1 {
+		t.Errorf("expected a single reload; got %d", got)
+	}
+}
+
+func TestConfigurationSummary(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	_, err := mydns.NewServer(mydns.Options{
+		Logger:      zap.New(core),
+		UDPPort:     1053,
+		Nameservers: []string{"192.0.2.1"},
+		MinimalANY:  true,
+		AdminAddr:   "127.0.0.1:8053",
+		AdminToken:  "s3cret",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries := logs.FilterMessage("configuration").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected a single configuration summary; got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if got := fields["udpPort"]; got != int64(1053) {
+		t.Errorf("expected UDP port 1053; got %v", got)
+	}
+	if got := fmt.Sprint(fields["features"]); got != "[minimal-any]" {
+		t.Errorf("expected features [minimal-any]; got %s", got)
+	}
+	if got := fields["adminToken"]; got != true {
+		t.Errorf("expected admin token to be reported as set; got %v", got)
+	}
+	if strings.Contains(fmt.Sprint(fields), "s3cret") {
+		t.Error("expected admin token to be redacted")
+	}
+}
+
+func TestBlocklistFromStdin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.list")
+	if err := ioutil.WriteFile(path, []byte("sub1.example.com\nsub2.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stdin := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = stdin }()
+
+	srv, err := mydns.NewServer(mydns.Options{
+		UDPPort:       1053,
+		Nameservers:   []string{"192.0.2.1"},
+		BlocklistPath: "-",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	before, after, err := srv.ReloadBlocklist()
+	if err == nil {
+		t.Error("expected reloading from stdin to fail")
+	}
+	if before != 2 || after != 2 {
+		t.Errorf("expected the 2 entries read from stdin to be kept; got %d and %d", before, after)
+	}
+}
+
+func TestMaxConnQueries(t *testing.T) {
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("192.0.2.10 www.dev.local\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	srv, err := mydns.NewServer(mydns.Options{
+		Logger:         zap.NewNop(),
+		TCPPort:        port,
+		Nameservers:    []string{"192.0.2.1"},
+		HostsPath:      hosts,
+		MaxConnQueries: 2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	conn, err := dns.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// pipeline all queries before reading any response
+	for i := 0; i < 4; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("www.dev.local.", dns.TypeA)
+		if err := conn.WriteMsg(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var answered int
+	for {
+		if _, err := conn.ReadMsg(); err != nil {
+			break
+		}
+		answered++
+	}
+	if answered != 2 {
+		t.Errorf("expected 2 queries to be answered before the connection was closed; got %d", answered)
+	}
+}
+
+// startUpstream serves plain DNS on a free UDP port, answering every query
+// with rcode, and returns its address.
+func startUpstream(t *testing.T, rcode int) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetRcode(r, rcode)
+			w.WriteMsg(res)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+func TestTestUpstreamFallback(t *testing.T) {
+	ok := startUpstream(t, dns.RcodeSuccess)
+	refusing := startUpstream(t, dns.RcodeRefused)
+
+	tests := []struct {
+		name     string
+		fallback string
+		wantErr  bool
+	}{
+		{"no fallback", "", false},
+		{"working fallback", ok, false},
+		{"failing fallback", refusing, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mydns.NewServer(mydns.Options{
+				Logger:             zap.NewNop(),
+				UDPPort:            1053,
+				Nameservers:        []string{ok},
+				FallbackNameserver: tt.fallback,
+				TestUpstream:       "fatal",
+			})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), refusing) {
+					t.Errorf("expected the fallback %s to fail the test; got %v", refusing, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// startTXTUpstream serves plain DNS over TCP on a free port, answering TXT
+// queries for name with entries, and returns its address.
+func startTXTUpstream(t *testing.T, name string, entries ...string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetReply(r)
+			res.Answer = append(res.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: entries,
+			})
+			w.WriteMsg(res)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return l.Addr().String()
+}
+
+// closedPort returns the address of a TCP port nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestBlocklistDNSFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "block.list")
+	if err := ioutil.WriteFile(path, []byte("tracker.example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	down := closedPort(t)
+	up := startTXTUpstream(t, "blocklist.example.com.", "ads.example.com")
+
+	tests := []struct {
+		name        string
+		nameservers []string
+		wantTXT     bool
+	}{
+		{"all nameservers down", []string{down}, false},
+		{"next nameserver answers", []string{down, up}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := mydns.NewServer(mydns.Options{
+				Logger:           zap.NewNop(),
+				UDPPort:          1053,
+				Nameservers:      tt.nameservers,
+				BlocklistPath:    path,
+				BlocklistDNSName: "blocklist.example.com",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, blocked := srv.MatchBlocklist("tracker.example.com."); !blocked {
+				t.Error("expected the entries of the file to be loaded")
+			}
+			if _, blocked := srv.MatchBlocklist("ads.example.com."); blocked != tt.wantTXT {
+				t.Errorf("expected the TXT entries to be loaded: %v; got %v", tt.wantTXT, blocked)
+			}
+		})
+	}
+}
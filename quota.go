@@ -0,0 +1,28 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package mydns
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// ClientQuota reports the quota of ip: the number of queries allowed per
+// window, how many are left, and when the current window resets. ok is false
+// if client quotas are disabled.
+func (s *Server) ClientQuota(ip net.IP) (limit uint64, remaining uint64, reset time.Time, ok bool) {
+	if s.quota == nil {
+		return 0, 0, time.Time{}, false
+	}
+	remaining, reset = s.quota.Remaining(ip)
+	return s.quota.Limit(), remaining, reset, true
+}
+
+// pruneQuota frees the quotas of clients that have been idle for a window.
+func (s *Server) pruneQuota() {
+	if n := s.quota.Prune(); n > 0 {
+		s.logger.Debug(fmt.Sprintf("Pruned the quotas of %d idle clients", n))
+	}
+}
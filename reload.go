@@ -0,0 +1,365 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package mydns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/execjosh/mydns/internal/blocklist"
+	"github.com/execjosh/mydns/internal/filewatch"
+	"github.com/execjosh/mydns/internal/roundrobin"
+	"github.com/execjosh/mydns/internal/txtlist"
+	"go.uber.org/zap"
+)
+
+// stdinPath is the blocklist path that reads from stdin.
+const stdinPath = "-"
+
+// blocklistProgressLines is how many lines of a blocklist are read between
+// progress logs, so only huge blocklists log their progress.
+const blocklistProgressLines = 1000000
+
+// errReloadStdin is returned when reloading a blocklist that was read from
+// stdin, which cannot be read again.
+var errReloadStdin = errors.New("blocklist was read from stdin and cannot be reloaded")
+
+type loadedBlocklist struct {
+	bl  *blocklist.Blocklist
+	cnt uint
+}
+
+// swappableBlocklist is a blocklist that can be atomically replaced while
+// queries are being answered.
+type swappableBlocklist struct {
+	v     atomic.Value // loadedBlocklist
+	mu    sync.Mutex   // serializes reloads
+	ready int32        // set once the first load has finished
+}
+
+func newSwappableBlocklist(bl *blocklist.Blocklist, cnt uint) *swappableBlocklist {
+	b := &swappableBlocklist{}
+	b.v.Store(loadedBlocklist{bl, cnt})
+	return b
+}
+
+// newPendingBlocklist returns an empty blocklist that is not ready until its
+// first load has finished.
+func newPendingBlocklist() *swappableBlocklist {
+	return newSwappableBlocklist(blocklist.Empty(), 0)
+}
+
+// Ready returns whether the first load of the blocklist has finished.
+func (b *swappableBlocklist) Ready() bool {
+	return atomic.LoadInt32(&b.ready) == 1
+}
+
+func (b *swappableBlocklist) markReady() {
+	atomic.StoreInt32(&b.ready, 1)
+}
+
+// Contains returns whether the current blocklist contains fqdn.
+func (b *swappableBlocklist) Contains(fqdn string) bool {
+	return b.v.Load().(loadedBlocklist).bl.Contains(fqdn)
+}
+
+// Allows returns whether the current blocklist has an exception for fqdn.
+func (b *swappableBlocklist) Allows(fqdn string) bool {
+	return b.v.Load().(loadedBlocklist).bl.Allows(fqdn)
+}
+
+// MatchBlocklist returns whether the current blocklist blocks fqdn, together
+// with the entry that decided it, as described for blocklist.Blocklist.Match.
+// It does not take the policy file into account.
+func (s *Server) MatchBlocklist(fqdn string) (entry string, blocked bool) {
+	return s.blocklist.v.Load().(loadedBlocklist).bl.Match(fqdn)
+}
+
+// ReloadBlocklist re-reads the blocklist file and TXT records, if any, and
+// atomically replaces the blocklist in use. If loading either fails, the
+// current blocklist is kept. It returns the number of blocked entries before
+// and after the reload. A blocklist read from stdin cannot be reloaded.
+func (s *Server) ReloadBlocklist() (before uint, after uint, err error) {
+	s.blocklist.mu.Lock()
+	defer s.blocklist.mu.Unlock()
+
+	before = s.blocklist.v.Load().(loadedBlocklist).cnt
+	if s.blocklistLoader.path == stdinPath {
+		return before, before, errReloadStdin
+	}
+
+	bl, cnt, err := s.blocklistLoader.load()
+	if err != nil {
+		return before, before, fmt.Errorf("reloading blocklist: %w", err)
+	}
+	s.blocklist.v.Store(loadedBlocklist{bl, cnt})
+	if err := s.blocklistLoader.export(bl); err != nil {
+		s.logger.Warn("failed to export blocklist", zap.Error(err))
+	}
+
+	s.logger.Info(fmt.Sprintf("Blocking %d domains from %s", cnt, s.blocklistLoader),
+		zap.Uint("before", before),
+	)
+	return before, cnt, nil
+}
+
+// loadBlocklistInBackground loads the blocklist for the first time while
+// queries are already being answered, then marks it ready. As with loading on
+// startup, a failure leaves the blocklist empty.
+func (s *Server) loadBlocklistInBackground() {
+	s.blocklist.mu.Lock()
+	defer s.blocklist.mu.Unlock()
+	defer s.blocklist.markReady()
+
+	bl, cnt, err := s.blocklistLoader.load()
+	if err != nil {
+		s.logger.Error("failed to load blocklist", zap.Error(err))
+	} else if err := s.blocklistLoader.export(bl); err != nil {
+		s.logger.Warn("failed to export blocklist", zap.Error(err))
+	}
+	s.blocklist.v.Store(loadedBlocklist{bl, cnt})
+	s.logger.Info(fmt.Sprintf("Blocking %d domains from %s", cnt, s.blocklistLoader))
+}
+
+// ReloadTLSCertificate re-reads the DoT certificate and key. If loading fails,
+// the current certificate is kept. It does nothing if DoT is disabled.
+func (s *Server) ReloadTLSCertificate() error {
+	if s.certs == nil {
+		return nil
+	}
+	if err := s.certs.Reload(); err != nil {
+		return err
+	}
+	s.logger.Info(fmt.Sprintf("Reloaded TLS certificate from %q", s.opts.TLSCertPath))
+	return nil
+}
+
+// blocklistLoader loads the blocklist from a file and, optionally, from the
+// TXT records of a control name, which are queried via the upstream
+// nameservers.
+type blocklistLoader struct {
+	path       string
+	opts       []blocklist.LoadOption
+	exportPath string
+
+	txtName     string
+	exchanger   exchanger
+	nameservers *roundrobin.RoundRobin
+	attempts    int // how many nameservers to query for the TXT records
+}
+
+// String describes where the blocklist is loaded from, for logging.
+func (l *blocklistLoader) String() string {
+	switch {
+	case len(l.txtName) > 0 && len(l.path) > 0:
+		return fmt.Sprintf("%q and the TXT records of %q", l.path, l.txtName)
+	case len(l.txtName) > 0:
+		return fmt.Sprintf("the TXT records of %q", l.txtName)
+	}
+	return fmt.Sprintf("%q", l.path)
+}
+
+// load loads the blocklist. If the TXT records cannot be fetched, the entries
+// of the file are loaded anyway, so that blocking does not depend on upstream
+// being reachable, and the error is returned along with them.
+func (l *blocklistLoader) load() (*blocklist.Blocklist, uint, error) {
+	var readers []io.Reader
+
+	switch l.path {
+	case "":
+	case stdinPath:
+		readers = append(readers, os.Stdin)
+	default:
+		f, err := os.Open(l.path)
+		if err != nil {
+			return blocklist.Empty(), 0, fmt.Errorf("opening blocklist: %w", err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	var txtErr error
+	if len(l.txtName) > 0 {
+		entries, err := l.fetchTXT()
+		if err != nil {
+			txtErr = fmt.Errorf("fetching blocklist TXT records: %w", err)
+		} else {
+			// the file may not end with a newline
+			readers = append(readers, strings.NewReader("\n"+strings.Join(entries, "\n")))
+		}
+	}
+
+	if len(readers) < 1 {
+		return blocklist.Empty(), 0, txtErr
+	}
+	bl, cnt, err := blocklist.Load(io.MultiReader(readers...), l.opts...)
+	if err != nil {
+		return bl, cnt, err
+	}
+	return bl, cnt, txtErr
+}
+
+// fetchTXT fetches the entries in the TXT records of the control name, moving
+// on to the next nameserver while queries fail.
+func (l *blocklistLoader) fetchTXT() ([]string, error) {
+	var err error
+	for i := 0; i == 0 || i < l.attempts; i++ {
+		var entries []string
+		if entries, err = txtlist.Fetch(l.exchanger, l.nameservers.Next(), l.txtName); err == nil {
+			return entries, nil
+		}
+	}
+	return nil, err
+}
+
+// export writes bl to the export path, if any. The file is replaced
+// atomically, so readers never see a partial export.
+func (l *blocklistLoader) export(bl *blocklist.Blocklist) error {
+	if len(l.exportPath) < 1 {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(l.exportPath), ".mydns-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	if err := bl.Export(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), l.exportPath)
+}
+
+// ticker runs a function periodically until closed.
+type ticker struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+func every(interval time.Duration, f func()) *ticker {
+	tk := &ticker{stop: make(chan struct{})}
+
+	t := time.NewTicker(interval)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-tk.stop:
+				return
+			case <-t.C:
+				f()
+			}
+		}
+	}()
+
+	return tk
+}
+
+// Close stops the ticker.
+func (tk *ticker) Close() error {
+	tk.once.Do(func() { close(tk.stop) })
+	return nil
+}
+
+// debouncer runs a function once it has not been triggered for a window, so that
+// bursts of triggers coalesce into a single run.
+type debouncer struct {
+	window time.Duration
+	f      func()
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	closed bool
+}
+
+func debounce(window time.Duration, f func()) *debouncer {
+	return &debouncer{window: window, f: f}
+}
+
+// Trigger schedules f to run once window has elapsed without another trigger.
+func (d *debouncer) Trigger() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(d.window, d.f)
+}
+
+// Close cancels a pending run.
+func (d *debouncer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	return nil
+}
+
+// ScheduleBlocklistReload reloads the blocklist like ReloadBlocklist. With a
+// ReloadDebounce window, the reload happens once no other reload has been
+// scheduled for the window, so bursts of triggers, e.g. an editor writing a
+// file several times, result in a single reload of the latest state. Failures
+// are logged.
+func (s *Server) ScheduleBlocklistReload() {
+	if s.reloads == nil {
+		s.refreshBlocklist()
+		return
+	}
+	s.reloads.Trigger()
+}
+
+// blocklistPollInterval is how often a watched blocklist file is checked for
+// changes.
+const blocklistPollInterval = time.Second
+
+// watchBlocklist schedules a reload whenever the blocklist file changes.
+func (s *Server) watchBlocklist() {
+	path := s.blocklistLoader.path
+	switch path {
+	case "":
+		s.logger.Warn("not watching the blocklist, as there is no blocklist file")
+		return
+	case stdinPath:
+		s.logger.Warn("not watching the blocklist, as it was read from stdin")
+		return
+	}
+
+	s.closers = append(s.closers, filewatch.Watch(path, blocklistPollInterval, func() {
+		s.logger.Info(fmt.Sprintf("Blocklist %q changed on disk", path))
+		s.ScheduleBlocklistReload()
+	}))
+}
+
+func (s *Server) refreshBlocklist() {
+	if _, _, err := s.ReloadBlocklist(); err != nil {
+		s.logger.Error("failed to refresh blocklist", zap.Error(err))
+	}
+}
+
+// pruneBlocklist frees temporary blocklist entries that have expired.
+func (s *Server) pruneBlocklist() {
+	if n := s.blocklist.v.Load().(loadedBlocklist).bl.Prune(); n > 0 {
+		s.logger.Info(fmt.Sprintf("Pruned %d expired temporary blocklist entries", n))
+	}
+}
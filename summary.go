@@ -0,0 +1,94 @@
+// Copyright (C) 2021  execjosh
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package mydns
+
+import (
+	"go.uber.org/zap"
+)
+
+// summary returns fields describing the effective configuration, to be logged
+// as a single line on startup. Secrets are redacted; only whether they are set
+// is reported.
+func summary(opts Options, upstreams []string, fallback string, loader *blocklistLoader, blockCnt uint) []zap.Field {
+	blockMode := opts.BlockMode
+	if len(blockMode) < 1 {
+		blockMode = "address"
+	}
+
+	return []zap.Field{
+		zap.Int("udpPort", opts.UDPPort),
+		zap.Int("tcpPort", opts.TCPPort),
+		zap.Int("dotPort", opts.DoTPort),
+		zap.Strings("nameservers", upstreams),
+		zap.String("fallbackNameserver", fallback),
+		zap.String("blocklist", loader.String()),
+		zap.Uint("blocklistEntries", blockCnt),
+		zap.String("blockMode", blockMode),
+		zap.String("adminAddr", opts.AdminAddr),
+		zap.Bool("adminToken", len(opts.AdminToken) > 0),
+		zap.Strings("features", features(opts)),
+	}
+}
+
+// features returns the names of the optional features enabled by opts.
+func features(opts Options) []string {
+	enabled := []struct {
+		name string
+		on   bool
+	}{
+		{"edns-cookie", opts.EDNSCookie},
+		{"edns-passthrough", len(opts.EDNSPassthrough) > 0},
+		{"minimal-any", opts.MinimalANY},
+		{"normalize-qname", opts.NormalizeQNAME},
+		{"ede", opts.ExtendedErrors},
+		{"no-compression", opts.DisableCompression},
+		{"no-recursion-available", opts.DisableRecursionAvailable},
+		{"no-cname-inspection", opts.DisableCNAMEInspection},
+		{"no-answer-log", opts.DisableAnswerLog},
+		{"query-deadline", opts.QueryDeadline > 0},
+		{"retry", opts.RetryWindow > 0},
+		{"upstream-pool", opts.UpstreamPoolSize > 0},
+		{"upstream-override", opts.AllowUpstreamOverride},
+		{"rcode-retry", len(opts.RetryRcodes) > 0 && opts.MaxRcodeRetries > 0},
+		{"upstream-limit", opts.MaxUpstreamConcurrency > 0},
+		{"adaptive-upstreams", opts.AdaptiveUpstreams},
+		{"workers", opts.Workers > 0},
+		{"dscp", opts.DSCP != 0},
+		{"udp-buffers", opts.UDPReceiveBuffer > 0 || opts.UDPSendBuffer > 0},
+		{"tcp-keepalive", opts.TCPIdleTimeout > 0},
+		{"tcp-conn-limit", opts.MaxTCPConns > 0},
+		{"conn-query-limit", opts.MaxConnQueries > 0},
+		{"padding", opts.PaddingBlockSize > 0},
+		{"whoami", len(opts.WhoamiName) > 0},
+		{"client-quota", len(opts.ClientQuota) > 0},
+		{"nxdomain-redirect", len(opts.NXDOMAINRedirect) > 0},
+		{"local-tld", len(opts.LocalTLDs) > 0},
+		{"max-answers", opts.MaxAnswers > 0},
+		{"max-qname-labels", opts.MaxQNameLabels > 0},
+		{"stage-order", len(opts.StageOrder) > 0},
+		{"hosts", len(opts.HostsPath) > 0},
+		{"fallback-hosts", len(opts.FallbackHostsPath) > 0},
+		{"caa", len(opts.CAAPath) > 0},
+		{"txt", len(opts.TXTPath) > 0},
+		{"dns64", len(opts.DNS64Prefix) > 0},
+		{"response-filters", len(opts.ResponseFilters) > 0},
+		{"policy", len(opts.PolicyPath) > 0},
+		{"sinkhole", opts.Sinkhole},
+		{"block-ips", len(opts.BlockedIPsPath) > 0},
+		{"suppress-types", len(opts.SuppressTypesPath) > 0},
+		{"blocklist-bloom", opts.BlocklistBloomRate > 0},
+		{"watch-blocklist", opts.WatchBlocklist},
+		{"fail-closed", opts.FailClosed},
+		{"fail-open", opts.FailOpen},
+		{"syslog", len(opts.SyslogAddr) > 0},
+	}
+
+	names := []string{}
+	for _, f := range enabled {
+		if f.on {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}